@@ -7,10 +7,12 @@ import (
 
 	"github.com/kbuzsaki/cupid/rpcclient"
 	"github.com/kbuzsaki/cupid/server"
+	"golang.org/x/net/context"
 )
 
 const (
 	minimumKeepAliveDelay  = 100 * time.Millisecond
+	maximumKeepAliveDelay  = 3 * time.Second
 	connectionErrorBackoff = 5 * time.Second
 )
 
@@ -27,6 +29,10 @@ type clientImpl struct {
 	nodeCache nodeCache
 	locks     lockSet
 
+	// the sequence number of the last event handled, reported in keepalives so that missed events are sent again
+	seqLock sync.Mutex
+	lastSeq uint64
+
 	keepAliveDelay time.Duration
 	subscriber     Subscriber
 }
@@ -38,11 +44,19 @@ func New(addr string, keepAliveDelay time.Duration) (Client, error) {
 }
 
 func NewRaft(addrs []string, keepAliveDelay time.Duration) (Client, error) {
-	var delegates []server.Server
-	for _, addr := range addrs {
-		delegates = append(delegates, rpcclient.New(addr, keepAliveDelay))
-	}
-	s := &RedirectServer{delegates: delegates, leader: 1, pendingLeader: 1}
+	s := NewRedirectServer(addrs, func(addr string) server.Server {
+		return rpcclient.New(addr, keepAliveDelay)
+	})
+	return newFromServer(s, keepAliveDelay)
+}
+
+// NewRaftFollowerReads is like NewRaft, but reads the contents of nodes from any member of the cluster
+// rather than only from the leader
+func NewRaftFollowerReads(addrs []string, keepAliveDelay time.Duration) (Client, error) {
+	s := NewRedirectServer(addrs, func(addr string) server.Server {
+		return rpcclient.New(addr, keepAliveDelay)
+	})
+	s.EnableFollowerReads()
 	return newFromServer(s, keepAliveDelay)
 }
 
@@ -65,7 +79,7 @@ func newFromServer(s server.Server, keepAliveDelay time.Duration) (Client, error
 	}
 	cl.subscriber = subscriber
 
-	sd, err := s.OpenSession()
+	sd, err := s.OpenSession(server.NewRequestID())
 	if err != nil {
 		return nil, err
 	}
@@ -95,6 +109,12 @@ func (cl *clientImpl) handleEvents(events []server.Event) {
 			cl.nodeCache.Delete(event.Descriptor)
 		case server.ContentInvalidationPushEvent:
 			cl.nodeCache.Put(event.Descriptor, event.NodeContentAndStat)
+		case server.NodeDeletedEvent:
+			cl.nodeCache.Delete(event.Descriptor)
+			cl.locks.Remove(event.Descriptor)
+		case server.ResyncEvent:
+			log.Println("handling resync event:", event)
+			cl.nodeCache.Clear()
 		default:
 			log.Println("Unrecognized event:", rawEvent)
 		}
@@ -116,27 +136,160 @@ func (cl *clientImpl) setClosing() {
 	cl.closing = true
 }
 
-// background does background KeepAlive processing in a goroutine
+// keepAlive keeps the session's event stream open in a goroutine, opening it again through the new leader
+// whenever it fails, until the session is closed or expires. a stream lost to a leader change is opened again
+// right away, and only repeated failures back off, up to connectionErrorBackoff.
 func (cl *clientImpl) keepAlive() {
+	backoff := time.Duration(0)
 	for !cl.isClosing() {
+		stream, err := cl.s.OpenEventStream(cl.sd)
+		if err == nil {
+			start := time.Now()
+			err = cl.serveEventStream(stream)
+			stream.Close()
+			// a stream that stayed up for a while wasn't part of a run of failures
+			if time.Since(start) > maximumKeepAliveDelay {
+				backoff = 0
+			}
+		}
+
+		if cl.isClosing() {
+			return
+		} else if isInvalidSession(err) {
+			log.Println("session expired:", cl.sd)
+			cl.expireSession()
+			return
+		}
+		log.Println("event stream error:", err)
+
+		if isLeaderChange(err) {
+			continue
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff < minimumKeepAliveDelay {
+			backoff = minimumKeepAliveDelay
+		} else if backoff > connectionErrorBackoff {
+			backoff = connectionErrorBackoff
+		}
+	}
+}
+
+// serveEventStream handles the events pushed on stream and acks them, while sending keepalives on it in the
+// background, until the stream fails
+func (cl *clientImpl) serveEventStream(stream server.EventStream) error {
+	done := make(chan struct{})
+	defer close(done)
+	go cl.sendKeepAlives(stream, done)
+
+	for {
+		sequenced, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		events := cl.unseenEvents(sequenced)
+		cl.handleEvents(events)
+
+		seq := sequenced[len(sequenced)-1].Seq
+		cl.setLastSeq(seq)
+		if err := stream.Ack(seq); err != nil {
+			return err
+		}
+	}
+}
+
+// unseenEvents drops the events that were already handled before they were sent again. if some events were lost
+// in between then the cached contents can't be trusted anymore.
+func (cl *clientImpl) unseenEvents(sequenced []server.SequencedEvent) []server.Event {
+	last := cl.getLastSeq()
+
+	var events []server.Event
+	for _, se := range sequenced {
+		if se.Seq <= last {
+			continue
+		} else if se.Seq > last+1 {
+			log.Println("missed events:", last+1, "to", se.Seq-1)
+			cl.nodeCache.Clear()
+		}
+		events = append(events, se.Event)
+		last = se.Seq
+	}
+	return events
+}
+
+func (cl *clientImpl) getLastSeq() uint64 {
+	cl.seqLock.Lock()
+	defer cl.seqLock.Unlock()
+	return cl.lastSeq
+}
+
+func (cl *clientImpl) setLastSeq(seq uint64) {
+	cl.seqLock.Lock()
+	defer cl.seqLock.Unlock()
+	if seq > cl.lastSeq {
+		cl.lastSeq = seq
+	}
+}
+
+// sendKeepAlives sends a keepalive on stream every keepAliveDelay, but at least as often as the server needs them
+func (cl *clientImpl) sendKeepAlives(stream server.EventStream, done <-chan struct{}) {
+	interval := cl.keepAliveDelay
+	if interval < minimumKeepAliveDelay {
+		interval = minimumKeepAliveDelay
+	} else if interval > maximumKeepAliveDelay {
+		interval = maximumKeepAliveDelay
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
 		li := cl.locks.GetLeaseInfo()
 		li.Session = cl.sd
-		//start := time.Now()
-		events, err := cl.s.KeepAlive(li, cl.nodeCache.GetEventInfos(), cl.keepAliveDelay)
-		//fmt.Println(time.Since(start))
-		if err != nil {
-			log.Println("KeepAlive error:", err)
-			time.Sleep(connectionErrorBackoff)
+		li.LastSeq = cl.getLastSeq()
+		// a failed keepalive also fails the stream's Recv, which opens a new one
+		if err := stream.KeepAlive(li, cl.nodeCache.GetEventInfos()); err != nil {
+			return
 		}
 
-		if len(events) > 0 {
-			cl.handleEvents(events)
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
 		}
 	}
 }
 
-func (cl *clientImpl) Open(path string, readOnly bool, config server.EventsConfig) (NodeHandle, error) {
-	nd, err := cl.s.Open(cl.sd, path, readOnly, config)
+// isInvalidSession checks whether err means that the server no longer knows about our session.
+// errors lose their identity over rpc, so compare the messages instead.
+func isInvalidSession(err error) bool {
+	return err != nil && err.Error() == server.ErrInvalidSessionDescriptor.Error()
+}
+
+// isLeaderChange checks whether err means that the stream's server stopped being the leader, in which case the
+// redirecting server finds the new one when the stream is opened again
+func isLeaderChange(err error) bool {
+	if err == nil {
+		return false
+	} else if _, rerr := unmarshalRedirectError(err.Error()); rerr == nil {
+		return true
+	}
+	return err.Error() == server.ErrLeadershipLost.Error()
+}
+
+// expireSession drops all of the state that was tied to a session the server has closed
+func (cl *clientImpl) expireSession() {
+	var events []server.Event
+	for _, nd := range cl.locks.GetLeaseInfo().LockedNodes {
+		events = append(events, server.LockInvalidationEvent{Descriptor: nd})
+	}
+	cl.handleEvents(events)
+
+	cl.nodeCache.Clear()
+	cl.setClosing()
+}
+
+func (cl *clientImpl) Open(path string, readOnly bool, ephemeral bool, config server.EventsConfig) (NodeHandle, error) {
+	nd, err := cl.s.Open(server.NewRequestID(), cl.sd, path, readOnly, ephemeral, config)
 	if err != nil {
 		return nil, err
 	}
@@ -144,8 +297,16 @@ func (cl *clientImpl) Open(path string, readOnly bool, config server.EventsConfi
 	return &nodeHandleImpl{cl, nd}, nil
 }
 
+func (cl *clientImpl) List(dir string) ([]server.DirEntry, error) {
+	return cl.s.List(cl.sd, dir)
+}
+
+func (cl *clientImpl) CheckSequencer(seq server.Sequencer) (bool, error) {
+	return cl.s.CheckSequencer(seq)
+}
+
 func (cl *clientImpl) Close() error {
-	err := cl.s.CloseSession(cl.sd)
+	err := cl.s.CloseSession(server.NewRequestID(), cl.sd)
 	if err != nil {
 		return err
 	}
@@ -160,7 +321,7 @@ type nodeHandleImpl struct {
 }
 
 func (nh *nodeHandleImpl) Close() error {
-	err := nh.cl.s.CloseNode(nh.nd)
+	err := nh.cl.s.CloseNode(server.NewRequestID(), nh.nd)
 	if err != nil {
 		return err
 	}
@@ -171,7 +332,7 @@ func (nh *nodeHandleImpl) Close() error {
 }
 
 func (nh *nodeHandleImpl) Acquire() error {
-	if nh.cl.locks.Contains(nh.nd) {
+	if nh.cl.locks.ContainsExclusive(nh.nd) {
 		return nil
 	}
 
@@ -185,12 +346,41 @@ func (nh *nodeHandleImpl) Acquire() error {
 	return nil
 }
 
+func (nh *nodeHandleImpl) AcquireContext(ctx context.Context) error {
+	if nh.cl.locks.ContainsExclusive(nh.nd) {
+		return nil
+	}
+
+	err := nh.cl.s.AcquireContext(ctx, nh.nd)
+	if err != nil {
+		return err
+	}
+
+	nh.cl.locks.Add(nh.nd)
+
+	return nil
+}
+
+func (nh *nodeHandleImpl) AcquireTimeout(timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := nh.AcquireContext(ctx)
+	if err == context.DeadlineExceeded {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
 func (nh *nodeHandleImpl) TryAcquire() (bool, error) {
-	if nh.cl.locks.Contains(nh.nd) {
+	if nh.cl.locks.ContainsExclusive(nh.nd) {
 		return true, nil
 	}
 
-	ok, err := nh.cl.s.TryAcquire(nh.nd)
+	ok, err := nh.cl.s.TryAcquire(server.NewRequestID(), nh.nd)
 	if err != nil {
 		return false, err
 	}
@@ -202,8 +392,40 @@ func (nh *nodeHandleImpl) TryAcquire() (bool, error) {
 	return ok, nil
 }
 
+func (nh *nodeHandleImpl) AcquireShared() error {
+	if nh.cl.locks.Contains(nh.nd) {
+		return nil
+	}
+
+	err := nh.cl.s.AcquireShared(nh.nd)
+	if err != nil {
+		return err
+	}
+
+	nh.cl.locks.AddShared(nh.nd)
+
+	return nil
+}
+
+func (nh *nodeHandleImpl) TryAcquireShared() (bool, error) {
+	if nh.cl.locks.Contains(nh.nd) {
+		return true, nil
+	}
+
+	ok, err := nh.cl.s.TryAcquireShared(server.NewRequestID(), nh.nd)
+	if err != nil {
+		return false, err
+	}
+
+	if ok {
+		nh.cl.locks.AddShared(nh.nd)
+	}
+
+	return ok, nil
+}
+
 func (nh *nodeHandleImpl) Release() error {
-	err := nh.cl.s.Release(nh.nd)
+	err := nh.cl.s.Release(server.NewRequestID(), nh.nd)
 	if err != nil {
 		return err
 	}
@@ -213,6 +435,18 @@ func (nh *nodeHandleImpl) Release() error {
 	return nil
 }
 
+func (nh *nodeHandleImpl) SetLockDelay(delay time.Duration) error {
+	return nh.cl.s.SetLockDelay(server.NewRequestID(), nh.nd, delay)
+}
+
+func (nh *nodeHandleImpl) GetSequencer() (server.Sequencer, error) {
+	if !nh.cl.locks.Contains(nh.nd) {
+		return server.Sequencer{}, server.ErrNoSequencerHeld
+	}
+
+	return nh.cl.s.GetSequencer(nh.nd)
+}
+
 func (nh *nodeHandleImpl) GetContentAndStat() (server.NodeContentAndStat, error) {
 	if cas, ok := nh.cl.nodeCache.Get(nh.nd); ok {
 		return cas, nil
@@ -229,11 +463,18 @@ func (nh *nodeHandleImpl) GetContentAndStat() (server.NodeContentAndStat, error)
 }
 
 func (nh *nodeHandleImpl) SetContent(contents string, generation uint64) (bool, error) {
-	return nh.cl.s.SetContent(nh.nd, contents, generation)
+	return nh.cl.s.SetContent(server.NewRequestID(), nh.nd, contents, generation)
 }
 
 func (nh *nodeHandleImpl) Delete() error {
-	panic("implement me")
+	err := nh.cl.s.Delete(server.NewRequestID(), nh.nd)
+	if err != nil {
+		return err
+	}
+
+	nh.cl.nodeCache.Delete(nh.nd)
+	nh.cl.locks.Remove(nh.nd)
+	return nil
 }
 
 func (nh *nodeHandleImpl) Path() string {
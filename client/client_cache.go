@@ -37,6 +37,13 @@ func (nc *nodeCache) Delete(nd server.NodeDescriptor) {
 	delete(nc.casCache, nd)
 }
 
+func (nc *nodeCache) Clear() {
+	nc.casLock.Lock()
+	defer nc.casLock.Unlock()
+
+	nc.casCache = make(map[server.NodeDescriptor]server.NodeContentAndStat)
+}
+
 func (nc *nodeCache) GetEventInfos() []server.EventInfo {
 	var eis []server.EventInfo
 	nc.casLock.RLock()
@@ -44,7 +51,7 @@ func (nc *nodeCache) GetEventInfos() []server.EventInfo {
 
 	for nd := range nc.casCache {
 		cas := nc.casCache[nd]
-		eis = append(eis, server.EventInfo{nd, cas.Stat.Generation, true})
+		eis = append(eis, server.EventInfo{Descriptor: nd, Generation: cas.Stat.Generation, Push: true})
 	}
 
 	return eis
@@ -53,13 +60,15 @@ func (nc *nodeCache) GetEventInfos() []server.EventInfo {
 // lockSet keeps track of which locks a client holds
 type lockSet struct {
 	heldLocksLock sync.RWMutex
-	heldLocks     map[server.NodeDescriptor]struct{}
+	// maps each held lock to whether it is held in shared mode
+	heldLocks map[server.NodeDescriptor]bool
 }
 
 func newLockSet() lockSet {
-	return lockSet{heldLocks: make(map[server.NodeDescriptor]struct{})}
+	return lockSet{heldLocks: make(map[server.NodeDescriptor]bool)}
 }
 
+// Contains returns whether the lock is held in either mode
 func (ls *lockSet) Contains(nd server.NodeDescriptor) bool {
 	ls.heldLocksLock.RLock()
 	defer ls.heldLocksLock.RUnlock()
@@ -68,11 +77,26 @@ func (ls *lockSet) Contains(nd server.NodeDescriptor) bool {
 	return ok
 }
 
+func (ls *lockSet) ContainsExclusive(nd server.NodeDescriptor) bool {
+	ls.heldLocksLock.RLock()
+	defer ls.heldLocksLock.RUnlock()
+
+	shared, ok := ls.heldLocks[nd]
+	return ok && !shared
+}
+
 func (ls *lockSet) Add(nd server.NodeDescriptor) {
 	ls.heldLocksLock.Lock()
 	defer ls.heldLocksLock.Unlock()
 
-	ls.heldLocks[nd] = struct{}{}
+	ls.heldLocks[nd] = false
+}
+
+func (ls *lockSet) AddShared(nd server.NodeDescriptor) {
+	ls.heldLocksLock.Lock()
+	defer ls.heldLocksLock.Unlock()
+
+	ls.heldLocks[nd] = true
 }
 
 func (ls *lockSet) Remove(nd server.NodeDescriptor) {
@@ -1,12 +1,16 @@
 package client
 
 import (
+	"net/rpc"
+	"sync"
 	"testing"
+	"time"
 
 	"errors"
 
 	"github.com/kbuzsaki/cupid/mocks"
 	"github.com/kbuzsaki/cupid/server"
+	"github.com/stretchr/testify/mock"
 )
 
 // TODO: do dependency injection here with mocks so that the client doesn't talk to an actual server
@@ -17,15 +21,15 @@ func TestClientImpl_Open(t *testing.T) {
 		}
 	}
 	mockServer := &mocks.Server{}
-	sd := server.SessionDescriptor{3}
+	sd := server.SessionDescriptor{Descriptor: 3}
 	cl := clientImpl{s: mockServer, sd: sd}
 
 	// success case
-	nd := server.NodeDescriptor{sd, 4, "/foo/bar"}
-	mockServer.On("Open", sd, "/foo/bar", false, server.EventsConfig{}).Return(nd, nil)
+	nd := server.NodeDescriptor{Session: sd, Descriptor: 4, Path: "/foo/bar"}
+	mockServer.On("Open", mock.AnythingOfType("server.RequestID"), sd, "/foo/bar", false, false, server.EventsConfig{}).Return(nd, nil)
 
 	// test success
-	nh, err := cl.Open("/foo/bar", false, server.EventsConfig{})
+	nh, err := cl.Open("/foo/bar", false, false, server.EventsConfig{})
 	ne("Opening /foo/bar from client", err)
 	if nh == nil {
 		t.Error("Got nil NodeHandle from Open")
@@ -34,11 +38,77 @@ func TestClientImpl_Open(t *testing.T) {
 
 	// failure case
 	someError := errors.New("some error")
-	mockServer.On("Open", sd, "/bad/file", false, server.EventsConfig{}).Return(server.NodeDescriptor{}, someError)
+	mockServer.On("Open", mock.AnythingOfType("server.RequestID"), sd, "/bad/file", false, false, server.EventsConfig{}).Return(server.NodeDescriptor{}, someError)
 
-	nh, err = cl.Open("/bad/file", false, server.EventsConfig{})
+	nh, err = cl.Open("/bad/file", false, false, server.EventsConfig{})
 	if err == nil {
 		t.Error("Client performed bad open")
 	}
 	mockServer.AssertExpectations(t)
 }
+
+// fakeEventStream fails its Recv with whatever is sent on errC
+type fakeEventStream struct {
+	errC      chan error
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFakeEventStream() *fakeEventStream {
+	return &fakeEventStream{errC: make(chan error, 1), closed: make(chan struct{})}
+}
+
+func (es *fakeEventStream) Recv() ([]server.SequencedEvent, error) {
+	select {
+	case err := <-es.errC:
+		return nil, err
+	case <-es.closed:
+		return nil, server.ErrEventStreamClosed
+	}
+}
+
+func (es *fakeEventStream) Ack(seq uint64) error {
+	return nil
+}
+
+func (es *fakeEventStream) KeepAlive(li server.LeaseInfo, eis []server.EventInfo) error {
+	return nil
+}
+
+func (es *fakeEventStream) Close() error {
+	es.closeOnce.Do(func() { close(es.closed) })
+	return nil
+}
+
+func TestClientImpl_KeepAliveLeaderChange(t *testing.T) {
+	mockServer := &mocks.Server{}
+	sd := server.SessionDescriptor{Descriptor: 3}
+	cl := &clientImpl{s: mockServer, sd: sd, nodeCache: newNodeCache(), locks: newLockSet(), keepAliveDelay: time.Second}
+
+	// the first streams lose their leader one after the other, the last is opened on the new leader. repeated
+	// failures of any other kind would back off in between.
+	redirected, lost, reopened := newFakeEventStream(), newFakeEventStream(), newFakeEventStream()
+	redirected.errC <- rpc.ServerError(server.LeaderRedirectError{LeaderID: 2, LeaderAddr: "new-leader"}.Error())
+	lost.errC <- rpc.ServerError(server.ErrLeadershipLost.Error())
+	opened := make(chan struct{})
+	mockServer.On("OpenEventStream", sd).Return(redirected, nil).Once()
+	mockServer.On("OpenEventStream", sd).Return(lost, nil).Once()
+	mockServer.On("OpenEventStream", sd).Return(reopened, nil).Once().Run(func(mock.Arguments) { close(opened) })
+
+	done := make(chan struct{})
+	go func() {
+		cl.keepAlive()
+		close(done)
+	}()
+
+	select {
+	case <-opened:
+	case <-time.After(minimumKeepAliveDelay / 2):
+		t.Error("event stream not reopened right away after a leader change")
+	}
+
+	cl.setClosing()
+	reopened.Close()
+	<-done
+	mockServer.AssertExpectations(t)
+}
@@ -2,20 +2,39 @@ package client
 
 import (
 	"io"
+	"time"
 
 	"github.com/kbuzsaki/cupid/server"
+	"golang.org/x/net/context"
 )
 
 type Client interface {
-	Open(path string, readOnly bool, events server.EventsConfig) (NodeHandle, error)
+	Open(path string, readOnly bool, ephemeral bool, events server.EventsConfig) (NodeHandle, error)
+	List(dir string) ([]server.DirEntry, error)
+	// CheckSequencer reports whether seq still describes the current holder of its lock
+	CheckSequencer(seq server.Sequencer) (bool, error)
 	GetEventsOut() <-chan server.Event
 	Close() error
 }
 
 type Locker interface {
 	Acquire() error
+	// AcquireContext blocks until the lock is acquired or ctx is done, in which case it returns ctx.Err()
+	AcquireContext(ctx context.Context) error
+	// AcquireTimeout blocks for at most timeout and reports whether the lock was acquired
+	AcquireTimeout(timeout time.Duration) (bool, error)
 	TryAcquire() (bool, error)
+	// AcquireShared and TryAcquireShared take the lock in shared mode, which excludes only exclusive holders.
+	// holding the lock exclusively already satisfies them.
+	AcquireShared() error
+	TryAcquireShared() (bool, error)
 	Release() error
+	// GetSequencer returns a sequencer for the lock, which must currently be held in either mode
+	GetSequencer() (server.Sequencer, error)
+	// SetLockDelay sets how long the lock stays unavailable after a holder is lost without releasing it.
+	// a running delay carries over to a new leader. it is measured by the members' clocks, so it is only as
+	// accurate as they agree.
+	SetLockDelay(delay time.Duration) error
 }
 
 type File interface {
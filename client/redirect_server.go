@@ -9,14 +9,37 @@ import (
 	"net/rpc"
 
 	"github.com/kbuzsaki/cupid/server"
+	"golang.org/x/net/context"
 )
 
+// noLeaderBackoff is how long to wait before trying another member when there is no leader to redirect to
+const noLeaderBackoff = 100 * time.Millisecond
+
+// RedirectServer sends each call to the leader of a raft cluster, following the leader redirects that the
+// members return. addrs are the seed addresses that are tried in turn when the leader isn't known.
+// calls are retried with the same RequestID, so a retry of a call that was already applied isn't applied again.
 type RedirectServer struct {
-	delegates []server.Server
+	addrs []string
+	dial  func(addr string) server.Server
 
 	lock          sync.RWMutex
-	leader        int
+	delegates     map[string]server.Server
+	leader        string
 	pendingLeader int
+
+	// whether reads are spread across every member, and which member gets the next one
+	followerReads bool
+	nextReader    int
+}
+
+func NewRedirectServer(addrs []string, dial func(addr string) server.Server) *RedirectServer {
+	return &RedirectServer{
+		addrs:         addrs,
+		dial:          dial,
+		delegates:     make(map[string]server.Server),
+		leader:        addrs[0],
+		pendingLeader: 1,
+	}
 }
 
 func unmarshalRedirectError(se string) (server.LeaderRedirectError, error) {
@@ -26,16 +49,48 @@ func unmarshalRedirectError(se string) (server.LeaderRedirectError, error) {
 }
 
 func (rs *RedirectServer) getLeader() server.Server {
-	rs.lock.RLock()
-	defer rs.lock.RUnlock()
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
 
 	// stable leader
-	if rs.leader != 0 {
-		return rs.delegates[rs.leader-1]
+	addr := rs.leader
+	if addr == "" {
+		// leader not known, try pending leader
+		addr = rs.addrs[rs.pendingLeader-1]
 	}
 
-	// leader not known, try pending leader
-	return rs.delegates[rs.pendingLeader-1]
+	return rs.getDelegateLocked(addr)
+}
+
+func (rs *RedirectServer) getDelegateLocked(addr string) server.Server {
+	delegate, ok := rs.delegates[addr]
+	if !ok {
+		delegate = rs.dial(addr)
+		rs.delegates[addr] = delegate
+	}
+	return delegate
+}
+
+// EnableFollowerReads spreads GetContentAndStat calls round robin across the seed addresses instead of sending
+// them all to the leader
+func (rs *RedirectServer) EnableFollowerReads() {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.followerReads = true
+}
+
+// getReader returns the member that should serve the next read, or nil if reads go to the leader
+func (rs *RedirectServer) getReader() server.Server {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	if !rs.followerReads {
+		return nil
+	}
+
+	addr := rs.addrs[rs.nextReader]
+	rs.nextReader = (rs.nextReader + 1) % len(rs.addrs)
+	return rs.getDelegateLocked(addr)
 }
 
 func (rs *RedirectServer) stabilizeLeader() {
@@ -43,8 +98,8 @@ func (rs *RedirectServer) stabilizeLeader() {
 	defer rs.lock.Unlock()
 
 	// only stabilize if we're currently aborting
-	if rs.leader == 0 {
-		rs.leader = rs.pendingLeader
+	if rs.leader == "" {
+		rs.leader = rs.addrs[rs.pendingLeader-1]
 		//log.Println("stabilize leader:", rs.leader)
 	}
 }
@@ -55,25 +110,36 @@ func (rs *RedirectServer) abortLeader() {
 
 	//log.Println("aborting leader:", rs.leader, rs.pendingLeader)
 
-	if rs.leader == 0 {
-		if rs.pendingLeader < len(rs.delegates) {
+	if rs.leader == "" {
+		if rs.pendingLeader < len(rs.addrs) {
 			rs.pendingLeader++
 		} else {
 			// totally partitioned, maybe retry again and eventually go into jeopardy?
 			panic("jeopardy!")
 		}
 	} else {
-		rs.leader = 0
+		rs.leader = ""
 		rs.pendingLeader = 1
 	}
 
 	//log.Println("new pending leader:", rs.pendingLeader)
 }
 
-// setLeader sets the known stable leader
-func (rs *RedirectServer) setLeader(leader int) {
+// setLeader sets the known stable leader. a redirect without an address means that there is no leader yet, or
+// that it hasn't published its address, so the call is tried on the next seed address after a short wait instead
+// of going straight back to the member that couldn't say who the leader is.
+func (rs *RedirectServer) setLeader(leader string) {
+	if leader == "" {
+		time.Sleep(noLeaderBackoff)
+	}
+
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
+	if leader == "" {
+		rs.leader = ""
+		rs.pendingLeader = rs.pendingLeader%len(rs.addrs) + 1
+		return
+	}
 	rs.leader = leader
 }
 
@@ -84,7 +150,7 @@ func (rs *RedirectServer) KeepAlive(li server.LeaseInfo, eis []server.EventInfo,
 		return events, nil
 	} else if se, ok := err.(rpc.ServerError); ok {
 		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
-			rs.setLeader(lre.LeaderID)
+			rs.setLeader(lre.LeaderAddr)
 			return rs.KeepAlive(li, eis, keepAliveDelay)
 		}
 		return events, err
@@ -95,74 +161,129 @@ func (rs *RedirectServer) KeepAlive(li server.LeaseInfo, eis []server.EventInfo,
 	}
 }
 
-func (rs *RedirectServer) OpenSession() (server.SessionDescriptor, error) {
-	sd, err := rs.getLeader().OpenSession()
+// OpenEventStream opens the stream on the leader. the stream fails once that member stops being the leader, and
+// opening it again through here finds the new one.
+func (rs *RedirectServer) OpenEventStream(sd server.SessionDescriptor) (server.EventStream, error) {
+	stream, err := rs.getLeader().OpenEventStream(sd)
+	if err == nil {
+		rs.stabilizeLeader()
+		return stream, nil
+	} else if se, ok := err.(rpc.ServerError); ok {
+		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
+			rs.setLeader(lre.LeaderAddr)
+			return rs.OpenEventStream(sd)
+		}
+		return nil, err
+	} else {
+		rs.abortLeader()
+		return rs.OpenEventStream(sd)
+	}
+}
+
+func (rs *RedirectServer) OpenSession(id server.RequestID) (server.SessionDescriptor, error) {
+	sd, err := rs.getLeader().OpenSession(id)
 	if err == nil {
 		rs.stabilizeLeader()
 		return sd, nil
 	} else if se, ok := err.(rpc.ServerError); ok {
 		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
-			rs.setLeader(lre.LeaderID)
-			return rs.OpenSession()
+			rs.setLeader(lre.LeaderAddr)
+			return rs.OpenSession(id)
 		}
 		return sd, err
 	} else {
 		rs.abortLeader()
-		return rs.OpenSession()
+		return rs.OpenSession(id)
 	}
 }
 
-func (rs *RedirectServer) CloseSession(sd server.SessionDescriptor) error {
-	err := rs.getLeader().CloseSession(sd)
+func (rs *RedirectServer) CloseSession(id server.RequestID, sd server.SessionDescriptor) error {
+	err := rs.getLeader().CloseSession(id, sd)
 	if err == nil {
 		rs.stabilizeLeader()
 		return nil
 	} else if se, ok := err.(rpc.ServerError); ok {
 		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
-			rs.setLeader(lre.LeaderID)
-			return rs.CloseSession(sd)
+			rs.setLeader(lre.LeaderAddr)
+			return rs.CloseSession(id, sd)
 		}
 		log.Println("server error:", se)
 		return err
 	} else {
 		rs.abortLeader()
-		return rs.CloseSession(sd)
+		return rs.CloseSession(id, sd)
 	}
 }
 
-func (rs *RedirectServer) Open(sd server.SessionDescriptor, path string, readOnly bool, config server.EventsConfig) (server.NodeDescriptor, error) {
-	nd, err := rs.getLeader().Open(sd, path, readOnly, config)
+func (rs *RedirectServer) Open(id server.RequestID, sd server.SessionDescriptor, path string, readOnly bool, ephemeral bool, config server.EventsConfig) (server.NodeDescriptor, error) {
+	nd, err := rs.getLeader().Open(id, sd, path, readOnly, ephemeral, config)
 	if err == nil {
 		rs.stabilizeLeader()
 		return nd, nil
 	} else if se, ok := err.(rpc.ServerError); ok {
 		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
-			rs.setLeader(lre.LeaderID)
-			return rs.Open(sd, path, readOnly, config)
+			rs.setLeader(lre.LeaderAddr)
+			return rs.Open(id, sd, path, readOnly, ephemeral, config)
 		}
 		log.Println("server error:", se)
 		return nd, err
 	} else {
 		rs.abortLeader()
-		return rs.Open(sd, path, readOnly, config)
+		return rs.Open(id, sd, path, readOnly, ephemeral, config)
 	}
 }
 
-func (rs *RedirectServer) CloseNode(nd server.NodeDescriptor) error {
-	err := rs.getLeader().CloseNode(nd)
+func (rs *RedirectServer) CloseNode(id server.RequestID, nd server.NodeDescriptor) error {
+	err := rs.getLeader().CloseNode(id, nd)
 	if err == nil {
 		rs.stabilizeLeader()
 		return nil
 	} else if se, ok := err.(rpc.ServerError); ok {
 		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
-			rs.setLeader(lre.LeaderID)
-			return rs.CloseNode(nd)
+			rs.setLeader(lre.LeaderAddr)
+			return rs.CloseNode(id, nd)
 		}
 		log.Println("server error:", se)
 		return err
 	} else {
 		rs.abortLeader()
-		return rs.CloseNode(nd)
+		return rs.CloseNode(id, nd)
+	}
+}
+
+func (rs *RedirectServer) Delete(id server.RequestID, node server.NodeDescriptor) error {
+	err := rs.getLeader().Delete(id, node)
+	if err == nil {
+		rs.stabilizeLeader()
+		return nil
+	} else if se, ok := err.(rpc.ServerError); ok {
+		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
+			rs.setLeader(lre.LeaderAddr)
+			return rs.Delete(id, node)
+		}
+		log.Println("server error:", se)
+		return err
+	} else {
+		rs.abortLeader()
+		return rs.Delete(id, node)
+	}
+}
+
+func (rs *RedirectServer) List(sd server.SessionDescriptor, dir string) ([]server.DirEntry, error) {
+	entries, err := rs.getLeader().List(sd, dir)
+	if err == nil {
+		rs.stabilizeLeader()
+		return entries, nil
+	} else if se, ok := err.(rpc.ServerError); ok {
+		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
+			rs.setLeader(lre.LeaderAddr)
+			return rs.List(sd, dir)
+		}
+		log.Println("server error:", se)
+		return entries, err
+	} else {
+		rs.abortLeader()
+		return rs.List(sd, dir)
 	}
 }
 
@@ -173,7 +294,7 @@ func (rs *RedirectServer) Acquire(node server.NodeDescriptor) error {
 		return nil
 	} else if se, ok := err.(rpc.ServerError); ok {
 		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
-			rs.setLeader(lre.LeaderID)
+			rs.setLeader(lre.LeaderAddr)
 			return rs.Acquire(node)
 		}
 		log.Println("server error:", se)
@@ -184,52 +305,185 @@ func (rs *RedirectServer) Acquire(node server.NodeDescriptor) error {
 	}
 }
 
-func (rs *RedirectServer) TryAcquire(node server.NodeDescriptor) (bool, error) {
-	ok, err := rs.getLeader().TryAcquire(node)
+func (rs *RedirectServer) AcquireContext(ctx context.Context, node server.NodeDescriptor) error {
+	err := rs.getLeader().AcquireContext(ctx, node)
+	if err == nil {
+		rs.stabilizeLeader()
+		return nil
+	} else if ctx.Err() != nil {
+		return ctx.Err()
+	} else if se, ok := err.(rpc.ServerError); ok {
+		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
+			rs.setLeader(lre.LeaderAddr)
+			return rs.AcquireContext(ctx, node)
+		}
+		log.Println("server error:", se)
+		return err
+	} else {
+		rs.abortLeader()
+		return rs.AcquireContext(ctx, node)
+	}
+}
+
+func (rs *RedirectServer) CancelAcquire(node server.NodeDescriptor) error {
+	err := rs.getLeader().CancelAcquire(node)
+	if err == nil {
+		rs.stabilizeLeader()
+		return nil
+	} else if se, ok := err.(rpc.ServerError); ok {
+		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
+			rs.setLeader(lre.LeaderAddr)
+			return rs.CancelAcquire(node)
+		}
+		log.Println("server error:", se)
+		return err
+	} else {
+		rs.abortLeader()
+		return rs.CancelAcquire(node)
+	}
+}
+
+func (rs *RedirectServer) TryAcquire(id server.RequestID, node server.NodeDescriptor) (bool, error) {
+	ok, err := rs.getLeader().TryAcquire(id, node)
 	if err == nil {
 		rs.stabilizeLeader()
 		return ok, nil
 	} else if se, ok := err.(rpc.ServerError); ok {
 		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
-			rs.setLeader(lre.LeaderID)
-			return rs.TryAcquire(node)
+			rs.setLeader(lre.LeaderAddr)
+			return rs.TryAcquire(id, node)
 		}
 		log.Println("server error:", se)
-		return ok, err
+		return false, err
 	} else {
 		rs.abortLeader()
-		return rs.TryAcquire(node)
+		return rs.TryAcquire(id, node)
 	}
-	return ok, err
 }
 
-func (rs *RedirectServer) Release(node server.NodeDescriptor) error {
-	err := rs.getLeader().Release(node)
+func (rs *RedirectServer) AcquireShared(node server.NodeDescriptor) error {
+	err := rs.getLeader().AcquireShared(node)
 	if err == nil {
 		rs.stabilizeLeader()
 		return nil
 	} else if se, ok := err.(rpc.ServerError); ok {
 		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
-			rs.setLeader(lre.LeaderID)
-			return rs.Release(node)
+			rs.setLeader(lre.LeaderAddr)
+			return rs.AcquireShared(node)
 		}
 		log.Println("server error:", se)
 		return err
 	} else {
 		rs.abortLeader()
-		return rs.Release(node)
+		return rs.AcquireShared(node)
+	}
+}
+
+func (rs *RedirectServer) TryAcquireShared(id server.RequestID, node server.NodeDescriptor) (bool, error) {
+	ok, err := rs.getLeader().TryAcquireShared(id, node)
+	if err == nil {
+		rs.stabilizeLeader()
+		return ok, nil
+	} else if se, ok := err.(rpc.ServerError); ok {
+		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
+			rs.setLeader(lre.LeaderAddr)
+			return rs.TryAcquireShared(id, node)
+		}
+		log.Println("server error:", se)
+		return false, err
+	} else {
+		rs.abortLeader()
+		return rs.TryAcquireShared(id, node)
+	}
+}
+
+func (rs *RedirectServer) Release(id server.RequestID, node server.NodeDescriptor) error {
+	err := rs.getLeader().Release(id, node)
+	if err == nil {
+		rs.stabilizeLeader()
+		return nil
+	} else if se, ok := err.(rpc.ServerError); ok {
+		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
+			rs.setLeader(lre.LeaderAddr)
+			return rs.Release(id, node)
+		}
+		log.Println("server error:", se)
+		return err
+	} else {
+		rs.abortLeader()
+		return rs.Release(id, node)
+	}
+}
+
+func (rs *RedirectServer) SetLockDelay(id server.RequestID, node server.NodeDescriptor, delay time.Duration) error {
+	err := rs.getLeader().SetLockDelay(id, node, delay)
+	if err == nil {
+		rs.stabilizeLeader()
+		return nil
+	} else if se, ok := err.(rpc.ServerError); ok {
+		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
+			rs.setLeader(lre.LeaderAddr)
+			return rs.SetLockDelay(id, node, delay)
+		}
+		log.Println("server error:", se)
+		return err
+	} else {
+		rs.abortLeader()
+		return rs.SetLockDelay(id, node, delay)
+	}
+}
+
+func (rs *RedirectServer) GetSequencer(node server.NodeDescriptor) (server.Sequencer, error) {
+	seq, err := rs.getLeader().GetSequencer(node)
+	if err == nil {
+		rs.stabilizeLeader()
+		return seq, nil
+	} else if se, ok := err.(rpc.ServerError); ok {
+		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
+			rs.setLeader(lre.LeaderAddr)
+			return rs.GetSequencer(node)
+		}
+		log.Println("server error:", se)
+		return seq, err
+	} else {
+		rs.abortLeader()
+		return rs.GetSequencer(node)
+	}
+}
+
+func (rs *RedirectServer) CheckSequencer(seq server.Sequencer) (bool, error) {
+	ok, err := rs.getLeader().CheckSequencer(seq)
+	if err == nil {
+		rs.stabilizeLeader()
+		return ok, nil
+	} else if se, ok := err.(rpc.ServerError); ok {
+		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
+			rs.setLeader(lre.LeaderAddr)
+			return rs.CheckSequencer(seq)
+		}
+		log.Println("server error:", se)
+		return false, err
+	} else {
+		rs.abortLeader()
+		return rs.CheckSequencer(seq)
 	}
-	return err
 }
 
 func (rs *RedirectServer) GetContentAndStat(node server.NodeDescriptor) (server.NodeContentAndStat, error) {
+	if reader := rs.getReader(); reader != nil {
+		// if the member can't serve the read then the leader still can
+		if cas, err := reader.GetContentAndStatFollower(node); err == nil {
+			return cas, nil
+		}
+	}
+
 	cas, err := rs.getLeader().GetContentAndStat(node)
 	if err == nil {
 		rs.stabilizeLeader()
 		return cas, nil
 	} else if se, ok := err.(rpc.ServerError); ok {
 		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
-			rs.setLeader(lre.LeaderID)
+			rs.setLeader(lre.LeaderAddr)
 			return rs.GetContentAndStat(node)
 		}
 		log.Println("server error:", se)
@@ -238,26 +492,42 @@ func (rs *RedirectServer) GetContentAndStat(node server.NodeDescriptor) (server.
 		rs.abortLeader()
 		return rs.GetContentAndStat(node)
 	}
-	return cas, err
 }
 
-func (rs *RedirectServer) SetContent(node server.NodeDescriptor, content string, generation uint64) (bool, error) {
-	ok, err := rs.getLeader().SetContent(node, content, generation)
+func (rs *RedirectServer) GetContentAndStatFollower(node server.NodeDescriptor) (server.NodeContentAndStat, error) {
+	cas, err := rs.getLeader().GetContentAndStatFollower(node)
+	if err == nil {
+		rs.stabilizeLeader()
+		return cas, nil
+	} else if se, ok := err.(rpc.ServerError); ok {
+		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
+			rs.setLeader(lre.LeaderAddr)
+			return rs.GetContentAndStatFollower(node)
+		}
+		log.Println("server error:", se)
+		return cas, err
+	} else {
+		rs.abortLeader()
+		return rs.GetContentAndStatFollower(node)
+	}
+}
+
+func (rs *RedirectServer) SetContent(id server.RequestID, node server.NodeDescriptor, content string, generation uint64) (bool, error) {
+	ok, err := rs.getLeader().SetContent(id, node, content, generation)
 	if err == nil {
 		rs.stabilizeLeader()
 		return ok, nil
 	} else if se, ok := err.(rpc.ServerError); ok {
 		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
-			rs.setLeader(lre.LeaderID)
-			return rs.SetContent(node, content, generation)
+			rs.setLeader(lre.LeaderAddr)
+			return rs.SetContent(id, node, content, generation)
 		}
 		log.Println("server error:", se)
-		return ok, err
+		return false, err
 	} else {
 		rs.abortLeader()
-		return rs.SetContent(node, content, generation)
+		return rs.SetContent(id, node, content, generation)
 	}
-	return ok, err
 }
 
 func (rs *RedirectServer) Nop(numOps uint64) error {
@@ -267,7 +537,7 @@ func (rs *RedirectServer) Nop(numOps uint64) error {
 		return nil
 	} else if se, ok := err.(rpc.ServerError); ok {
 		if lre, err := unmarshalRedirectError(se.Error()); err == nil {
-			rs.setLeader(lre.LeaderID)
+			rs.setLeader(lre.LeaderAddr)
 			return rs.Nop(numOps)
 		}
 		return err
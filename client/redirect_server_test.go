@@ -0,0 +1,62 @@
+package client
+
+import (
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/kbuzsaki/cupid/mocks"
+	"github.com/kbuzsaki/cupid/server"
+)
+
+func TestRedirectServer_RedirectWithoutLeader(t *testing.T) {
+	// the first member doesn't know where the leader is yet, the second one is the leader
+	follower, leader := &mocks.Server{}, &mocks.Server{}
+	noLeader := rpc.ServerError(server.LeaderRedirectError{}.Error())
+	follower.On("Nop", uint64(1)).Return(noLeader).Once()
+	leader.On("Nop", uint64(1)).Return(nil).Once()
+
+	members := map[string]server.Server{"follower": follower, "leader": leader}
+	rs := NewRedirectServer([]string{"follower", "leader"}, func(addr string) server.Server {
+		return members[addr]
+	})
+
+	start := time.Now()
+	if err := rs.Nop(1); err != nil {
+		t.Fatal("Nop failed:", err)
+	}
+	if elapsed := time.Since(start); elapsed < noLeaderBackoff {
+		t.Error("retried without backing off:", elapsed)
+	}
+	follower.AssertExpectations(t)
+	leader.AssertExpectations(t)
+
+	if rs.getLeader() != leader {
+		t.Error("next seed address not kept as the leader")
+	}
+}
+
+func TestRedirectServer_ServerErrorIsNotSuccess(t *testing.T) {
+	// the server's own answer of true mustn't leak out alongside an error that isn't a redirect
+	leader := &mocks.Server{}
+	failed := rpc.ServerError(server.ErrInvalidNodeDescriptor.Error())
+	nd := server.NodeDescriptor{Path: "/foo/bar"}
+	leader.On("TryAcquire", server.NoRequestID, nd).Return(true, failed).Once()
+	leader.On("TryAcquireShared", server.NoRequestID, nd).Return(true, failed).Once()
+	leader.On("SetContent", server.NoRequestID, nd, "content", uint64(0)).Return(true, failed).Once()
+
+	rs := NewRedirectServer([]string{"leader"}, func(addr string) server.Server {
+		return leader
+	})
+
+	for name, try := range map[string]func() (bool, error){
+		"TryAcquire":       func() (bool, error) { return rs.TryAcquire(server.NoRequestID, nd) },
+		"TryAcquireShared": func() (bool, error) { return rs.TryAcquireShared(server.NoRequestID, nd) },
+		"SetContent":       func() (bool, error) { return rs.SetContent(server.NoRequestID, nd, "content", 0) },
+	} {
+		if ok, err := try(); ok || err != failed {
+			t.Errorf("%s returned %v, %v on a server error", name, ok, err)
+		}
+	}
+	leader.AssertExpectations(t)
+}
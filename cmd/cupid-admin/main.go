@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/kbuzsaki/cupid/cmd/internal/admintoken"
+	"github.com/kbuzsaki/cupid/server"
+)
+
+const (
+	cmdHelp = "Command List:\n" +
+		"\tmembers\n" +
+		"\tadd-member <id> <peer url> [rpc addr]\n" +
+		"\tremove-member <id>\n" +
+		"\treplace-member <old id> <new id> <new peer url> [new rpc addr]\n" +
+		"\texpire-session <sd>\n" +
+		"\trelease-lock <path>"
+)
+
+var (
+	adminAddr  = ""
+	adminToken = ""
+)
+
+func parseArgs() []string {
+	addrp := flag.String("admin", "", "the admin address of any cupid-server in the cluster, usually its port+1")
+	tokenfilep := flag.String("tokenfile", "", "file holding the server's admin token, needed for expire-session and release-lock")
+	flag.Parse()
+
+	if *addrp == "" {
+		log.Fatal("Admin address is required")
+	}
+	adminAddr = *addrp
+
+	if *tokenfilep != "" {
+		token, err := admintoken.Read(*tokenfilep)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		adminToken = token
+	}
+
+	return flag.Args()
+}
+
+func parseID(s string) uint64 {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || id == 0 {
+		log.Fatalf("invalid member id: %q\n", s)
+	}
+	return id
+}
+
+// parseMember reads a member from <id> <peer url> [rpc addr]. the rpc address may be left out because every
+// member publishes its own once it starts.
+func parseMember(args []string) server.Member {
+	member := server.Member{ID: parseID(args[0]), PeerURL: args[1]}
+	if len(args) > 2 {
+		member.RPCAddr = args[2]
+	}
+	return member
+}
+
+// do sends an admin request and decodes the server's response into out
+func do(method string, path string, body interface{}, out interface{}) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			log.Fatalf("encode error: %v\n", err)
+		}
+	}
+
+	req, err := http.NewRequest(method, "http://"+adminAddr+path, &buf)
+	if err != nil {
+		log.Fatalf("request error: %v\n", err)
+	}
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("request error: %v\n", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		log.Fatalf("admin error: %s: %s", resp.Status, msg)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		log.Fatalf("decode error: %v\n", err)
+	}
+}
+
+// doMembers sends a membership request and prints the membership that the server responds with
+func doMembers(method string, path string, body interface{}) {
+	var members []server.Member
+	do(method, path, body, &members)
+	for _, member := range members {
+		fmt.Printf("%d\t%s\t%s\n", member.ID, member.PeerURL, member.RPCAddr)
+	}
+}
+
+// expireSession expires a session and prints the descriptors it had open
+func expireSession(sd string) {
+	var session server.SessionInfo
+	do(http.MethodPost, "/admin/sessions/expire?sd="+url.QueryEscape(sd), nil, &session)
+	fmt.Println("expired session", session.SD.Descriptor)
+	for _, di := range session.Descriptors {
+		fmt.Printf("\tclosed %d\n", di.ND.Descriptor)
+	}
+}
+
+// releaseLock releases a lock from its holders and prints who lost it
+func releaseLock(path string) {
+	var nds []server.NodeDescriptor
+	do(http.MethodPost, "/admin/locks/release?path="+url.QueryEscape(path), nil, &nds)
+	for _, nd := range nds {
+		fmt.Printf("released %s from session %d descriptor %d\n", path, nd.Session.Descriptor, nd.Descriptor)
+	}
+}
+
+func main() {
+	args := parseArgs()
+	if len(args) == 0 {
+		fmt.Println(cmdHelp)
+		return
+	}
+
+	command, args := args[0], args[1:]
+	switch {
+	case command == "members" && len(args) == 0:
+		doMembers(http.MethodGet, "/admin/members", nil)
+	case command == "add-member" && (len(args) == 2 || len(args) == 3):
+		doMembers(http.MethodPost, "/admin/members", parseMember(args))
+	case command == "remove-member" && len(args) == 1:
+		doMembers(http.MethodDelete, "/admin/members?id="+strconv.FormatUint(parseID(args[0]), 10), nil)
+	case command == "replace-member" && (len(args) == 3 || len(args) == 4):
+		path := "/admin/members/replace?id=" + strconv.FormatUint(parseID(args[0]), 10)
+		doMembers(http.MethodPost, path, parseMember(args[1:]))
+	case command == "expire-session" && len(args) == 1:
+		expireSession(args[0])
+	case command == "release-lock" && len(args) == 1:
+		releaseLock(args[0])
+	default:
+		fmt.Println(cmdHelp)
+	}
+}
@@ -50,10 +50,11 @@ func parseArgs() {
 	addrs = strings.Split(addrstr, ",")
 }
 
-func advertiseNick(chanHandle client.NodeHandle, nick string) ([]string, error) {
+// advertiseNick appends nick to the channel node so that everyone in the channel gets an event when we join
+func advertiseNick(chanHandle client.NodeHandle, nick string) error {
 	err := chanHandle.Acquire()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer chanHandle.Release()
 
@@ -62,18 +63,33 @@ func advertiseNick(chanHandle client.NodeHandle, nick string) ([]string, error)
 	for !done {
 		cas, err := chanHandle.GetContentAndStat()
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		oldNicks = cas.Content
 		newNicks := oldNicks + "\n" + nick
 		done, err = chanHandle.SetContent(newNicks, cas.Stat.Generation+1)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	return strings.Split(oldNicks, "\n"), nil
+	return nil
+}
+
+// listChatters returns the nicks that are currently in the channel. nick nodes are ephemeral,
+// so chatters that have disconnected are no longer listed.
+func listChatters(cl client.Client) ([]string, error) {
+	entries, err := cl.List(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	var chatters []string
+	for _, entry := range entries {
+		chatters = append(chatters, entry.Name)
+	}
+	return chatters, nil
 }
 
 type message struct {
@@ -109,7 +125,7 @@ func (c *Channel) registerChatter(chatter string, announce bool) {
 	}
 	c.chatters[chatter] = struct{}{}
 
-	chatterHandle, err := c.cl.Open(channel+"/"+chatter, true, server.EventsConfig{})
+	chatterHandle, err := c.cl.Open(channel+"/"+chatter, true, false, server.EventsConfig{})
 	if err != nil {
 		log.Fatal("unable to open chatter handle:", err)
 	}
@@ -146,32 +162,42 @@ func main() {
 	ch := Channel{cl: cl, nick: nick, messages: messages, chatters: make(map[string]struct{})}
 	go ch.printMessages()
 
-	chanHandle, err := cl.Open(channel, false, server.EventsConfig{})
+	chanHandle, err := cl.Open(channel, false, false, server.EventsConfig{})
 	if err != nil {
 		log.Fatal("error opening channel:", err)
 	}
-	chatters, err := advertiseNick(chanHandle, nick)
+
+	// open the nick before advertising it so that it shows up when the other chatters list the channel
+	nickPath := channel + "/" + nick
+	nickHandle, err := cl.Open(nickPath, false, true, server.EventsConfig{})
+	if err != nil {
+		log.Fatal("error opening nick:", err)
+	}
+
+	err = advertiseNick(chanHandle, nick)
 	if err != nil {
 		log.Fatal("unable to advertise nick")
 	}
 
+	chatters, err := listChatters(cl)
+	if err != nil {
+		log.Fatal("unable to list chatters:", err)
+	}
 	for _, chatter := range chatters {
 		ch.registerChatter(chatter, false)
 	}
 
 	chanHandle.Register(func(path string, cas server.NodeContentAndStat) {
-		chatters := strings.Split(cas.Content, "\n")
+		chatters, err := listChatters(cl)
+		if err != nil {
+			log.Println("unable to list chatters:", err)
+			return
+		}
 		for _, chatter := range chatters {
 			ch.registerChatter(chatter, true)
 		}
 	})
 
-	nickPath := channel + "/" + nick
-	nickHandle, err := cl.Open(nickPath, false, server.EventsConfig{})
-	if err != nil {
-		log.Fatal("error opening nick:", err)
-	}
-
 	fmt.Println("> you joined '" + channel + "' as '" + nick + "'")
 	reader := bufio.NewReader(os.Stdin)
 	for {
@@ -34,7 +34,10 @@ const (
 		"\tset <path> <value> <generation>" +
 		"\tlock <name>" +
 		"\ttrylock <name>" +
+		"\trlock <name>" +
 		"\tunlock <name>" +
+		"\tdelete <path>" +
+		"\tls <dir>" +
 		"\tnop <path> <value>"
 	prompt = "> "
 )
@@ -74,10 +77,10 @@ func maybePrintHelp(ok bool) bool {
 
 func mustGetNodeHandle(path string) client.NodeHandle {
 	if _, ok := handles[path]; !ok {
-		nh, err := cl.Open(path, false, server.EventsConfig{false, false, false})
+		nh, err := cl.Open(path, false, false, server.EventsConfig{})
 		nh.Register(printEvents)
 		if err != nil {
-			log.Fatalf("open error:", err)
+			log.Fatalf("open error: %v\n", err)
 		}
 		handles[path] = nh
 	}
@@ -103,7 +106,7 @@ func handleGet(args []string) bool {
 	nh := mustGetNodeHandle(path)
 	cas, err := nh.GetContentAndStat()
 	if err != nil {
-		log.Fatalf("get error:", err)
+		log.Fatalf("get error: %v\n", err)
 	}
 
 	//Maybe we want this switched on a flag?
@@ -147,7 +150,7 @@ func handleSet(args []string) bool {
 	nh := mustGetNodeHandle(path)
 	ok, err := nh.SetContent(value, generation)
 	if err != nil {
-		log.Fatalf("set error:", err)
+		log.Fatalf("set error: %v\n", err)
 	}
 	if !ok {
 		fmt.Println("set no-oped due to generation")
@@ -178,12 +181,12 @@ func handleNop(args []string) bool {
 	start := time.Now()
 	val, err := strconv.ParseUint(value, 10, 64)
 	if err != nil {
-		fmt.Println("Cannot parse %v as integer", value)
+		fmt.Printf("Cannot parse %v as integer\n", value)
 	}
 	fmt.Println("cupid-client: ", val)
 	err = nh.Nop(val)
 	if err != nil {
-		log.Fatalf("nop error:", err)
+		log.Fatalf("nop error: %v\n", err)
 
 	}
 	fmt.Println(time.Since(start))
@@ -206,6 +209,22 @@ func handleLock(args []string) bool {
 	return true
 }
 
+func handleSharedLock(args []string) bool {
+	if maybePrintHelp(parseGet(args)) {
+		return true
+	}
+
+	nh := mustGetNodeHandle(path)
+
+	err := nh.AcquireShared()
+	handles[path] = nh
+	if err != nil {
+		log.Fatalf("shared lock error: %v\n", err)
+	}
+
+	return true
+}
+
 func handleUnlock(args []string) bool {
 	if maybePrintHelp(parseGet(args)) {
 		return true
@@ -242,6 +261,40 @@ func handleTryLock(args []string) bool {
 	return true
 }
 
+func handleDelete(args []string) bool {
+	if maybePrintHelp(parseGet(args)) {
+		return true
+	}
+
+	nh := mustGetNodeHandle(path)
+
+	err := nh.Delete()
+	if err != nil {
+		log.Fatalf("delete error: %v\n", err)
+	}
+	delete(handles, path)
+
+	return true
+}
+
+func handleList(args []string) bool {
+	dir := "/"
+	if len(args) >= 1 {
+		dir = args[0]
+	}
+
+	entries, err := cl.List(dir)
+	if err != nil {
+		log.Fatalf("ls error: %v\n", err)
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%v\t%v\n", entry.Stat.Generation, entry.Name)
+	}
+
+	return true
+}
+
 func handleSubscribe(args []string) bool {
 	if maybePrintHelp(parseGet(args)) {
 		return true
@@ -266,12 +319,18 @@ func runCmd(args []string) bool {
 		return handleGet(args)
 	case "lock":
 		return handleLock(args)
+	case "rlock":
+		return handleSharedLock(args)
 	case "unlock":
 		return handleUnlock(args)
 	case "set":
 		return handleSet(args)
 	case "trylock":
 		return handleTryLock(args)
+	case "delete":
+		return handleDelete(args)
+	case "ls":
+		return handleList(args)
 	case "subscribe":
 		return handleSubscribe(args)
 	case "wait":
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/kbuzsaki/cupid/server"
+)
+
+const (
+	membershipChangeTimeout = 10 * time.Second
+)
+
+// membershipAdmin serves the admin api for changing the members of the raft cluster at runtime:
+//
+//	GET    /admin/members                  lists the members
+//	POST   /admin/members                  adds the member in the body
+//	DELETE /admin/members?id=<id>          removes a member
+//	POST   /admin/members/replace?id=<id>  replaces a member with the member in the body
+//
+// each change is proposed through raft and the request returns once it has been applied on this node. the changes
+// need the admin token, see checkToken, while listing the members doesn't.
+type membershipAdmin struct {
+	members     *membership
+	confChangeC chan<- raftpb.ConfChange
+	token       string
+}
+
+func registerMembershipAdmin(mux *http.ServeMux, members *membership, confChangeC chan<- raftpb.ConfChange, token string) {
+	ma := &membershipAdmin{members, confChangeC, token}
+	mux.HandleFunc("/admin/members", ma.handleMembers)
+	mux.HandleFunc("/admin/members/replace", ma.handleReplace)
+}
+
+func (ma *membershipAdmin) handleMembers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, ma.members.Members())
+	case http.MethodPost:
+		if !checkToken(w, r, ma.token) {
+			return
+		}
+		member, err := readMember(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := ma.addMember(member); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, ma.members.Members())
+	case http.MethodDelete:
+		if !checkToken(w, r, ma.token) {
+			return
+		}
+		id, err := readID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := ma.removeMember(id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, ma.members.Members())
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleReplace swaps out a member, usually one whose machine died, for a new one.
+// the old member is removed first so that a dead member doesn't count against quorum while the new one catches up.
+func (ma *membershipAdmin) handleReplace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkToken(w, r, ma.token) {
+		return
+	}
+
+	id, err := readID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	member, err := readMember(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := ma.removeMember(id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := ma.addMember(member); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, ma.members.Members())
+}
+
+func (ma *membershipAdmin) addMember(member server.Member) error {
+	if _, ok := ma.members.Get(member.ID); ok {
+		return fmt.Errorf("member %d already exists", member.ID)
+	}
+
+	log.Println("adding member:", member)
+	ma.confChangeC <- raftpb.ConfChange{
+		Type:    raftpb.ConfChangeAddNode,
+		NodeID:  member.ID,
+		Context: encodeMember(member),
+	}
+	return ma.members.WaitFor(func(m *membership) bool {
+		_, ok := m.Get(member.ID)
+		return ok
+	}, membershipChangeTimeout)
+}
+
+func (ma *membershipAdmin) removeMember(id uint64) error {
+	if _, ok := ma.members.Get(id); !ok {
+		return fmt.Errorf("member %d does not exist", id)
+	}
+
+	log.Println("removing member:", id)
+	ma.confChangeC <- raftpb.ConfChange{
+		Type:   raftpb.ConfChangeRemoveNode,
+		NodeID: id,
+	}
+	return ma.members.WaitFor(func(m *membership) bool {
+		_, ok := m.Get(id)
+		return !ok
+	}, membershipChangeTimeout)
+}
+
+func readID(r *http.Request) (uint64, error) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("invalid member id: %q", r.URL.Query().Get("id"))
+	}
+	return id, nil
+}
+
+func readMember(r *http.Request) (server.Member, error) {
+	var member server.Member
+	if err := json.NewDecoder(r.Body).Decode(&member); err != nil {
+		return member, err
+	}
+	if member.ID == 0 || member.PeerURL == "" {
+		return member, fmt.Errorf("member needs an id and a peer url: %+v", member)
+	}
+	return member, nil
+}
+
+// checkToken makes sure that a request that changes the cluster, its sessions or its locks carries a
+// "Authorization: Bearer <token>" header with the token from -admintokenfile. without a token those changes are
+// refused altogether. it writes the error response itself and returns whether the request may go ahead.
+func checkToken(w http.ResponseWriter, r *http.Request, token string) bool {
+	if token == "" {
+		http.Error(w, "admin changes are disabled, start the server with -admintokenfile", http.StatusForbidden)
+		return false
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("unable to write admin response:", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+func TestMembershipAdmin_RequiresToken(t *testing.T) {
+	const member = `{"ID": 3, "PeerURL": "http://127.0.0.1:32379"}`
+	requests := []struct {
+		method, path, body string
+	}{
+		{http.MethodPost, "/admin/members", member},
+		{http.MethodDelete, "/admin/members?id=2", ""},
+		{http.MethodPost, "/admin/members/replace?id=2", member},
+	}
+
+	for _, tc := range []struct {
+		name          string
+		serverToken   string
+		authorization string
+		status        int
+	}{
+		{"no token sent", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer wrong", http.StatusUnauthorized},
+		{"token not a bearer", "secret", "secret", http.StatusUnauthorized},
+		{"changes disabled", "", "Bearer secret", http.StatusForbidden},
+	} {
+		confChangeC := make(chan raftpb.ConfChange, len(requests))
+		mux := http.NewServeMux()
+		registerMembershipAdmin(mux, newMembership([]string{"http://127.0.0.1:12379", "http://127.0.0.1:22379"}), confChangeC, tc.serverToken)
+
+		for _, req := range requests {
+			r := httptest.NewRequest(req.method, req.path, strings.NewReader(req.body))
+			if tc.authorization != "" {
+				r.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tc.status {
+				t.Errorf("%s: %s %s got status %d, expected %d", tc.name, req.method, req.path, w.Code, tc.status)
+			}
+		}
+		if len(confChangeC) != 0 {
+			t.Errorf("%s: membership changed without the admin token", tc.name)
+		}
+
+		// listing the members is read-only and stays open
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/members", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: listing members got status %d", tc.name, w.Code)
+		}
+	}
+}
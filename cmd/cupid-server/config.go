@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// config is where a server keeps its data and the addresses it listens on. the address flags all default to
+// being derived from -port and -cluster, so a server started with only those behaves as it always has.
+type config struct {
+	dataDir       string // directory that holds the wal and snapshot directories
+	listenAddr    string // address the cupid rpc server binds to
+	advertiseAddr string // address that clients are told to dial for this server, e.g. in leader redirects
+	raftAddr      string // address the raft transport binds to, or empty without raft
+	adminAddr     string // address of the admin and debug http server, or empty to disable it
+	adminToken    string // bearer token for the admin changes to members, sessions and locks, or empty to disable them
+}
+
+func (c *config) walDir(id int) string {
+	return filepath.Join(c.dataDir, fmt.Sprintf("raftexample-%d", id))
+}
+
+func (c *config) snapDir(id int) string {
+	return filepath.Join(c.dataDir, fmt.Sprintf("raftexample-%d-snap", id))
+}
+
+// peerHost returns the host and port of a raft peer url, which is where that peer's transport listens by default
+func peerHost(peer string) (string, error) {
+	u, err := url.Parse(peer)
+	if err != nil {
+		return "", fmt.Errorf("invalid peer url %q: %v", peer, err)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid peer url %q: missing host", peer)
+	}
+	return u.Host, nil
+}
+
+func validateAddr(name, addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid %s address %q: %v", name, addr, err)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("invalid %s address %q: %v", name, addr, err)
+	}
+	return nil
+}
+
+// validate checks the config before anything is started, and creates the data directory if it doesn't exist yet
+func (c *config) validate() error {
+	if err := validateAddr("listen", c.listenAddr); err != nil {
+		return err
+	}
+	if err := validateAddr("advertise", c.advertiseAddr); err != nil {
+		return err
+	}
+	// clients can't dial a wildcard address, so one has to be advertised explicitly when listening on all interfaces
+	host, _, _ := net.SplitHostPort(c.advertiseAddr)
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return fmt.Errorf("advertise address %q must name a host that clients can reach", c.advertiseAddr)
+	}
+
+	bound := map[string]string{"listen": c.listenAddr}
+	for name, addr := range map[string]string{"raft": c.raftAddr, "admin": c.adminAddr} {
+		if addr == "" {
+			continue
+		}
+		if err := validateAddr(name, addr); err != nil {
+			return err
+		}
+		for other, otherAddr := range bound {
+			if addr == otherAddr {
+				return fmt.Errorf("%s and %s addresses are both %q", name, other, addr)
+			}
+		}
+		bound[name] = addr
+	}
+
+	if c.adminToken != "" && c.adminAddr == "" {
+		return fmt.Errorf("an admin token needs the admin address to be enabled")
+	}
+
+	if c.dataDir == "" {
+		return fmt.Errorf("data directory must not be empty")
+	}
+	if err := os.MkdirAll(c.dataDir, 0750); err != nil {
+		return fmt.Errorf("unable to create data directory: %v", err)
+	}
+	return nil
+}
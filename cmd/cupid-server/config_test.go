@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	dir := t.TempDir()
+	notADir := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(notADir, []byte("not a directory"), 0600); err != nil {
+		t.Fatal("unable to write file:", err)
+	}
+
+	valid := func() config {
+		return config{
+			dataDir:       filepath.Join(dir, "data"),
+			listenAddr:    "localhost:9121",
+			advertiseAddr: "cupid.example.com:9121",
+			raftAddr:      "localhost:12379",
+			adminAddr:     "localhost:9122",
+			adminToken:    "secret",
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		change func(c *config)
+		err    string // part of the expected error, or empty if the config is valid
+	}{
+		{"valid", func(c *config) {}, ""},
+		{"valid without raft or admin", func(c *config) { c.raftAddr, c.adminAddr, c.adminToken = "", "", "" }, ""},
+		{"valid named port", func(c *config) { c.listenAddr = "localhost:http" }, ""},
+		{"listen without port", func(c *config) { c.listenAddr = "localhost" }, "invalid listen address"},
+		{"listen with unknown port", func(c *config) { c.listenAddr = "localhost:notaport" }, "invalid listen address"},
+		{"advertise without port", func(c *config) { c.advertiseAddr = "cupid.example.com" }, "invalid advertise address"},
+		{"advertise without host", func(c *config) { c.advertiseAddr = ":9121" }, "must name a host"},
+		{"advertise wildcard", func(c *config) { c.advertiseAddr = "0.0.0.0:9121" }, "must name a host"},
+		{"advertise ipv6 wildcard", func(c *config) { c.advertiseAddr = "[::]:9121" }, "must name a host"},
+		{"invalid raft", func(c *config) { c.raftAddr = "localhost" }, "invalid raft address"},
+		{"invalid admin", func(c *config) { c.adminAddr = "localhost:-1" }, "invalid admin address"},
+		{"raft on listen", func(c *config) { c.raftAddr = c.listenAddr }, "raft and listen addresses"},
+		{"admin on listen", func(c *config) { c.adminAddr = c.listenAddr }, "admin and listen addresses"},
+		{"admin on raft", func(c *config) { c.adminAddr = c.raftAddr }, "addresses are both"},
+		{"token without admin", func(c *config) { c.adminAddr = "" }, "admin token needs the admin address"},
+		{"empty data directory", func(c *config) { c.dataDir = "" }, "data directory must not be empty"},
+		{"data directory under a file", func(c *config) { c.dataDir = filepath.Join(notADir, "data") }, "unable to create data directory"},
+	} {
+		c := valid()
+		tc.change(&c)
+
+		err := c.validate()
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		} else if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: expected error containing %q, got: %v", tc.name, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/kbuzsaki/cupid/server"
+)
+
+// inspectAdmin serves the read only admin api for looking at what the server holds:
+//
+//	GET /admin/cluster              the current cluster state
+//	GET /admin/sessions             every session with its last keepalive and its open descriptors
+//	GET /admin/sessions?sd=<sd>     a single session
+//	GET /admin/locks                the holders and queued waiters of every lock that is held or waited on
+//	GET /admin/node?path=<path>     a node's content and stat
+//
+// keepalive times, waiters and lock delays are only known to the leader, so ask the leader when a lock looks stuck.
+type inspectAdmin struct {
+	in server.Introspector
+}
+
+func registerInspectAdmin(mux *http.ServeMux, in server.Introspector) {
+	ia := &inspectAdmin{in}
+	mux.HandleFunc("/admin/cluster", onlyGet(ia.handleCluster))
+	mux.HandleFunc("/admin/sessions", onlyGet(ia.handleSessions))
+	mux.HandleFunc("/admin/locks", onlyGet(ia.handleLocks))
+	mux.HandleFunc("/admin/node", onlyGet(ia.handleNode))
+}
+
+func onlyGet(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (ia *inspectAdmin) handleCluster(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, ia.in.GetClusterState())
+}
+
+func (ia *inspectAdmin) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("sd") == "" {
+		writeJSON(w, ia.in.GetSessions())
+		return
+	}
+
+	sd, err := strconv.ParseUint(r.URL.Query().Get("sd"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid session descriptor: %q", r.URL.Query().Get("sd")), http.StatusBadRequest)
+		return
+	}
+	session, ok := ia.in.GetSession(sd)
+	if !ok {
+		http.Error(w, fmt.Sprintf("session %d does not exist", sd), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, session)
+}
+
+func (ia *inspectAdmin) handleLocks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, ia.in.GetLocks())
+}
+
+func (ia *inspectAdmin) handleNode(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "missing node path", http.StatusBadRequest)
+		return
+	}
+
+	cas, ok := ia.in.GetNode(path)
+	if !ok {
+		http.Error(w, fmt.Sprintf("node %q does not exist", path), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, cas)
+}
@@ -3,72 +3,229 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/snap"
 	"github.com/coreos/pkg/capnslog"
+	"github.com/kbuzsaki/cupid/cmd/internal/admintoken"
 	"github.com/kbuzsaki/cupid/rpcclient"
 	"github.com/kbuzsaki/cupid/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const (
+	// how long a leader that is shutting down waits for another member to take over
+	shutdownTransferTimeout = 5 * time.Second
+	// how long the calls in progress get to finish when shutting down, keepalives may have to be cut short
+	shutdownDrainTimeout = 5 * time.Second
+)
+
+func loadSnapshot(snapshotter *snap.Snapshotter, fsm server.FSM) error {
+	snapshot, err := snapshotter.Load()
+	if err == snap.ErrNoSnapshot {
+		return nil
+	} else if err != nil {
+		return err
+	} else if len(snapshot.Data) == 0 {
+		// snapshots taken before the fsm supported snapshotting carry no data
+		return nil
+	}
+
+	log.Printf("loading snapshot at term %d and index %d", snapshot.Metadata.Term, snapshot.Metadata.Index)
+	return fsm.RecoverFromSnapshot(snapshot.Data)
+}
+
+// standalonePeers is the cluster of a standalone server. a one member cluster commits as soon as its entries reach
+// the wal, and replays the wal and snapshots on restart like any other member. it can still be grown later through
+// the membership admin api.
+func standalonePeers(port int, raftlisten string) []string {
+	peer := fmt.Sprintf("localhost:%d", port+2)
+	if raftlisten != "" {
+		peer = raftlisten
+	}
+	return []string{"http://" + peer}
+}
+
 func main() {
-	cluster := flag.String("cluster", "", "comma separated cluster peers")
+	cluster := flag.String("cluster", "", "comma separated cluster peers, \"standalone\" for a single durable node, or \"none\" for an in-memory server")
 	id := flag.Int("id", 1, "node ID")
-	cupidport := flag.Int("port", 9121, "cupid rpc server port")
+	cupidport := flag.Int("port", 9121, "cupid rpc server port, used for the default listen, advertise and admin addresses")
 	join := flag.Bool("join", false, "join an existing cluster")
 	verbose := flag.Bool("verbose", false, "enable verbose logging")
+	batch := flag.Int("batch", server.DefaultMaxBatchSize, "max proposals per raft log entry, 1 disables batching")
+	datadir := flag.String("datadir", ".", "directory to keep the wal and snapshots in")
+	listen := flag.String("listen", "", "address to serve cupid rpc on (default localhost:port)")
+	advertise := flag.String("advertise", "", "address clients should use to reach this server (default the listen address)")
+	raftlisten := flag.String("raftlisten", "", "address to serve raft on (default the host of this node's peer url)")
+	admin := flag.String("admin", "", "address to serve the admin and debug http api on, \"none\" to disable it (default localhost:port+1)")
+	admintokenfile := flag.String("admintokenfile", "", "file holding the bearer token that enables the admin changes to members, sessions and locks")
 	flag.Parse()
 
+	var peers []string
+	switch *cluster {
+	case "none":
+	case "standalone":
+		if *id != 1 || *join {
+			log.Fatal("a standalone server must have id 1 and can't join a cluster")
+		}
+		peers = standalonePeers(*cupidport, *raftlisten)
+	default:
+		peers = strings.Split(*cluster, ",")
+		if *id < 1 || *id > len(peers) {
+			log.Fatalf("node id %d is not in the %d member cluster", *id, len(peers))
+		}
+	}
+
+	cfg := &config{
+		dataDir:       *datadir,
+		listenAddr:    *listen,
+		advertiseAddr: *advertise,
+		raftAddr:      *raftlisten,
+		adminAddr:     *admin,
+	}
+	if cfg.listenAddr == "" {
+		cfg.listenAddr = fmt.Sprintf("localhost:%d", *cupidport)
+	}
+	if cfg.advertiseAddr == "" {
+		cfg.advertiseAddr = cfg.listenAddr
+	}
+	if cfg.raftAddr == "" && peers != nil {
+		host, err := peerHost(peers[*id-1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.raftAddr = host
+	}
+	if cfg.adminAddr == "" {
+		cfg.adminAddr = fmt.Sprintf("localhost:%d", *cupidport+1)
+	} else if cfg.adminAddr == "none" {
+		cfg.adminAddr = ""
+	}
+	if *admintokenfile != "" {
+		token, err := admintoken.Read(*admintokenfile)
+		if err != nil {
+			log.Fatal("invalid configuration: ", err)
+		}
+		cfg.adminToken = token
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatal("invalid configuration: ", err)
+	}
+
+	// capnslog takes over the standard logger, so quieting it is left until the configuration errors are reported
 	if !*verbose {
 		capnslog.SetGlobalLogLevel(capnslog.ERROR)
 	}
 
-	go http.ListenAndServe(fmt.Sprintf("localhost:%d", *cupidport+1), nil)
+	// signals are caught from here on, so a server that is still starting up shuts down once it is ready
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGTERM, syscall.SIGINT)
 
-	cupidaddr := fmt.Sprintf("localhost:%d", *cupidport)
+	http.Handle("/metrics", promhttp.Handler())
+	if cfg.adminAddr != "" {
+		go func() { log.Fatal(http.ListenAndServe(cfg.adminAddr, nil)) }()
+	}
 
-	if *cluster == "none" {
+	if peers == nil {
 		s, err := server.NewFrontend()
 		if err != nil {
 			log.Fatal("error intializing server:", err)
 		}
 
-		log.Println("starting cupid-server on", cupidaddr)
-		ready := make(chan bool)
-		rpcclient.ServeCupidRPC(s, cupidaddr, ready)
+		registerInspectAdmin(http.DefaultServeMux, s.(server.Introspector))
+		registerOperatorAdmin(http.DefaultServeMux, s.(server.Introspector), s.(server.Operator), cfg.adminToken)
+		listener := serveRPC(s, cfg)
+		waitForSignal(sigC)
+		listener.Shutdown(shutdownDrainTimeout)
+		s.(io.Closer).Close()
 	} else {
-		proposeC := make(chan string)
-		defer close(proposeC)
-		confChangeC := make(chan raftpb.ConfChange)
-		defer close(confChangeC)
+		rs := startRaftServer(*id, peers, *join, *batch, cfg, http.DefaultServeMux)
+		prometheus.MustRegister(server.NewFSMCollector(rs.fsm))
+		waitForSignal(sigC)
+		rs.stop()
+	}
+	log.Println("cupid-server stopped")
+}
 
-		// raft provides a commit stream for the proposals from the http api
-		fsm, err := server.NewFSM()
-		if err != nil {
-			log.Fatal("unable to open fsm:", err)
-		}
+// raftServer is a cupid server backed by a member of a raft cluster, which may be a standalone one member cluster
+type raftServer struct {
+	s        server.Server
+	fsm      server.FSM
+	rc       *raftNode
+	listener *rpcclient.CupidRPCListener
+}
 
-		getSnapshot := func() ([]byte, error) {
-			log.Println("no snapshotting available")
-			return nil, nil
-		}
-		commitC, errorC, stateC, snapshotterReady := newRaftNode(*id, strings.Split(*cluster, ","), *join, getSnapshot, proposeC, confChangeC)
+// startRaftServer starts this member's raft node on the snapshot and wal in the data directory, and serves cupid
+// rpc from it along with the admin api on mux
+func startRaftServer(id int, peers []string, join bool, batch int, cfg *config, mux *http.ServeMux) *raftServer {
+	proposeC := make(chan string)
+	confChangeC := make(chan raftpb.ConfChange)
 
-		// TODO: what to do with these things?
-		_ = errorC
-		_ = snapshotterReady
+	// raft provides a commit stream for the proposals from the http api
+	fsm, err := server.NewFSM()
+	if err != nil {
+		log.Fatal("unable to open fsm:", err)
+	}
 
-		raftFSM := server.NewRaftFSM(proposeC, commitC, fsm)
-		s, err := server.NewFrontendWithFSM(raftFSM, stateC)
-		if err != nil {
-			log.Fatalf("error initializing server: %v\n", err)
-		}
+	members := newMembership(peers)
+	registerMembershipAdmin(mux, members, confChangeC, cfg.adminToken)
+
+	var raftFSM server.FSM
+	getSnapshot := func() ([]byte, error) { return raftFSM.GetSnapshot() }
+	commitC, errorC, stateC, snapshotterReady, rc := newRaftNode(id, peers, join, cfg, members, getSnapshot, proposeC, confChangeC)
+
+	// TODO: what to do with these things?
+	_ = errorC
 
-		log.Println("starting cupid-server on", cupidaddr)
-		ready := make(chan bool)
-		rpcclient.ServeCupidRPC(s, cupidaddr, ready)
+	// the wal is only replayed from the last snapshot onwards, so restore it before reading any commits
+	if err := loadSnapshot(<-snapshotterReady, fsm); err != nil {
+		log.Fatal("unable to load snapshot:", err)
 	}
+
+	go publishRPCAddr(uint64(id), cfg.advertiseAddr, members, confChangeC)
+
+	raftFSM = server.NewRaftFSMWithBatchSize(proposeC, commitC, rc.readIndex, fsm, batch)
+	s, err := server.NewFrontendWithFSM(raftFSM, stateC)
+	if err != nil {
+		log.Fatalf("error initializing server: %v\n", err)
+	}
+
+	registerInspectAdmin(mux, s.(server.Introspector))
+	registerOperatorAdmin(mux, s.(server.Introspector), s.(server.Operator), cfg.adminToken)
+	return &raftServer{s: s, fsm: fsm, rc: rc, listener: serveRPC(s, cfg)}
+}
+
+// stop hands off leadership first so that the rest of the cluster is available again as soon as possible, then
+// lets the calls in progress finish or fail over before raft is stopped and the wal closed
+func (rs *raftServer) stop() {
+	rs.rc.transferLeadership(shutdownTransferTimeout)
+	rs.listener.Shutdown(shutdownDrainTimeout)
+	rs.s.(io.Closer).Close()
+	rs.rc.shutdown()
+}
+
+func serveRPC(s server.Server, cfg *config) *rpcclient.CupidRPCListener {
+	listener, err := rpcclient.ListenCupidRPC(s, cfg.listenAddr)
+	if err != nil {
+		log.Fatal("unable to serve cupid rpc: ", err)
+	}
+
+	log.Println("starting cupid-server on", cfg.listenAddr, "advertised as", cfg.advertiseAddr)
+	go listener.Serve()
+	return listener
+}
+
+func waitForSignal(sigC <-chan os.Signal) {
+	sig := <-sigC
+	log.Println("received", sig, "shutting down")
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/kbuzsaki/cupid/server"
+)
+
+const (
+	// raft drops conf changes proposed while another one is pending, so publishing is retried fairly quickly
+	publishRetryTimeout = time.Second
+)
+
+var (
+	ErrMembershipTimeout = errors.New("timed out waiting for membership change to apply")
+)
+
+// membership tracks the peer url and client rpc address of every member of the raft cluster. it starts out as
+// the -cluster list and is kept up to date as conf changes are applied. rpc addresses are only known once
+// each member has published its own.
+// TODO: urls of members added at runtime are not in snapshots, so restarted nodes rely on -cluster for them
+type membership struct {
+	lock    sync.RWMutex
+	peers   map[uint64]server.Member
+	changed chan struct{}
+}
+
+func newMembership(peers []string) *membership {
+	m := &membership{
+		peers:   make(map[uint64]server.Member),
+		changed: make(chan struct{}),
+	}
+	for i, peer := range peers {
+		m.peers[uint64(i+1)] = server.Member{ID: uint64(i + 1), PeerURL: peer}
+	}
+	return m
+}
+
+// encodeMember builds the context for a conf change that adds or updates member
+func encodeMember(member server.Member) []byte {
+	data, err := json.Marshal(&member)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// decodeMember reads the context of a conf change for node id
+func decodeMember(id uint64, context []byte) server.Member {
+	var member server.Member
+	if err := json.Unmarshal(context, &member); err != nil {
+		// older conf changes carry just the peer url
+		return server.Member{ID: id, PeerURL: string(context)}
+	}
+	member.ID = id
+	return member
+}
+
+func (m *membership) Get(id uint64) (server.Member, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	member, ok := m.peers[id]
+	return member, ok
+}
+
+// Update adds member, or replaces what is known about it if it is already present.
+// fields that are empty in member are left as they were.
+func (m *membership) Update(member server.Member) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	old := m.peers[member.ID]
+	if member.PeerURL == "" {
+		member.PeerURL = old.PeerURL
+	}
+	if member.RPCAddr == "" {
+		member.RPCAddr = old.RPCAddr
+	}
+	m.peers[member.ID] = member
+	m.notifyLocked()
+}
+
+func (m *membership) Remove(id uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.peers, id)
+	m.notifyLocked()
+}
+
+func (m *membership) notifyLocked() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *membership) Members() []server.Member {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var members []server.Member
+	for _, member := range m.peers {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+// WaitFor blocks until cond holds for the membership or until timeout passes
+func (m *membership) WaitFor(cond func(m *membership) bool, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		m.lock.RLock()
+		changed := m.changed
+		m.lock.RUnlock()
+
+		if cond(m) {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return ErrMembershipTimeout
+		}
+	}
+}
+
+// publishRPCAddr records this member's client rpc address in the replicated membership so that leader redirects
+// carry an address that clients can dial. the conf change is retried until it has been applied, since it can be
+// dropped while there is no leader.
+func publishRPCAddr(id uint64, rpcAddr string, members *membership, confChangeC chan<- raftpb.ConfChange) {
+	for {
+		if member, ok := members.Get(id); ok && member.RPCAddr == rpcAddr {
+			return
+		}
+
+		confChangeC <- raftpb.ConfChange{
+			Type:    raftpb.ConfChangeUpdateNode,
+			NodeID:  id,
+			Context: encodeMember(server.Member{ID: id, RPCAddr: rpcAddr}),
+		}
+		err := members.WaitFor(func(m *membership) bool {
+			member, ok := m.Get(id)
+			return ok && member.RPCAddr == rpcAddr
+		}, publishRetryTimeout)
+		if err == nil {
+			log.Println("published rpc address:", rpcAddr)
+			return
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	commitIndex = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cupid",
+		Name:      "raft_commit_index",
+		Help:      "The highest raft log index known to be committed.",
+	})
+
+	appliedIndex = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cupid",
+		Name:      "raft_applied_index",
+		Help:      "The highest raft log index handed to the fsm.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(commitIndex, appliedIndex)
+}
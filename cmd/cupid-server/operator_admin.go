@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/kbuzsaki/cupid/server"
+)
+
+// operatorAdmin serves the admin api for taking sessions and locks away from wedged clients:
+//
+//	POST /admin/sessions/expire?sd=<sd>     closes a session as if its lease ran out
+//	POST /admin/locks/release?path=<path>   releases a lock from all of its holders
+//
+// the holders that lose a lock get a LockInvalidationEvent and the lock stays in its lock-delay. like the membership
+// changes these need a "Authorization: Bearer <token>" header with the token from -admintokenfile, and are refused
+// when the server was started without one. they have to be sent to the leader.
+type operatorAdmin struct {
+	in    server.Introspector
+	op    server.Operator
+	token string
+}
+
+func registerOperatorAdmin(mux *http.ServeMux, in server.Introspector, op server.Operator, token string) {
+	oa := &operatorAdmin{in, op, token}
+	mux.HandleFunc("/admin/sessions/expire", oa.authorized(oa.handleExpireSession))
+	mux.HandleFunc("/admin/locks/release", oa.authorized(oa.handleReleaseLock))
+}
+
+func (oa *operatorAdmin) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if checkToken(w, r, oa.token) {
+			handler(w, r)
+		}
+	}
+}
+
+func (oa *operatorAdmin) handleExpireSession(w http.ResponseWriter, r *http.Request) {
+	sd, err := strconv.ParseUint(r.URL.Query().Get("sd"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid session descriptor: %q", r.URL.Query().Get("sd")), http.StatusBadRequest)
+		return
+	}
+
+	// respond with what the session held, which is gone once it has expired
+	session, ok := oa.in.GetSession(sd)
+	if !ok {
+		http.Error(w, fmt.Sprintf("session %d does not exist", sd), http.StatusNotFound)
+		return
+	}
+	if err := oa.op.ExpireSession(session.SD); err != nil {
+		writeOperatorError(w, err)
+		return
+	}
+	writeJSON(w, session)
+}
+
+func (oa *operatorAdmin) handleReleaseLock(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "missing node path", http.StatusBadRequest)
+		return
+	}
+
+	nds, err := oa.op.ForceReleaseLock(path)
+	if err != nil {
+		writeOperatorError(w, err)
+		return
+	}
+	writeJSON(w, nds)
+}
+
+func writeOperatorError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case server.LeaderRedirectError:
+		http.Error(w, fmt.Sprintf("not the leader, send it to the leader's admin address instead: %v", err), http.StatusMisdirectedRequest)
+		return
+	}
+
+	switch err {
+	case server.ErrNoLeader:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case server.ErrInvalidSessionDescriptor, server.ErrNodeNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case server.ErrLockNotHeld:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -15,12 +15,11 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -50,6 +49,7 @@ type raftNode struct {
 	join        bool     // node is joining an existing cluster
 	waldir      string   // path to WAL directory
 	snapdir     string   // path to snapshot directory
+	raftAddr    string   // address the raft transport listens on
 	getSnapshot func() ([]byte, error)
 	lastIndex   uint64 // index of log at start
 
@@ -57,6 +57,15 @@ type raftNode struct {
 	snapshotIndex uint64
 	appliedIndex  uint64
 
+	members *membership // peer URLs of the current members
+	lead    uint64      // ID of the current leader, or 0 if there isn't one
+
+	readLock     sync.Mutex
+	readCount    uint64                  // number of read requests made, for unique request contexts
+	pendingReads map[string]*readRequest // reads waiting on raft to confirm their read index
+	readyReads   []*readRequest          // reads waiting on their read index to be applied
+	nodeReady    chan struct{}           // closed once node is started
+
 	// raft backing for the commit/error channel
 	node        raft.Node
 	raftStorage *raft.MemoryStorage
@@ -68,6 +77,8 @@ type raftNode struct {
 	snapCount uint64
 	transport *rafthttp.Transport
 	stopc     chan struct{} // signals proposal channel closed
+	shutdownc chan struct{} // signals the server is shutting down
+	donec     chan struct{} // signals raft has stopped and the wal is closed
 	httpstopc chan struct{} // signals http server to shutdown
 	httpdonec chan struct{} // signals http server shutdown complete
 }
@@ -78,9 +89,9 @@ var defaultSnapCount uint64 = 10000
 // channel and error channel. Proposals for log updates are sent over the
 // provided the proposal channel. All log entries are replayed over the
 // commit channel, followed by a nil message (to indicate the channel is
-// current), then new log entries. To shutdown, close proposeC and read errorC.
-func newRaftNode(id int, peers []string, join bool, getSnapshot func() ([]byte, error), proposeC <-chan string,
-	confChangeC <-chan raftpb.ConfChange) (<-chan *string, <-chan error, <-chan server.ClusterState, <-chan *snap.Snapshotter) {
+// current), then new log entries. To shutdown, close proposeC and read errorC, or call shutdown on the returned node.
+func newRaftNode(id int, peers []string, join bool, cfg *config, members *membership, getSnapshot func() ([]byte, error), proposeC <-chan string,
+	confChangeC <-chan raftpb.ConfChange) (<-chan *string, <-chan error, <-chan server.ClusterState, <-chan *snap.Snapshotter, *raftNode) {
 
 	commitC := make(chan *string)
 	errorC := make(chan error)
@@ -95,19 +106,25 @@ func newRaftNode(id int, peers []string, join bool, getSnapshot func() ([]byte,
 		id:          id,
 		peers:       peers,
 		join:        join,
-		waldir:      fmt.Sprintf("raftexample-%d", id),
-		snapdir:     fmt.Sprintf("raftexample-%d-snap", id),
+		waldir:      cfg.walDir(id),
+		snapdir:     cfg.snapDir(id),
+		raftAddr:    cfg.raftAddr,
 		getSnapshot: getSnapshot,
 		snapCount:   defaultSnapCount,
+		members:     members,
 		stopc:       make(chan struct{}),
+		shutdownc:   make(chan struct{}),
+		donec:       make(chan struct{}),
 		httpstopc:   make(chan struct{}),
 		httpdonec:   make(chan struct{}),
 
 		snapshotterReady: make(chan *snap.Snapshotter, 1),
+		pendingReads:     make(map[string]*readRequest),
+		nodeReady:        make(chan struct{}),
 		// rest of structure populated after WAL replay
 	}
 	go rc.startRaft()
-	return commitC, errorC, stateC, rc.snapshotterReady
+	return commitC, errorC, stateC, rc.snapshotterReady, rc
 }
 
 func (rc *raftNode) saveSnap(snap raftpb.Snapshot) error {
@@ -162,15 +179,24 @@ func (rc *raftNode) publishEntries(ents []raftpb.Entry) bool {
 			switch cc.Type {
 			case raftpb.ConfChangeAddNode:
 				if len(cc.Context) > 0 {
-					rc.transport.AddPeer(types.ID(cc.NodeID), []string{string(cc.Context)})
+					member := decodeMember(cc.NodeID, cc.Context)
+					if cc.NodeID != uint64(rc.id) {
+						rc.transport.AddPeer(types.ID(cc.NodeID), []string{member.PeerURL})
+					}
+					rc.members.Update(member)
 				}
+			case raftpb.ConfChangeUpdateNode:
+				rc.members.Update(decodeMember(cc.NodeID, cc.Context))
 			case raftpb.ConfChangeRemoveNode:
+				rc.members.Remove(cc.NodeID)
 				if cc.NodeID == uint64(rc.id) {
 					log.Println("I've been removed from the cluster! Shutting down.")
 					return false
 				}
 				rc.transport.RemovePeer(types.ID(cc.NodeID))
 			}
+			// the leader's address may have changed along with the peer list
+			rc.publishClusterState()
 		}
 
 		// after commit, update appliedIndex
@@ -291,6 +317,7 @@ func (rc *raftNode) startRaft() {
 		}
 		rc.node = raft.StartNode(c, startPeers)
 	}
+	close(rc.nodeReady)
 
 	ss := &stats.ServerStats{}
 	ss.Initialize()
@@ -340,7 +367,14 @@ func (rc *raftNode) publishSnapshot(snapshotToSave raftpb.Snapshot) {
 	if snapshotToSave.Metadata.Index <= rc.appliedIndex {
 		log.Fatalf("snapshot index [%d] should > progress.appliedIndex [%d] + 1", snapshotToSave.Metadata.Index, rc.appliedIndex)
 	}
-	rc.commitC <- nil // trigger kvstore to load snapshot
+	// hand the snapshot to the fsm through the commit stream so that it is applied in order
+	restore := server.RestoreSnapshotProposal{Data: snapshotToSave.Data}
+	s := server.Encode(restore.Wrap())
+	select {
+	case rc.commitC <- &s:
+	case <-rc.stopc:
+		return
+	}
 
 	rc.confState = snapshotToSave.Metadata.ConfState
 	rc.snapshotIndex = snapshotToSave.Metadata.Index
@@ -388,6 +422,7 @@ func (rc *raftNode) serveChannels() {
 	rc.snapshotIndex = snap.Metadata.Index
 	rc.appliedIndex = snap.Metadata.Index
 
+	defer close(rc.donec)
 	defer rc.wal.Close()
 
 	ticker := time.NewTicker(100 * time.Millisecond)
@@ -403,8 +438,11 @@ func (rc *raftNode) serveChannels() {
 				if !ok {
 					rc.proposeC = nil
 				} else {
-					// blocks until accepted by raft state machine
-					rc.node.Propose(context.TODO(), []byte(prop))
+					// blocks until accepted by raft state machine. proposals that raft drops are failed by the
+					// fsm once their deadline passes.
+					if err := rc.node.Propose(context.TODO(), []byte(prop)); err != nil {
+						log.Println("unable to propose:", err)
+					}
 				}
 
 			case cc, ok := <-rc.confChangeC:
@@ -430,21 +468,15 @@ func (rc *raftNode) serveChannels() {
 		// store raft entries to wal, then publish over commit channel
 		case rd := <-rc.node.Ready():
 			if rd.SoftState != nil {
-				leaderId := atomic.LoadUint64(&rd.SoftState.Lead)
-				log.Println("***** new leader id:", leaderId)
-
-				var cs server.ClusterState
-				if leaderId != 0 {
-					cs = server.ClusterState{
-						IsLeader:   uint64(rc.id) == leaderId,
-						LeaderID:   int(leaderId),
-						LeaderAddr: rc.peers[leaderId-1],
-					}
-				}
-				rc.stateC <- cs
+				rc.lead = atomic.LoadUint64(&rd.SoftState.Lead)
+				log.Println("***** new leader id:", rc.lead)
+				rc.publishClusterState()
 			}
 
 			rc.wal.Save(rd.HardState, rd.Entries)
+			if !raft.IsEmptyHardState(rd.HardState) {
+				commitIndex.Set(float64(rd.HardState.Commit))
+			}
 			if !raft.IsEmptySnap(rd.Snapshot) {
 				rc.saveSnap(rd.Snapshot)
 				rc.raftStorage.ApplySnapshot(rd.Snapshot)
@@ -452,10 +484,13 @@ func (rc *raftNode) serveChannels() {
 			}
 			rc.raftStorage.Append(rd.Entries)
 			rc.transport.Send(rd.Messages)
+			rc.confirmReads(rd.ReadStates)
 			if ok := rc.publishEntries(rc.entriesToApply(rd.CommittedEntries)); !ok {
 				rc.stop()
 				return
 			}
+			appliedIndex.Set(float64(rc.appliedIndex))
+			rc.releaseReads()
 			rc.maybeTriggerSnapshot()
 			rc.node.Advance()
 
@@ -466,17 +501,72 @@ func (rc *raftNode) serveChannels() {
 		case <-rc.stopc:
 			rc.stop()
 			return
+
+		case <-rc.shutdownc:
+			rc.stop()
+			return
 		}
 	}
 }
 
-func (rc *raftNode) serveRaft() {
-	url, err := url.Parse(rc.peers[rc.id-1])
-	if err != nil {
-		log.Fatalf("raftexample: Failed parsing URL (%v)", err)
+// transferLeadership hands off leadership to the most up to date of the other members if this node is the leader,
+// and waits up to timeout for it to take over. the proposals that were still pending here fail over to the new
+// leader along with their clients, rather than waiting out an election timeout once this node is gone.
+func (rc *raftNode) transferLeadership(timeout time.Duration) {
+	<-rc.nodeReady
+	status := rc.node.Status()
+	if status.Lead != uint64(rc.id) {
+		return
+	}
+
+	var transferee, match uint64
+	for id, pr := range status.Progress {
+		if id != uint64(rc.id) && (transferee == 0 || pr.Match > match) {
+			transferee, match = id, pr.Match
+		}
 	}
+	if transferee == 0 {
+		// there's nobody to hand off to
+		return
+	}
+
+	log.Println("transferring leadership to", transferee)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	ln, err := newStoppableListener(url.Host, rc.httpstopc)
+	rc.node.TransferLeadership(ctx, status.Lead, transferee)
+	for ctx.Err() == nil {
+		if lead := rc.node.Status().Lead; lead != raft.None && lead != uint64(rc.id) {
+			log.Println("transferred leadership to", lead)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Println("timed out transferring leadership to", transferee)
+}
+
+// shutdown stops raft and waits for the wal to be closed
+func (rc *raftNode) shutdown() {
+	close(rc.shutdownc)
+	<-rc.donec
+}
+
+// publishClusterState tells the frontend who the current leader is and where to find it
+func (rc *raftNode) publishClusterState() {
+	var cs server.ClusterState
+	if rc.lead != 0 {
+		leader, _ := rc.members.Get(rc.lead)
+		cs = server.ClusterState{
+			IsLeader:   uint64(rc.id) == rc.lead,
+			LeaderID:   int(rc.lead),
+			LeaderAddr: leader.RPCAddr,
+		}
+	}
+	rc.stateC <- cs
+}
+
+func (rc *raftNode) serveRaft() {
+	ln, err := newStoppableListener(rc.raftAddr, rc.httpstopc)
 	if err != nil {
 		log.Fatalf("raftexample: Failed to listen rafthttp (%v)", err)
 	}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/coreos/etcd/raft"
+	"golang.org/x/net/context"
+)
+
+// readRequest is a linearizable read that is waiting on its read index
+type readRequest struct {
+	rctx  string
+	index uint64
+	done  chan struct{}
+}
+
+// readIndex implements server.ReadIndexFunc. raft confirms the read index with a quorum of the cluster, and then
+// the read waits until the entries up to it have been sent on the commit channel.
+func (rc *raftNode) readIndex(ctx context.Context) error {
+	select {
+	case <-rc.nodeReady:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// the leader tells read requests apart by their context, so it has to be unique across the whole cluster
+	rctx := make([]byte, 16)
+	binary.BigEndian.PutUint64(rctx, uint64(rc.id))
+	binary.BigEndian.PutUint64(rctx[8:], atomic.AddUint64(&rc.readCount, 1))
+
+	req := &readRequest{rctx: string(rctx), done: make(chan struct{})}
+	rc.readLock.Lock()
+	rc.pendingReads[req.rctx] = req
+	rc.readLock.Unlock()
+
+	err := rc.node.ReadIndex(ctx, rctx)
+	if err == nil {
+		select {
+		case <-req.done:
+			return nil
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	// raft silently drops read requests when there is no leader, so give up on the request
+	rc.readLock.Lock()
+	delete(rc.pendingReads, req.rctx)
+	for i, ready := range rc.readyReads {
+		if ready == req {
+			rc.readyReads = append(rc.readyReads[:i], rc.readyReads[i+1:]...)
+			break
+		}
+	}
+	rc.readLock.Unlock()
+	return err
+}
+
+// confirmReads records the read indexes that raft has confirmed
+func (rc *raftNode) confirmReads(readStates []raft.ReadState) {
+	if len(readStates) == 0 {
+		return
+	}
+
+	rc.readLock.Lock()
+	defer rc.readLock.Unlock()
+
+	for _, rs := range readStates {
+		req, ok := rc.pendingReads[string(rs.RequestCtx)]
+		if !ok {
+			continue
+		}
+		delete(rc.pendingReads, req.rctx)
+		req.index = rs.Index
+		rc.readyReads = append(rc.readyReads, req)
+	}
+}
+
+// releaseReads lets the reads whose read index has been applied go ahead
+func (rc *raftNode) releaseReads() {
+	rc.readLock.Lock()
+	defer rc.readLock.Unlock()
+
+	waiting := rc.readyReads[:0]
+	for _, req := range rc.readyReads {
+		if req.index <= rc.appliedIndex {
+			close(req.done)
+		} else {
+			waiting = append(waiting, req)
+		}
+	}
+	rc.readyReads = waiting
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kbuzsaki/cupid/server"
+)
+
+// openSessionOnLeader opens a session once the server has elected itself leader
+func openSessionOnLeader(t *testing.T, s server.Server) server.SessionDescriptor {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		sd, err := s.OpenSession(server.NewRequestID())
+		if err == nil {
+			return sd
+		} else if time.Now().After(deadline) {
+			t.Fatal("server never became the leader:", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestStandalone_Restart(t *testing.T) {
+	cfg := &config{
+		dataDir:       t.TempDir(),
+		listenAddr:    "127.0.0.1:0",
+		advertiseAddr: "127.0.0.1:0",
+		raftAddr:      "127.0.0.1:0",
+	}
+	peers := standalonePeers(0, cfg.raftAddr)
+
+	rs := startRaftServer(1, peers, false, server.DefaultMaxBatchSize, cfg, http.NewServeMux())
+	sd := openSessionOnLeader(t, rs.s)
+	nd, err := rs.s.Open(server.NewRequestID(), sd, "/standalone/node", false, false, server.EventsConfig{})
+	if err != nil {
+		t.Fatal("unable to open node:", err)
+	}
+
+	// the write waits for the session to ack its invalidation, which the next keepalive does
+	done := make(chan struct{})
+	go func(s server.Server) {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				s.KeepAlive(server.LeaseInfo{Session: sd}, nil, 10*time.Millisecond)
+			}
+		}
+	}(rs.s)
+	ok, err := rs.s.SetContent(server.NewRequestID(), nd, "durable", 0)
+	close(done)
+	if err != nil || !ok {
+		t.Fatal("unable to set content:", ok, err)
+	}
+	if _, err := rs.s.Open(server.NewRequestID(), sd, "/standalone/dir/child", false, false, server.EventsConfig{}); err != nil {
+		t.Fatal("unable to open child node:", err)
+	}
+	rs.stop()
+
+	// the new server replays the wal in the same data directory
+	rs = startRaftServer(1, peers, false, server.DefaultMaxBatchSize, cfg, http.NewServeMux())
+	defer rs.stop()
+	openSessionOnLeader(t, rs.s)
+
+	cas, err := rs.s.GetContentAndStat(nd)
+	if err != nil {
+		t.Fatal("node descriptor lost across restart:", err)
+	} else if cas.Content != "durable" || cas.Stat.Generation != 1 {
+		t.Error("content lost across restart:", cas)
+	}
+
+	entries, err := rs.s.List(sd, "/standalone")
+	if err != nil {
+		t.Fatal("session lost across restart:", err)
+	} else if len(entries) != 2 || entries[0].Name != "dir" || entries[1].Name != "node" {
+		t.Error("wrong entries after restart:", entries)
+	}
+
+	if _, err := rs.s.KeepAlive(server.LeaseInfo{Session: sd}, nil, time.Millisecond); err != nil {
+		t.Error("unable to keep session alive after restart:", err)
+	}
+}
@@ -0,0 +1,22 @@
+// Package admintoken reads the bearer token that guards the admin api of cupid-server, which cupid-admin sends along.
+package admintoken
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Read reads the token from the first line of path. the servers and the admin tool both take it from a file so
+// that it doesn't show up in the process list.
+func Read(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read admin token: %v", err)
+	}
+	token := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+	if token == "" {
+		return "", fmt.Errorf("admin token file %q is empty", path)
+	}
+	return token, nil
+}
@@ -26,7 +26,7 @@ func doPublish(topic string, count int, created *sync.WaitGroup, finished *sync.
 		log.Fatal("Could not create client in doPublish", err)
 	}
 
-	nh, err := cl.Open(topic, false, server.EventsConfig{})
+	nh, err := cl.Open(topic, false, false, server.EventsConfig{})
 	if err != nil {
 		log.Fatal("unable to open node handle")
 	}
@@ -66,7 +66,10 @@ func launchPublishers(topic string, numMessages int, numPubs int) {
 		go doPublish(topic, numMessages, &created, &finished)
 	}
 
+	created.Wait()
+	start := time.Now()
 	finished.Wait()
+	reportThroughput(numPubs*numMessages, time.Since(start))
 }
 
 func doSubscribe(topic string, created *sync.WaitGroup, finished *sync.WaitGroup) {
@@ -75,7 +78,7 @@ func doSubscribe(topic string, created *sync.WaitGroup, finished *sync.WaitGroup
 		log.Fatal("Could not launch new raft in doSubscribe", err)
 	}
 
-	nh, err := cl.Open(topic, true, server.EventsConfig{})
+	nh, err := cl.Open(topic, true, false, server.EventsConfig{})
 	if err != nil {
 		log.Fatal("unable to open node handle")
 	}
@@ -123,7 +126,7 @@ func doLocker(topic string, iterations int, created *sync.WaitGroup, finished *s
 		log.Fatal(err)
 	}
 
-	nh, err := cl.Open(topic, false, server.EventsConfig{})
+	nh, err := cl.Open(topic, false, false, server.EventsConfig{})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -159,12 +162,16 @@ func launchLockers(topic string, numGoRoutines, iterations int) {
 		go doLocker(topic, iterations, &created, &finished)
 	}
 
+	created.Wait()
+	start := time.Now()
 	finished.Wait()
+	// every iteration is an acquire and a release
+	reportThroughput(2*numGoRoutines*iterations, time.Since(start))
 }
 
 func doNoper(topic string, numOps uint64, iterations int, created *sync.WaitGroup, finished *sync.WaitGroup) {
 	cl, err := client.NewRaft(addrs, 5*time.Second)
-	nh, err := cl.Open(topic, false, server.EventsConfig{})
+	nh, err := cl.Open(topic, false, false, server.EventsConfig{})
 	if err != nil {
 		log.Fatal("Failed to open file in noper")
 	}
@@ -191,7 +198,16 @@ func launchNopers(topic string, numOps uint64, count, iterations int) {
 		go doNoper(topic, numOps, iterations, &created, &finished)
 	}
 
+	created.Wait()
+	start := time.Now()
 	finished.Wait()
+	reportThroughput(count*iterations*int(numOps), time.Since(start))
+}
+
+// reportThroughput prints the operations per second completed across every goroutine, so that runs against
+// differently configured servers (like cupid-server -batch 1) can be compared
+func reportThroughput(ops int, elapsed time.Duration) {
+	fmt.Printf("throughput: %d ops in %v, %.0f ops/sec\n", ops, elapsed, float64(ops)/elapsed.Seconds())
 }
 
 func launchFailover(topic string, id int) {
@@ -199,13 +215,13 @@ func launchFailover(topic string, id int) {
 	log.Println("opening rpc")
 	s := rpcclient.New(addrs[0], keepAliveDelay)
 	log.Println("opening session")
-	sd, err := s.OpenSession()
+	sd, err := s.OpenSession(server.NewRequestID())
 	if err != nil {
 		log.Fatal("error opening session:", err)
 	}
 
 	log.Println("opening node")
-	nd, err := s.Open(sd, topic, true, server.EventsConfig{})
+	nd, err := s.Open(server.NewRequestID(), sd, topic, true, false, server.EventsConfig{})
 	if err != nil {
 		log.Fatal("error opening node:", err)
 	}
@@ -1,6 +1,7 @@
 #! /bin/bash
 
 NO_CLUSTER='none'
+STANDALONE='standalone'
 ONE_CLUSTER='http://127.0.0.1:12379'
 THREE_CLUSTER='http://127.0.0.1:12379,http://127.0.0.1:22379,http://127.0.0.1:32379'
 FIVE_CLUSTER='http://127.0.0.1:12379,http://127.0.0.1:22379,http://127.0.0.1:32379,http://127.0.0.1:42379,http://127.0.0.1:52379'
@@ -12,7 +13,8 @@ pids=""
 function killservers() {
     echo
     echo "exiting..."
-    kill -9 $pids
+    kill -TERM $pids
+    wait $pids
     echo done
 }
 
@@ -23,6 +25,9 @@ cluster_arg=""
 if [ "$1" = "0" ]; then
     replicas=1
     cluster_arg=$NO_CLUSTER
+elif [ "$1" = "s" ]; then
+    replicas=1
+    cluster_arg=$STANDALONE
 elif [ "$1" = "1" ]; then
     cluster_arg=$ONE_CLUSTER
 elif [ "$1" = "3" ]; then
@@ -3,6 +3,7 @@ package mocks
 
 import mock "github.com/stretchr/testify/mock"
 import server "github.com/kbuzsaki/cupid/server"
+import context "golang.org/x/net/context"
 import time "time"
 
 // Server is an autogenerated mock type for the Server type
@@ -24,13 +25,27 @@ func (_m *Server) Acquire(node server.NodeDescriptor) error {
 	return r0
 }
 
-// CloseNode provides a mock function with given fields: nd
-func (_m *Server) CloseNode(nd server.NodeDescriptor) error {
-	ret := _m.Called(nd)
+// AcquireContext provides a mock function with given fields: ctx, node
+func (_m *Server) AcquireContext(ctx context.Context, node server.NodeDescriptor) error {
+	ret := _m.Called(ctx, node)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, server.NodeDescriptor) error); ok {
+		r0 = rf(ctx, node)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// AcquireShared provides a mock function with given fields: node
+func (_m *Server) AcquireShared(node server.NodeDescriptor) error {
+	ret := _m.Called(node)
 
 	var r0 error
 	if rf, ok := ret.Get(0).(func(server.NodeDescriptor) error); ok {
-		r0 = rf(nd)
+		r0 = rf(node)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -38,13 +53,76 @@ func (_m *Server) CloseNode(nd server.NodeDescriptor) error {
 	return r0
 }
 
-// CloseSession provides a mock function with given fields: sd
-func (_m *Server) CloseSession(sd server.SessionDescriptor) error {
-	ret := _m.Called(sd)
+// CancelAcquire provides a mock function with given fields: node
+func (_m *Server) CancelAcquire(node server.NodeDescriptor) error {
+	ret := _m.Called(node)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(server.SessionDescriptor) error); ok {
-		r0 = rf(sd)
+	if rf, ok := ret.Get(0).(func(server.NodeDescriptor) error); ok {
+		r0 = rf(node)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// CheckSequencer provides a mock function with given fields: seq
+func (_m *Server) CheckSequencer(seq server.Sequencer) (bool, error) {
+	ret := _m.Called(seq)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(server.Sequencer) bool); ok {
+		r0 = rf(seq)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(server.Sequencer) error); ok {
+		r1 = rf(seq)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CloseNode provides a mock function with given fields: id, nd
+func (_m *Server) CloseNode(id server.RequestID, nd server.NodeDescriptor) error {
+	ret := _m.Called(id, nd)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(server.RequestID, server.NodeDescriptor) error); ok {
+		r0 = rf(id, nd)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// CloseSession provides a mock function with given fields: id, sd
+func (_m *Server) CloseSession(id server.RequestID, sd server.SessionDescriptor) error {
+	ret := _m.Called(id, sd)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(server.RequestID, server.SessionDescriptor) error); ok {
+		r0 = rf(id, sd)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Delete provides a mock function with given fields: id, node
+func (_m *Server) Delete(id server.RequestID, node server.NodeDescriptor) error {
+	ret := _m.Called(id, node)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(server.RequestID, server.NodeDescriptor) error); ok {
+		r0 = rf(id, node)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -73,6 +151,48 @@ func (_m *Server) GetContentAndStat(node server.NodeDescriptor) (server.NodeCont
 	return r0, r1
 }
 
+// GetContentAndStatFollower provides a mock function with given fields: node
+func (_m *Server) GetContentAndStatFollower(node server.NodeDescriptor) (server.NodeContentAndStat, error) {
+	ret := _m.Called(node)
+
+	var r0 server.NodeContentAndStat
+	if rf, ok := ret.Get(0).(func(server.NodeDescriptor) server.NodeContentAndStat); ok {
+		r0 = rf(node)
+	} else {
+		r0 = ret.Get(0).(server.NodeContentAndStat)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(server.NodeDescriptor) error); ok {
+		r1 = rf(node)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetSequencer provides a mock function with given fields: node
+func (_m *Server) GetSequencer(node server.NodeDescriptor) (server.Sequencer, error) {
+	ret := _m.Called(node)
+
+	var r0 server.Sequencer
+	if rf, ok := ret.Get(0).(func(server.NodeDescriptor) server.Sequencer); ok {
+		r0 = rf(node)
+	} else {
+		r0 = ret.Get(0).(server.Sequencer)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(server.NodeDescriptor) error); ok {
+		r1 = rf(node)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // KeepAlive provides a mock function with given fields: li, eis, keepAliveDelay
 func (_m *Server) KeepAlive(li server.LeaseInfo, eis []server.EventInfo, keepAliveDelay time.Duration) ([]server.Event, error) {
 	ret := _m.Called(li, eis, keepAliveDelay)
@@ -96,20 +216,80 @@ func (_m *Server) KeepAlive(li server.LeaseInfo, eis []server.EventInfo, keepAli
 	return r0, r1
 }
 
-// Open provides a mock function with given fields: sd, path, readOnly, config
-func (_m *Server) Open(sd server.SessionDescriptor, path string, readOnly bool, config server.EventsConfig) (server.NodeDescriptor, error) {
-	ret := _m.Called(sd, path, readOnly, config)
+// List provides a mock function with given fields: sd, dir
+func (_m *Server) List(sd server.SessionDescriptor, dir string) ([]server.DirEntry, error) {
+	ret := _m.Called(sd, dir)
+
+	var r0 []server.DirEntry
+	if rf, ok := ret.Get(0).(func(server.SessionDescriptor, string) []server.DirEntry); ok {
+		r0 = rf(sd, dir)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]server.DirEntry)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(server.SessionDescriptor, string) error); ok {
+		r1 = rf(sd, dir)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Nop provides a mock function with given fields: numOps
+func (_m *Server) Nop(numOps uint64) error {
+	ret := _m.Called(numOps)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(uint64) error); ok {
+		r0 = rf(numOps)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Open provides a mock function with given fields: id, sd, path, readOnly, ephemeral, config
+func (_m *Server) Open(id server.RequestID, sd server.SessionDescriptor, path string, readOnly bool, ephemeral bool, config server.EventsConfig) (server.NodeDescriptor, error) {
+	ret := _m.Called(id, sd, path, readOnly, ephemeral, config)
 
 	var r0 server.NodeDescriptor
-	if rf, ok := ret.Get(0).(func(server.SessionDescriptor, string, bool, server.EventsConfig) server.NodeDescriptor); ok {
-		r0 = rf(sd, path, readOnly, config)
+	if rf, ok := ret.Get(0).(func(server.RequestID, server.SessionDescriptor, string, bool, bool, server.EventsConfig) server.NodeDescriptor); ok {
+		r0 = rf(id, sd, path, readOnly, ephemeral, config)
 	} else {
 		r0 = ret.Get(0).(server.NodeDescriptor)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(server.SessionDescriptor, string, bool, server.EventsConfig) error); ok {
-		r1 = rf(sd, path, readOnly, config)
+	if rf, ok := ret.Get(1).(func(server.RequestID, server.SessionDescriptor, string, bool, bool, server.EventsConfig) error); ok {
+		r1 = rf(id, sd, path, readOnly, ephemeral, config)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// OpenEventStream provides a mock function with given fields: sd
+func (_m *Server) OpenEventStream(sd server.SessionDescriptor) (server.EventStream, error) {
+	ret := _m.Called(sd)
+
+	var r0 server.EventStream
+	if rf, ok := ret.Get(0).(func(server.SessionDescriptor) server.EventStream); ok {
+		r0 = rf(sd)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(server.EventStream)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(server.SessionDescriptor) error); ok {
+		r1 = rf(sd)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -117,20 +297,20 @@ func (_m *Server) Open(sd server.SessionDescriptor, path string, readOnly bool,
 	return r0, r1
 }
 
-// OpenSession provides a mock function with given fields:
-func (_m *Server) OpenSession() (server.SessionDescriptor, error) {
-	ret := _m.Called()
+// OpenSession provides a mock function with given fields: id
+func (_m *Server) OpenSession(id server.RequestID) (server.SessionDescriptor, error) {
+	ret := _m.Called(id)
 
 	var r0 server.SessionDescriptor
-	if rf, ok := ret.Get(0).(func() server.SessionDescriptor); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(server.RequestID) server.SessionDescriptor); ok {
+		r0 = rf(id)
 	} else {
 		r0 = ret.Get(0).(server.SessionDescriptor)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(server.RequestID) error); ok {
+		r1 = rf(id)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -138,13 +318,13 @@ func (_m *Server) OpenSession() (server.SessionDescriptor, error) {
 	return r0, r1
 }
 
-// Release provides a mock function with given fields: node
-func (_m *Server) Release(node server.NodeDescriptor) error {
-	ret := _m.Called(node)
+// Release provides a mock function with given fields: id, node
+func (_m *Server) Release(id server.RequestID, node server.NodeDescriptor) error {
+	ret := _m.Called(id, node)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(server.NodeDescriptor) error); ok {
-		r0 = rf(node)
+	if rf, ok := ret.Get(0).(func(server.RequestID, server.NodeDescriptor) error); ok {
+		r0 = rf(id, node)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -152,20 +332,20 @@ func (_m *Server) Release(node server.NodeDescriptor) error {
 	return r0
 }
 
-// SetContent provides a mock function with given fields: node, content, generation
-func (_m *Server) SetContent(node server.NodeDescriptor, content string, generation uint64) (bool, error) {
-	ret := _m.Called(node, content, generation)
+// SetContent provides a mock function with given fields: id, node, content, generation
+func (_m *Server) SetContent(id server.RequestID, node server.NodeDescriptor, content string, generation uint64) (bool, error) {
+	ret := _m.Called(id, node, content, generation)
 
 	var r0 bool
-	if rf, ok := ret.Get(0).(func(server.NodeDescriptor, string, uint64) bool); ok {
-		r0 = rf(node, content, generation)
+	if rf, ok := ret.Get(0).(func(server.RequestID, server.NodeDescriptor, string, uint64) bool); ok {
+		r0 = rf(id, node, content, generation)
 	} else {
 		r0 = ret.Get(0).(bool)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(server.NodeDescriptor, string, uint64) error); ok {
-		r1 = rf(node, content, generation)
+	if rf, ok := ret.Get(1).(func(server.RequestID, server.NodeDescriptor, string, uint64) error); ok {
+		r1 = rf(id, node, content, generation)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -173,20 +353,55 @@ func (_m *Server) SetContent(node server.NodeDescriptor, content string, generat
 	return r0, r1
 }
 
-// TryAcquire provides a mock function with given fields: node
-func (_m *Server) TryAcquire(node server.NodeDescriptor) (bool, error) {
-	ret := _m.Called(node)
+// SetLockDelay provides a mock function with given fields: id, node, delay
+func (_m *Server) SetLockDelay(id server.RequestID, node server.NodeDescriptor, delay time.Duration) error {
+	ret := _m.Called(id, node, delay)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(server.RequestID, server.NodeDescriptor, time.Duration) error); ok {
+		r0 = rf(id, node, delay)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// TryAcquire provides a mock function with given fields: id, node
+func (_m *Server) TryAcquire(id server.RequestID, node server.NodeDescriptor) (bool, error) {
+	ret := _m.Called(id, node)
 
 	var r0 bool
-	if rf, ok := ret.Get(0).(func(server.NodeDescriptor) bool); ok {
-		r0 = rf(node)
+	if rf, ok := ret.Get(0).(func(server.RequestID, server.NodeDescriptor) bool); ok {
+		r0 = rf(id, node)
 	} else {
 		r0 = ret.Get(0).(bool)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(server.NodeDescriptor) error); ok {
-		r1 = rf(node)
+	if rf, ok := ret.Get(1).(func(server.RequestID, server.NodeDescriptor) error); ok {
+		r1 = rf(id, node)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// TryAcquireShared provides a mock function with given fields: id, node
+func (_m *Server) TryAcquireShared(id server.RequestID, node server.NodeDescriptor) (bool, error) {
+	ret := _m.Called(id, node)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(server.RequestID, server.NodeDescriptor) bool); ok {
+		r0 = rf(id, node)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(server.RequestID, server.NodeDescriptor) error); ok {
+		r1 = rf(id, node)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -0,0 +1,212 @@
+package rpcclient
+
+import (
+	"bufio"
+	"encoding/gob"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/kbuzsaki/cupid/server"
+)
+
+const (
+	// eventStreamPreamble starts the connections that carry an event stream instead of rpc calls
+	eventStreamPreamble = "CUPID-EVENTS\n"
+	// the server answers every keepalive, so a stream that has been quiet for this long lost its server
+	eventStreamReadTimeout = 10 * time.Second
+)
+
+// the client sends eventStreamOpen first and then eventStreamRequests, and the server answers the open and every
+// request that carries a keepalive with an eventStreamReply, in between pushing the events as they happen
+type eventStreamOpen struct {
+	SD server.SessionDescriptor
+}
+
+type eventStreamRequest struct {
+	// KeepAlive is set for keepalives and Ack for acks, both may be sent together
+	KeepAlive *KeepAliveArgs
+	Ack       uint64
+}
+
+type eventStreamReply struct {
+	Events []server.SequencedEvent
+	// Err is set on the last reply before the server closes the stream
+	Err string
+}
+
+// eventStreamConn is either end of the gob streams in an event stream connection
+type eventStreamConn struct {
+	conn net.Conn
+	dec  *gob.Decoder
+
+	lock sync.Mutex
+	enc  *gob.Encoder
+}
+
+func newEventStreamConn(conn net.Conn, r *bufio.Reader) *eventStreamConn {
+	return &eventStreamConn{conn: conn, dec: gob.NewDecoder(r), enc: gob.NewEncoder(conn)}
+}
+
+func (esc *eventStreamConn) send(v interface{}) error {
+	esc.lock.Lock()
+	defer esc.lock.Unlock()
+	return esc.enc.Encode(v)
+}
+
+// isEventStream reports whether the connection read through r starts with the event stream preamble,
+// consuming the preamble if it does
+func isEventStream(r *bufio.Reader) (bool, error) {
+	preamble, err := r.Peek(len(eventStreamPreamble))
+	if err != nil {
+		return false, err
+	}
+	if string(preamble) != eventStreamPreamble {
+		return false, nil
+	}
+	_, err = r.Discard(len(eventStreamPreamble))
+	return true, err
+}
+
+// serveEventStream serves an event stream connection until it fails or the stream's session goes away
+func serveEventStream(s server.Server, conn net.Conn, r *bufio.Reader) {
+	esc := newEventStreamConn(conn, r)
+
+	var open eventStreamOpen
+	if err := esc.dec.Decode(&open); err != nil {
+		log.Println("unable to read event stream open:", err)
+		return
+	}
+
+	start := time.Now()
+	stream, err := s.OpenEventStream(open.SD)
+	observeRPC("OpenEventStream", start, &err)
+	if err != nil {
+		esc.send(&eventStreamReply{Err: err.Error()})
+		return
+	}
+	defer stream.Close()
+	if err := esc.send(&eventStreamReply{}); err != nil {
+		return
+	}
+
+	// the requests are read in the background and the events pushed from here, until either side fails
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			var req eventStreamRequest
+			if err := esc.dec.Decode(&req); err != nil {
+				failed <- err
+				stream.Close()
+				return
+			}
+
+			if req.Ack > 0 {
+				if err := stream.Ack(req.Ack); err != nil {
+					failed <- err
+					stream.Close()
+					return
+				}
+			}
+			if req.KeepAlive != nil {
+				if err := stream.KeepAlive(req.KeepAlive.LeaseInfo, req.KeepAlive.EventsInfo); err != nil {
+					failed <- err
+					stream.Close()
+					return
+				}
+				if err := esc.send(&eventStreamReply{}); err != nil {
+					failed <- err
+					stream.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		events, err := stream.Recv()
+		if err != nil {
+			select {
+			case err = <-failed:
+			default:
+			}
+			if err != server.ErrEventStreamClosed {
+				esc.send(&eventStreamReply{Err: err.Error()})
+			}
+			return
+		}
+
+		if err := esc.send(&eventStreamReply{Events: events}); err != nil {
+			return
+		}
+	}
+}
+
+// rpcEventStream is the client end of an event stream connection
+type rpcEventStream struct {
+	esc *eventStreamConn
+}
+
+// OpenEventStream dials a new connection for the stream, since the rpc connections can't carry it
+func (cg *clientGlue) OpenEventStream(sd server.SessionDescriptor) (server.EventStream, error) {
+	conn, err := net.Dial("tcp", cg.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	esc := newEventStreamConn(conn, bufio.NewReader(conn))
+	if _, err := conn.Write([]byte(eventStreamPreamble)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := esc.send(&eventStreamOpen{sd}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	es := &rpcEventStream{esc}
+	if _, err := es.recv(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return es, nil
+}
+
+// recv reads the next reply. the errors sent by the server are returned as rpc.ServerErrors, like the errors of
+// the rpc calls, so that redirects are recognized the same way.
+func (es *rpcEventStream) recv() ([]server.SequencedEvent, error) {
+	es.esc.conn.SetReadDeadline(time.Now().Add(eventStreamReadTimeout))
+
+	var reply eventStreamReply
+	if err := es.esc.dec.Decode(&reply); err != nil {
+		return nil, err
+	}
+	if reply.Err != "" {
+		return nil, rpc.ServerError(reply.Err)
+	}
+	return reply.Events, nil
+}
+
+func (es *rpcEventStream) Recv() ([]server.SequencedEvent, error) {
+	for {
+		// the replies to keepalives have no events
+		events, err := es.recv()
+		if err != nil || len(events) > 0 {
+			return events, err
+		}
+	}
+}
+
+func (es *rpcEventStream) Ack(seq uint64) error {
+	return es.esc.send(&eventStreamRequest{Ack: seq})
+}
+
+func (es *rpcEventStream) KeepAlive(li server.LeaseInfo, eis []server.EventInfo) error {
+	return es.esc.send(&eventStreamRequest{KeepAlive: &KeepAliveArgs{LeaseInfo: li, EventsInfo: eis}})
+}
+
+func (es *rpcEventStream) Close() error {
+	return es.esc.conn.Close()
+}
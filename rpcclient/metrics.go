@@ -0,0 +1,47 @@
+package rpcclient
+
+import (
+	"time"
+
+	"github.com/kbuzsaki/cupid/server"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cupid",
+		Name:      "rpc_requests_total",
+		Help:      "RPCs handled, by method and result.",
+	}, []string{"method", "result"})
+
+	rpcSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cupid",
+		Name:      "rpc_duration_seconds",
+		Help:      "How long RPCs took to handle, by method.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"method"})
+)
+
+func init() {
+	prometheus.MustRegister(rpcRequests, rpcSeconds)
+}
+
+// rpcResult classifies the error an rpc returned. redirects are counted apart from other errors since followers
+// return them for every call from a client that doesn't know the leader yet.
+func rpcResult(err error) string {
+	switch err.(type) {
+	case nil:
+		return "ok"
+	case server.LeaderRedirectError:
+		return "redirect"
+	}
+	if err == server.ErrNoLeader {
+		return "no_leader"
+	}
+	return "error"
+}
+
+func observeRPC(method string, start time.Time, err *error) {
+	rpcRequests.WithLabelValues(method, rpcResult(*err)).Inc()
+	rpcSeconds.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
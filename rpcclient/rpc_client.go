@@ -66,23 +66,23 @@ func (cl *client) KeepAlive(args *KeepAliveArgs, events *[]server.Event) error {
 	return conn.Call("Cupid.KeepAlive", args, events)
 }
 
-func (cl *client) OpenSession(_ int, sd *server.SessionDescriptor) error {
+func (cl *client) OpenSession(id server.RequestID, sd *server.SessionDescriptor) error {
 	conn, err := cl.getConn()
 	if err != nil {
 		return err
 	}
 
-	return conn.Call("Cupid.OpenSession", 0, sd)
+	return conn.Call("Cupid.OpenSession", id, sd)
 }
 
-func (cl *client) CloseSession(sd *server.SessionDescriptor, _ *int) error {
+func (cl *client) CloseSession(args *CloseSessionArgs, _ *int) error {
 	conn, err := cl.getConn()
 	if err != nil {
 		return err
 	}
 
 	i := 0
-	return conn.Call("Cupid.CloseSession", sd, &i)
+	return conn.Call("Cupid.CloseSession", args, &i)
 }
 
 func (cl *client) Open(args *OpenArgs, nd *server.NodeDescriptor) error {
@@ -94,14 +94,32 @@ func (cl *client) Open(args *OpenArgs, nd *server.NodeDescriptor) error {
 	return conn.Call("Cupid.Open", args, nd)
 }
 
-func (cl *client) CloseNode(nd *server.NodeDescriptor, _ *int) error {
+func (cl *client) CloseNode(args *NodeRequestArgs, _ *int) error {
 	conn, err := cl.getConn()
 	if err != nil {
 		return err
 	}
 
 	i := 0
-	return conn.Call("Cupid.CloseNode", nd, &i)
+	return conn.Call("Cupid.CloseNode", args, &i)
+}
+
+func (cl *client) Delete(args *NodeRequestArgs, _ *int) error {
+	conn, err := cl.getConn()
+	if err != nil {
+		return err
+	}
+
+	return conn.Call("Cupid.Delete", args, nil)
+}
+
+func (cl *client) List(args *ListArgs, entries *[]server.DirEntry) error {
+	conn, err := cl.getConn()
+	if err != nil {
+		return err
+	}
+
+	return conn.Call("Cupid.List", args, entries)
 }
 
 func (cl *client) Acquire(node server.NodeDescriptor, _ *int) error {
@@ -113,22 +131,85 @@ func (cl *client) Acquire(node server.NodeDescriptor, _ *int) error {
 	return conn.Call("Cupid.Acquire", node, nil)
 }
 
-func (cl *client) TryAcquire(node server.NodeDescriptor, success *bool) error {
+func (cl *client) AcquireTimeout(args *AcquireTimeoutArgs, _ *int) error {
+	conn, err := cl.getConn()
+	if err != nil {
+		return err
+	}
+
+	return conn.Call("Cupid.AcquireTimeout", args, nil)
+}
+
+func (cl *client) CancelAcquire(node server.NodeDescriptor, _ *int) error {
+	conn, err := cl.getConn()
+	if err != nil {
+		return err
+	}
+
+	return conn.Call("Cupid.CancelAcquire", node, nil)
+}
+
+func (cl *client) TryAcquire(args *NodeRequestArgs, success *bool) error {
+	conn, err := cl.getConn()
+	if err != nil {
+		return err
+	}
+
+	return conn.Call("Cupid.TryAcquire", args, success)
+}
+
+func (cl *client) AcquireShared(node server.NodeDescriptor, _ *int) error {
 	conn, err := cl.getConn()
 	if err != nil {
 		return err
 	}
 
-	return conn.Call("Cupid.TryAcquire", node, success)
+	return conn.Call("Cupid.AcquireShared", node, nil)
 }
 
-func (cl *client) Release(node server.NodeDescriptor, _ *int) error {
+func (cl *client) TryAcquireShared(args *NodeRequestArgs, success *bool) error {
 	conn, err := cl.getConn()
 	if err != nil {
 		return err
 	}
 
-	return conn.Call("Cupid.Release", node, nil)
+	return conn.Call("Cupid.TryAcquireShared", args, success)
+}
+
+func (cl *client) Release(args *NodeRequestArgs, _ *int) error {
+	conn, err := cl.getConn()
+	if err != nil {
+		return err
+	}
+
+	return conn.Call("Cupid.Release", args, nil)
+}
+
+func (cl *client) SetLockDelay(args *SetLockDelayArgs, _ *int) error {
+	conn, err := cl.getConn()
+	if err != nil {
+		return err
+	}
+
+	return conn.Call("Cupid.SetLockDelay", args, nil)
+}
+
+func (cl *client) GetSequencer(node server.NodeDescriptor, seq *server.Sequencer) error {
+	conn, err := cl.getConn()
+	if err != nil {
+		return err
+	}
+
+	return conn.Call("Cupid.GetSequencer", node, seq)
+}
+
+func (cl *client) CheckSequencer(seq server.Sequencer, valid *bool) error {
+	conn, err := cl.getConn()
+	if err != nil {
+		return err
+	}
+
+	return conn.Call("Cupid.CheckSequencer", seq, valid)
 }
 
 func (cl *client) GetContentAndStat(node server.NodeDescriptor, cas *server.NodeContentAndStat) error {
@@ -140,6 +221,15 @@ func (cl *client) GetContentAndStat(node server.NodeDescriptor, cas *server.Node
 	return conn.Call("Cupid.GetContentAndStat", node, cas)
 }
 
+func (cl *client) GetContentAndStatFollower(node server.NodeDescriptor, cas *server.NodeContentAndStat) error {
+	conn, err := cl.getConn()
+	if err != nil {
+		return err
+	}
+
+	return conn.Call("Cupid.GetContentAndStatFollower", node, cas)
+}
+
 func (cl *client) SetContent(args *SetContentArgs, success *bool) error {
 	conn, err := cl.getConn()
 	if err != nil {
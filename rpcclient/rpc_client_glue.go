@@ -4,14 +4,19 @@ import (
 	"time"
 
 	"github.com/kbuzsaki/cupid/server"
+	"golang.org/x/net/context"
 )
 
+// cancelAcquireInterval is how often AcquireContext repeats its cancel until the server gives up the wait
+const cancelAcquireInterval = 50 * time.Millisecond
+
 type clientGlue struct {
+	addr     string
 	delegate RPCServer
 }
 
 func New(addr string, keepAliveDelay time.Duration) server.Server {
-	return &clientGlue{NewClient(addr, keepAliveDelay)}
+	return &clientGlue{addr, NewClient(addr, keepAliveDelay)}
 }
 
 func (cg *clientGlue) KeepAlive(li server.LeaseInfo, eventsInfo []server.EventInfo, keepAliveDelay time.Duration) ([]server.Event, error) {
@@ -27,9 +32,9 @@ func (cg *clientGlue) KeepAlive(li server.LeaseInfo, eventsInfo []server.EventIn
 	return events, nil
 }
 
-func (cg *clientGlue) OpenSession() (server.SessionDescriptor, error) {
+func (cg *clientGlue) OpenSession(id server.RequestID) (server.SessionDescriptor, error) {
 	sd := server.SessionDescriptor{}
-	err := cg.delegate.OpenSession(0, &sd)
+	err := cg.delegate.OpenSession(id, &sd)
 	if err != nil {
 		return server.SessionDescriptor{}, err
 	}
@@ -37,12 +42,13 @@ func (cg *clientGlue) OpenSession() (server.SessionDescriptor, error) {
 	return sd, nil
 }
 
-func (cg *clientGlue) CloseSession(sd server.SessionDescriptor) error {
-	return cg.delegate.CloseSession(&sd, nil)
+func (cg *clientGlue) CloseSession(id server.RequestID, sd server.SessionDescriptor) error {
+	args := CloseSessionArgs{id, sd}
+	return cg.delegate.CloseSession(&args, nil)
 }
 
-func (cg *clientGlue) Open(sd server.SessionDescriptor, path string, readOnly bool, config server.EventsConfig) (server.NodeDescriptor, error) {
-	args := OpenArgs{sd, path, readOnly, config}
+func (cg *clientGlue) Open(id server.RequestID, sd server.SessionDescriptor, path string, readOnly bool, ephemeral bool, config server.EventsConfig) (server.NodeDescriptor, error) {
+	args := OpenArgs{id, sd, path, readOnly, ephemeral, config}
 	nd := server.NodeDescriptor{}
 	err := cg.delegate.Open(&args, &nd)
 	if err != nil {
@@ -52,22 +58,125 @@ func (cg *clientGlue) Open(sd server.SessionDescriptor, path string, readOnly bo
 	return nd, nil
 }
 
-func (cg *clientGlue) CloseNode(nd server.NodeDescriptor) error {
-	return cg.delegate.CloseNode(&nd, nil)
+func (cg *clientGlue) CloseNode(id server.RequestID, nd server.NodeDescriptor) error {
+	args := NodeRequestArgs{id, nd}
+	return cg.delegate.CloseNode(&args, nil)
+}
+
+func (cg *clientGlue) Delete(id server.RequestID, node server.NodeDescriptor) error {
+	args := NodeRequestArgs{id, node}
+	return cg.delegate.Delete(&args, nil)
+}
+
+func (cg *clientGlue) List(sd server.SessionDescriptor, dir string) ([]server.DirEntry, error) {
+	args := ListArgs{sd, dir}
+	entries := []server.DirEntry{}
+	err := cg.delegate.List(&args, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
 }
 
 func (cg *clientGlue) Acquire(node server.NodeDescriptor) error {
 	return cg.delegate.Acquire(node, nil)
 }
 
-func (cg *clientGlue) TryAcquire(node server.NodeDescriptor) (bool, error) {
+// AcquireContext passes the context's deadline along to the server so that it gives up on its own, and
+// tells the server to withdraw the wait if the context is cancelled before then.
+func (cg *clientGlue) AcquireContext(ctx context.Context, node server.NodeDescriptor) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	args := AcquireTimeoutArgs{Node: node}
+	if deadline, ok := ctx.Deadline(); ok {
+		args.Timeout = deadline.Sub(time.Now())
+		if args.Timeout <= 0 {
+			return context.DeadlineExceeded
+		}
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- cg.delegate.AcquireTimeout(&args, nil)
+	}()
+
+	select {
+	case err := <-errC:
+		// the server's deadline can fire a little before ours does
+		if err != nil && err.Error() == context.DeadlineExceeded.Error() {
+			return context.DeadlineExceeded
+		}
+		return err
+	case <-ctx.Done():
+		// the cancel can overtake the wait on the way to the server and find nothing to withdraw, so keep
+		// sending it until the wait returns
+		ticker := time.NewTicker(cancelAcquireInterval)
+		defer ticker.Stop()
+
+		var err error
+		for waiting := true; waiting; {
+			cg.delegate.CancelAcquire(node, nil)
+			select {
+			case err = <-errC:
+				waiting = false
+			case <-ticker.C:
+			}
+		}
+
+		// the lock may have been granted before the cancel arrived, in which case give it back
+		if err == nil {
+			args := NodeRequestArgs{server.NewRequestID(), node}
+			cg.delegate.Release(&args, nil)
+		}
+		return ctx.Err()
+	}
+}
+
+func (cg *clientGlue) CancelAcquire(node server.NodeDescriptor) error {
+	return cg.delegate.CancelAcquire(node, nil)
+}
+
+func (cg *clientGlue) TryAcquire(id server.RequestID, node server.NodeDescriptor) (bool, error) {
+	args := NodeRequestArgs{id, node}
 	ok := false
-	err := cg.delegate.TryAcquire(node, &ok)
+	err := cg.delegate.TryAcquire(&args, &ok)
 	return ok, err
 }
 
-func (cg *clientGlue) Release(node server.NodeDescriptor) error {
-	return cg.delegate.Release(node, nil)
+func (cg *clientGlue) AcquireShared(node server.NodeDescriptor) error {
+	return cg.delegate.AcquireShared(node, nil)
+}
+
+func (cg *clientGlue) TryAcquireShared(id server.RequestID, node server.NodeDescriptor) (bool, error) {
+	args := NodeRequestArgs{id, node}
+	ok := false
+	err := cg.delegate.TryAcquireShared(&args, &ok)
+	return ok, err
+}
+
+func (cg *clientGlue) Release(id server.RequestID, node server.NodeDescriptor) error {
+	args := NodeRequestArgs{id, node}
+	return cg.delegate.Release(&args, nil)
+}
+
+func (cg *clientGlue) SetLockDelay(id server.RequestID, node server.NodeDescriptor, delay time.Duration) error {
+	args := SetLockDelayArgs{id, node, delay}
+	return cg.delegate.SetLockDelay(&args, nil)
+}
+
+func (cg *clientGlue) GetSequencer(node server.NodeDescriptor) (server.Sequencer, error) {
+	seq := server.Sequencer{}
+	err := cg.delegate.GetSequencer(node, &seq)
+	return seq, err
+}
+
+func (cg *clientGlue) CheckSequencer(seq server.Sequencer) (bool, error) {
+	ok := false
+	err := cg.delegate.CheckSequencer(seq, &ok)
+	return ok, err
 }
 
 func (cg *clientGlue) GetContentAndStat(node server.NodeDescriptor) (server.NodeContentAndStat, error) {
@@ -76,8 +185,14 @@ func (cg *clientGlue) GetContentAndStat(node server.NodeDescriptor) (server.Node
 	return cas, err
 }
 
-func (cg *clientGlue) SetContent(node server.NodeDescriptor, content string, generation uint64) (bool, error) {
-	setContentArgs := SetContentArgs{node, content, generation}
+func (cg *clientGlue) GetContentAndStatFollower(node server.NodeDescriptor) (server.NodeContentAndStat, error) {
+	cas := server.NodeContentAndStat{}
+	err := cg.delegate.GetContentAndStatFollower(node, &cas)
+	return cas, err
+}
+
+func (cg *clientGlue) SetContent(id server.RequestID, node server.NodeDescriptor, content string, generation uint64) (bool, error) {
+	setContentArgs := SetContentArgs{id, node, content, generation}
 	ok := false
 	err := cg.delegate.SetContent(&setContentArgs, &ok)
 	return ok, err
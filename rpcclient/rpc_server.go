@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/kbuzsaki/cupid/server"
+	"golang.org/x/net/context"
 )
 
 type RPCServer interface {
@@ -11,16 +12,26 @@ type RPCServer interface {
 
 	KeepAlive(args *KeepAliveArgs, events *[]server.Event) error
 
-	OpenSession(_ int, sd *server.SessionDescriptor) error
-	CloseSession(sd *server.SessionDescriptor, _ *int) error
+	OpenSession(id server.RequestID, sd *server.SessionDescriptor) error
+	CloseSession(args *CloseSessionArgs, _ *int) error
 	Open(args *OpenArgs, nd *server.NodeDescriptor) error
-	CloseNode(nd *server.NodeDescriptor, _ *int) error
+	CloseNode(args *NodeRequestArgs, _ *int) error
+	Delete(args *NodeRequestArgs, _ *int) error
+	List(args *ListArgs, entries *[]server.DirEntry) error
 
 	Acquire(node server.NodeDescriptor, _ *int) error
-	TryAcquire(node server.NodeDescriptor, success *bool) error
-	Release(node server.NodeDescriptor, _ *int) error
+	AcquireTimeout(args *AcquireTimeoutArgs, _ *int) error
+	CancelAcquire(node server.NodeDescriptor, _ *int) error
+	TryAcquire(args *NodeRequestArgs, success *bool) error
+	AcquireShared(node server.NodeDescriptor, _ *int) error
+	TryAcquireShared(args *NodeRequestArgs, success *bool) error
+	Release(args *NodeRequestArgs, _ *int) error
+	GetSequencer(node server.NodeDescriptor, seq *server.Sequencer) error
+	SetLockDelay(args *SetLockDelayArgs, _ *int) error
+	CheckSequencer(seq server.Sequencer, valid *bool) error
 
 	GetContentAndStat(node server.NodeDescriptor, cas *server.NodeContentAndStat) error
+	GetContentAndStatFollower(node server.NodeDescriptor, cas *server.NodeContentAndStat) error
 	SetContent(args *SetContentArgs, success *bool) error
 
 	Nop(numOps uint64, garbage *bool) error
@@ -32,14 +43,45 @@ type KeepAliveArgs struct {
 	KeepAliveDelay time.Duration
 }
 
+type CloseSessionArgs struct {
+	RequestID server.RequestID
+	SD        server.SessionDescriptor
+}
+
 type OpenArgs struct {
+	RequestID    server.RequestID
 	SD           server.SessionDescriptor
 	Path         string
 	ReadOnly     bool
+	Ephemeral    bool
 	EventsConfig server.EventsConfig
 }
 
+// NodeRequestArgs are the arguments of the calls that change the state through just a node descriptor
+type NodeRequestArgs struct {
+	RequestID server.RequestID
+	Node      server.NodeDescriptor
+}
+
+type ListArgs struct {
+	SD  server.SessionDescriptor
+	Dir string
+}
+
+// Timeout is how long the server should wait for the lock before giving up, zero means forever
+type AcquireTimeoutArgs struct {
+	Node    server.NodeDescriptor
+	Timeout time.Duration
+}
+
+type SetLockDelayArgs struct {
+	RequestID server.RequestID
+	Node      server.NodeDescriptor
+	Delay     time.Duration
+}
+
 type SetContentArgs struct {
+	RequestID  server.RequestID
 	SNode      server.NodeDescriptor
 	Content    string
 	Generation uint64
@@ -53,11 +95,15 @@ func NewServer(delegate server.Server) RPCServer {
 	return &rpcServer{delegate}
 }
 
-func (rs *rpcServer) Ping(_, _ *int) error {
+func (rs *rpcServer) Ping(_, _ *int) (err error) {
+	defer observeRPC("Ping", time.Now(), &err)
+
 	return nil
 }
 
-func (rs *rpcServer) KeepAlive(args *KeepAliveArgs, events *[]server.Event) error {
+func (rs *rpcServer) KeepAlive(args *KeepAliveArgs, events *[]server.Event) (err error) {
+	defer observeRPC("KeepAlive", time.Now(), &err)
+
 	tmp_events, err := rs.delegate.KeepAlive(args.LeaseInfo, args.EventsInfo, args.KeepAliveDelay)
 	if err != nil {
 		return err
@@ -67,8 +113,10 @@ func (rs *rpcServer) KeepAlive(args *KeepAliveArgs, events *[]server.Event) erro
 	return nil
 }
 
-func (rs *rpcServer) OpenSession(_ int, sd *server.SessionDescriptor) error {
-	descriptor, err := rs.delegate.OpenSession()
+func (rs *rpcServer) OpenSession(id server.RequestID, sd *server.SessionDescriptor) (err error) {
+	defer observeRPC("OpenSession", time.Now(), &err)
+
+	descriptor, err := rs.delegate.OpenSession(id)
 	if err != nil {
 		return err
 	}
@@ -77,12 +125,16 @@ func (rs *rpcServer) OpenSession(_ int, sd *server.SessionDescriptor) error {
 	return nil
 }
 
-func (rs *rpcServer) CloseSession(sd *server.SessionDescriptor, _ *int) error {
-	return rs.delegate.CloseSession(*sd)
+func (rs *rpcServer) CloseSession(args *CloseSessionArgs, _ *int) (err error) {
+	defer observeRPC("CloseSession", time.Now(), &err)
+
+	return rs.delegate.CloseSession(args.RequestID, args.SD)
 }
 
-func (rs *rpcServer) Open(args *OpenArgs, nd *server.NodeDescriptor) error {
-	descriptor, err := rs.delegate.Open(args.SD, args.Path, args.ReadOnly, args.EventsConfig)
+func (rs *rpcServer) Open(args *OpenArgs, nd *server.NodeDescriptor) (err error) {
+	defer observeRPC("Open", time.Now(), &err)
+
+	descriptor, err := rs.delegate.Open(args.RequestID, args.SD, args.Path, args.ReadOnly, args.Ephemeral, args.EventsConfig)
 	if err != nil {
 		return err
 	}
@@ -91,16 +143,78 @@ func (rs *rpcServer) Open(args *OpenArgs, nd *server.NodeDescriptor) error {
 	return nil
 }
 
-func (rs *rpcServer) CloseNode(nd *server.NodeDescriptor, _ *int) error {
-	return rs.delegate.CloseNode(*nd)
+func (rs *rpcServer) CloseNode(args *NodeRequestArgs, _ *int) (err error) {
+	defer observeRPC("CloseNode", time.Now(), &err)
+
+	return rs.delegate.CloseNode(args.RequestID, args.Node)
+}
+
+func (rs *rpcServer) Delete(args *NodeRequestArgs, _ *int) (err error) {
+	defer observeRPC("Delete", time.Now(), &err)
+
+	return rs.delegate.Delete(args.RequestID, args.Node)
 }
 
-func (rs *rpcServer) Acquire(snd server.NodeDescriptor, _ *int) error {
+func (rs *rpcServer) List(args *ListArgs, entries *[]server.DirEntry) (err error) {
+	defer observeRPC("List", time.Now(), &err)
+
+	tmp_entries, err := rs.delegate.List(args.SD, args.Dir)
+	if err != nil {
+		return err
+	}
+
+	*entries = tmp_entries
+	return nil
+}
+
+func (rs *rpcServer) Acquire(snd server.NodeDescriptor, _ *int) (err error) {
+	defer observeRPC("Acquire", time.Now(), &err)
+
 	return rs.delegate.Acquire(snd)
 }
 
-func (rs *rpcServer) TryAcquire(snd server.NodeDescriptor, success *bool) error {
-	succ, err := rs.delegate.TryAcquire(snd)
+func (rs *rpcServer) AcquireTimeout(args *AcquireTimeoutArgs, _ *int) (err error) {
+	defer observeRPC("AcquireTimeout", time.Now(), &err)
+
+	ctx := context.Background()
+	if args.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, args.Timeout)
+		defer cancel()
+	}
+
+	return rs.delegate.AcquireContext(ctx, args.Node)
+}
+
+func (rs *rpcServer) CancelAcquire(snd server.NodeDescriptor, _ *int) (err error) {
+	defer observeRPC("CancelAcquire", time.Now(), &err)
+
+	return rs.delegate.CancelAcquire(snd)
+}
+
+func (rs *rpcServer) TryAcquire(args *NodeRequestArgs, success *bool) (err error) {
+	defer observeRPC("TryAcquire", time.Now(), &err)
+
+	succ, err := rs.delegate.TryAcquire(args.RequestID, args.Node)
+	if err != nil {
+		*success = false
+		return err
+	}
+
+	*success = succ
+	return nil
+}
+
+func (rs *rpcServer) AcquireShared(snd server.NodeDescriptor, _ *int) (err error) {
+	defer observeRPC("AcquireShared", time.Now(), &err)
+
+	return rs.delegate.AcquireShared(snd)
+}
+
+func (rs *rpcServer) TryAcquireShared(args *NodeRequestArgs, success *bool) (err error) {
+	defer observeRPC("TryAcquireShared", time.Now(), &err)
+
+	succ, err := rs.delegate.TryAcquireShared(args.RequestID, args.Node)
 	if err != nil {
 		*success = false
 		return err
@@ -110,11 +224,46 @@ func (rs *rpcServer) TryAcquire(snd server.NodeDescriptor, success *bool) error
 	return nil
 }
 
-func (rs *rpcServer) Release(snd server.NodeDescriptor, _ *int) error {
-	return rs.delegate.Release(snd)
+func (rs *rpcServer) Release(args *NodeRequestArgs, _ *int) (err error) {
+	defer observeRPC("Release", time.Now(), &err)
+
+	return rs.delegate.Release(args.RequestID, args.Node)
+}
+
+func (rs *rpcServer) SetLockDelay(args *SetLockDelayArgs, _ *int) (err error) {
+	defer observeRPC("SetLockDelay", time.Now(), &err)
+
+	return rs.delegate.SetLockDelay(args.RequestID, args.Node, args.Delay)
+}
+
+func (rs *rpcServer) GetSequencer(snd server.NodeDescriptor, seq *server.Sequencer) (err error) {
+	defer observeRPC("GetSequencer", time.Now(), &err)
+
+	tmp_seq, err := rs.delegate.GetSequencer(snd)
+	if err != nil {
+		return err
+	}
+
+	*seq = tmp_seq
+	return nil
 }
 
-func (rs *rpcServer) GetContentAndStat(snd server.NodeDescriptor, cas *server.NodeContentAndStat) error {
+func (rs *rpcServer) CheckSequencer(seq server.Sequencer, valid *bool) (err error) {
+	defer observeRPC("CheckSequencer", time.Now(), &err)
+
+	ok, err := rs.delegate.CheckSequencer(seq)
+	if err != nil {
+		*valid = false
+		return err
+	}
+
+	*valid = ok
+	return nil
+}
+
+func (rs *rpcServer) GetContentAndStat(snd server.NodeDescriptor, cas *server.NodeContentAndStat) (err error) {
+	defer observeRPC("GetContentAndStat", time.Now(), &err)
+
 	nodeCas, err := rs.delegate.GetContentAndStat(snd)
 	if err != nil {
 		return err
@@ -124,8 +273,22 @@ func (rs *rpcServer) GetContentAndStat(snd server.NodeDescriptor, cas *server.No
 	return nil
 }
 
-func (rs *rpcServer) SetContent(args *SetContentArgs, success *bool) error {
-	succ, err := rs.delegate.SetContent(args.SNode, args.Content, args.Generation)
+func (rs *rpcServer) GetContentAndStatFollower(snd server.NodeDescriptor, cas *server.NodeContentAndStat) (err error) {
+	defer observeRPC("GetContentAndStatFollower", time.Now(), &err)
+
+	nodeCas, err := rs.delegate.GetContentAndStatFollower(snd)
+	if err != nil {
+		return err
+	}
+
+	*cas = nodeCas
+	return nil
+}
+
+func (rs *rpcServer) SetContent(args *SetContentArgs, success *bool) (err error) {
+	defer observeRPC("SetContent", time.Now(), &err)
+
+	succ, err := rs.delegate.SetContent(args.RequestID, args.SNode, args.Content, args.Generation)
 	if err != nil {
 		*success = false
 		return err
@@ -135,6 +298,8 @@ func (rs *rpcServer) SetContent(args *SetContentArgs, success *bool) error {
 	return nil
 }
 
-func (rs *rpcServer) Nop(numOps uint64, garbage *bool) error {
+func (rs *rpcServer) Nop(numOps uint64, garbage *bool) (err error) {
+	defer observeRPC("Nop", time.Now(), &err)
+
 	return rs.delegate.Nop(numOps)
 }
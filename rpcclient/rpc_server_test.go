@@ -1,9 +1,12 @@
 package rpcclient
 
 import (
+	"io"
 	"math/rand"
+	"net"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/kbuzsaki/cupid/server"
 )
@@ -24,6 +27,7 @@ func TestRPC_KeepAlive(t *testing.T) {
 
 	s, err := server.NewFrontend()
 	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
 	addr := randaddr()
 
 	ready := make(chan bool)
@@ -47,6 +51,7 @@ func TestRPC_OpenGetSet(t *testing.T) {
 
 	s, err := server.NewFrontend()
 	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
 	addr := randaddr()
 
 	ready := make(chan bool)
@@ -70,6 +75,7 @@ func TestRPC_OpenReadOnly(t *testing.T) {
 
 	s, err := server.NewFrontend()
 	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
 	addr := randaddr()
 
 	ready := make(chan bool)
@@ -93,6 +99,7 @@ func TestRPC_SetContentGeneration(t *testing.T) {
 
 	s, err := server.NewFrontend()
 	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
 	addr := randaddr()
 
 	ready := make(chan bool)
@@ -116,6 +123,7 @@ func TestRPC_ConcurrentOpen(t *testing.T) {
 
 	s, err := server.NewFrontend()
 	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
 	addr := randaddr()
 
 	ready := make(chan bool)
@@ -139,6 +147,7 @@ func TestRPC_TryAcquire(t *testing.T) {
 
 	s, err := server.NewFrontend()
 	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
 	addr := randaddr()
 
 	ready := make(chan bool)
@@ -162,6 +171,7 @@ func TestRPC_BadRelease(t *testing.T) {
 
 	s, err := server.NewFrontend()
 	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
 	addr := randaddr()
 
 	ready := make(chan bool)
@@ -175,3 +185,333 @@ func TestRPC_BadRelease(t *testing.T) {
 
 	server.DoServerTest_BadRelease(t, cl)
 }
+
+func TestRPC_Delete(t *testing.T) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	s, err := server.NewFrontend()
+	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
+	addr := randaddr()
+
+	ready := make(chan bool)
+	go ServeCupidRPC(s, addr, ready)
+	v := <-ready
+	if !v {
+		t.Fatal("Could not launch rpc server")
+	}
+
+	cl := New(addr, 1)
+
+	server.DoServerTest_Delete(t, cl)
+}
+
+func TestRPC_List(t *testing.T) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	s, err := server.NewFrontend()
+	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
+	addr := randaddr()
+
+	ready := make(chan bool)
+	go ServeCupidRPC(s, addr, ready)
+	v := <-ready
+	if !v {
+		t.Fatal("Could not launch rpc server")
+	}
+
+	cl := New(addr, 1)
+
+	server.DoServerTest_List(t, cl)
+}
+
+func TestRPC_Ephemeral(t *testing.T) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	s, err := server.NewFrontend()
+	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
+	addr := randaddr()
+
+	ready := make(chan bool)
+	go ServeCupidRPC(s, addr, ready)
+	v := <-ready
+	if !v {
+		t.Fatal("Could not launch rpc server")
+	}
+
+	cl := New(addr, 1)
+
+	server.DoServerTest_Ephemeral(t, cl)
+}
+
+func TestRPC_AcquireFIFO(t *testing.T) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	s, err := server.NewFrontend()
+	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
+	addr := randaddr()
+
+	ready := make(chan bool)
+	go ServeCupidRPC(s, addr, ready)
+	v := <-ready
+	if !v {
+		t.Fatal("Could not launch rpc server")
+	}
+
+	cl := New(addr, 1)
+
+	server.DoServerTest_AcquireFIFO(t, cl)
+}
+
+func TestRPC_AcquireContext(t *testing.T) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	s, err := server.NewFrontend()
+	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
+	addr := randaddr()
+
+	ready := make(chan bool)
+	go ServeCupidRPC(s, addr, ready)
+	v := <-ready
+	if !v {
+		t.Fatal("Could not launch rpc server")
+	}
+
+	cl := New(addr, 1)
+
+	server.DoServerTest_AcquireContext(t, cl)
+}
+
+func TestRPC_Sequencer(t *testing.T) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	s, err := server.NewFrontend()
+	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
+	addr := randaddr()
+
+	ready := make(chan bool)
+	go ServeCupidRPC(s, addr, ready)
+	v := <-ready
+	if !v {
+		t.Fatal("Could not launch rpc server")
+	}
+
+	cl := New(addr, 1)
+
+	server.DoServerTest_Sequencer(t, cl)
+}
+
+func TestRPC_SharedLocks(t *testing.T) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	s, err := server.NewFrontend()
+	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
+	addr := randaddr()
+
+	ready := make(chan bool)
+	go ServeCupidRPC(s, addr, ready)
+	v := <-ready
+	if !v {
+		t.Fatal("Could not launch rpc server")
+	}
+
+	cl := New(addr, 1)
+
+	server.DoServerTest_SharedLocks(t, cl)
+}
+
+func TestRPC_SetLockDelay(t *testing.T) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	s, err := server.NewFrontend()
+	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
+	addr := randaddr()
+
+	ready := make(chan bool)
+	go ServeCupidRPC(s, addr, ready)
+	v := <-ready
+	if !v {
+		t.Fatal("Could not launch rpc server")
+	}
+
+	cl := New(addr, 1)
+
+	server.DoServerTest_SetLockDelay(t, cl)
+}
+
+func TestRPC_GetContentAndStatFollower(t *testing.T) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	s, err := server.NewFrontend()
+	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
+	addr := randaddr()
+
+	ready := make(chan bool)
+	go ServeCupidRPC(s, addr, ready)
+	v := <-ready
+	if !v {
+		t.Fatal("Could not launch rpc server")
+	}
+
+	cl := New(addr, 1)
+
+	server.DoServerTest_GetContentAndStatFollower(t, cl)
+}
+
+func TestRPC_RetriedRequests(t *testing.T) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	s, err := server.NewFrontend()
+	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
+	addr := randaddr()
+
+	ready := make(chan bool)
+	go ServeCupidRPC(s, addr, ready)
+	v := <-ready
+	if !v {
+		t.Fatal("Could not launch rpc server")
+	}
+
+	cl := New(addr, 1)
+
+	server.DoServerTest_RetriedRequests(t, cl)
+}
+
+func TestRPC_EventStream(t *testing.T) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	s, err := server.NewFrontend()
+	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
+	addr := randaddr()
+
+	ready := make(chan bool)
+	go ServeCupidRPC(s, addr, ready)
+	v := <-ready
+	if !v {
+		t.Fatal("Could not launch rpc server")
+	}
+
+	cl := New(addr, 1)
+
+	server.DoServerTest_EventStream(t, cl)
+}
+
+func TestRPC_EventStreamRedelivery(t *testing.T) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	s, err := server.NewFrontend()
+	ne("Could not instantiate server", err)
+	defer s.(io.Closer).Close()
+	addr := randaddr()
+
+	ready := make(chan bool)
+	go ServeCupidRPC(s, addr, ready)
+	v := <-ready
+	if !v {
+		t.Fatal("Could not launch rpc server")
+	}
+
+	cl := New(addr, 1)
+
+	server.DoServerTest_EventStreamRedelivery(t, cl)
+}
+
+func TestRPC_Shutdown(t *testing.T) {
+	s, err := server.NewFrontend()
+	if err != nil {
+		t.Fatal("Could not instantiate server", err)
+	}
+	defer s.(io.Closer).Close()
+	addr := randaddr()
+
+	listener, err := ListenCupidRPC(s, addr)
+	if err != nil {
+		t.Fatal("Could not launch rpc server", err)
+	}
+	go listener.Serve()
+
+	cl := New(addr, 1)
+	sd, err := cl.OpenSession(server.NewRequestID())
+	if err != nil {
+		t.Fatal("Error opening session:", err)
+	}
+
+	// a call that is already in progress gets to finish
+	done := make(chan error, 1)
+	go func() {
+		_, err := cl.KeepAlive(server.LeaseInfo{Session: sd}, nil, 200*time.Millisecond)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	listener.Shutdown(5 * time.Second)
+	if err := <-done; err != nil {
+		t.Error("KeepAlive in progress failed during shutdown:", err)
+	}
+
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("Connected after shutdown")
+	}
+	if _, err := cl.OpenSession(server.NewRequestID()); err == nil {
+		t.Error("Opened session after shutdown")
+	}
+}
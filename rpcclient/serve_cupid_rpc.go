@@ -1,36 +1,54 @@
 package rpcclient
 
 import (
+	"bufio"
 	"log"
 	"net"
 	"net/rpc"
+	"sync"
+	"time"
 
 	"github.com/kbuzsaki/cupid/server"
 )
 
-func ServeCupidRPC(s server.Server, addr string, ready chan bool) {
+// CupidRPCListener serves cupid rpc to the connections accepted on its address until it is shut down
+type CupidRPCListener struct {
+	s         server.Server
+	rpcServer *rpc.Server
+	listener  net.Listener
+
+	lock   sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	served sync.WaitGroup
+}
+
+func ListenCupidRPC(s server.Server, addr string) (*CupidRPCListener, error) {
 	rpcServer := rpc.NewServer()
 	cupidRPC := NewServer(s)
-	err := rpcServer.RegisterName("Cupid", cupidRPC)
-
-	if err != nil {
-		log.Println("Cannot register cupid rpc:", err)
-		return
+	if err := rpcServer.RegisterName("Cupid", cupidRPC); err != nil {
+		return nil, err
 	}
 
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Println("RPC server cannot listen:", err)
-		ready <- false
-		return
+		return nil, err
 	}
 
-	go func() { ready <- true }()
+	return &CupidRPCListener{
+		s:         s,
+		rpcServer: rpcServer,
+		listener:  listener,
+		conns:     make(map[net.Conn]struct{}),
+	}, nil
+}
 
-	log.Println("cupid rpc listening on:", addr)
+// Serve accepts connections until the listener is shut down
+func (cl *CupidRPCListener) Serve() {
+	log.Println("cupid rpc listening on:", cl.listener.Addr())
 
 	for {
-		conn, err := listener.Accept()
+		conn, err := cl.listener.Accept()
 		if err != nil {
 			log.Println("Cannot accept connection:", err)
 			break
@@ -38,8 +56,108 @@ func ServeCupidRPC(s server.Server, addr string, ready chan bool) {
 
 		log.Println("Accepted new connection from:", conn.RemoteAddr())
 
-		go rpcServer.ServeConn(conn)
+		if !cl.track(conn) {
+			conn.Close()
+			break
+		}
+		go func() {
+			defer cl.untrack(conn)
+			cl.serveConn(conn)
+		}()
 	}
 
 	log.Println("RPC Server exited infinite loop")
 }
+
+// bufferedConn reads through the reader that peeked at the start of the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.r.Read(p)
+}
+
+// serveConn serves either rpc calls or an event stream, depending on how the connection starts
+func (cl *CupidRPCListener) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	stream, err := isEventStream(r)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if stream {
+		serveEventStream(cl.s, conn, r)
+		conn.Close()
+		return
+	}
+	cl.rpcServer.ServeConn(&bufferedConn{conn, r})
+}
+
+func (cl *CupidRPCListener) track(conn net.Conn) bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if cl.closed {
+		return false
+	}
+	cl.conns[conn] = struct{}{}
+	cl.served.Add(1)
+	return true
+}
+
+func (cl *CupidRPCListener) untrack(conn net.Conn) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	delete(cl.conns, conn)
+	cl.served.Done()
+}
+
+// Shutdown stops accepting connections and calls, and waits up to timeout for the calls in progress to finish.
+// the connections that are still busy after that, like keepalives waiting for events, are closed without waiting
+// for their calls to return.
+func (cl *CupidRPCListener) Shutdown(timeout time.Duration) {
+	cl.lock.Lock()
+	cl.closed = true
+	cl.listener.Close()
+	// a connection stops reading calls once its read deadline passes, and closes after replying to the ones it has
+	for conn := range cl.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	cl.lock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		cl.served.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return
+	case <-time.After(timeout):
+	}
+
+	cl.lock.Lock()
+	log.Println("closing", len(cl.conns), "busy rpc connections")
+	for conn := range cl.conns {
+		conn.Close()
+	}
+	cl.lock.Unlock()
+}
+
+func ServeCupidRPC(s server.Server, addr string, ready chan bool) {
+	cl, err := ListenCupidRPC(s, addr)
+	if err != nil {
+		log.Println("RPC server cannot listen:", err)
+		ready <- false
+		return
+	}
+
+	go func() { ready <- true }()
+
+	cl.Serve()
+}
@@ -6,6 +6,7 @@ type AtomicMap interface {
 	Get(k uint64) interface{}
 	Put(k uint64, v interface{})
 	Delete(k uint64)
+	Take(k uint64) interface{}
 	Keys() []uint64
 }
 
@@ -28,9 +29,17 @@ func NewAtomicMapWithDefault(def func(uint64) interface{}) AtomicMap {
 
 func (am *atomicMapImpl) Get(k uint64) interface{} {
 	am.lock.RLock()
-	defer am.lock.RUnlock()
+	v, ok := am.data[k]
+	am.lock.RUnlock()
+	if ok || am.def == nil {
+		return v
+	}
+
+	// creating the default is a write, and someone else may have created it in the meantime
+	am.lock.Lock()
+	defer am.lock.Unlock()
 
-	if _, ok := am.data[k]; !ok && am.def != nil {
+	if _, ok := am.data[k]; !ok {
 		am.data[k] = am.def(k)
 	}
 	return am.data[k]
@@ -50,6 +59,16 @@ func (am *atomicMapImpl) Delete(k uint64) {
 	delete(am.data, k)
 }
 
+// Take deletes k and returns the value it had, so that only one of several concurrent callers gets the value
+func (am *atomicMapImpl) Take(k uint64) interface{} {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	v := am.data[k]
+	delete(am.data, k)
+	return v
+}
+
 func (am *atomicMapImpl) Keys() []uint64 {
 	am.lock.RLock()
 	defer am.lock.RUnlock()
@@ -63,6 +82,7 @@ func (am *atomicMapImpl) Keys() []uint64 {
 
 type AtomicStringMap interface {
 	Get(k string) interface{}
+	Lookup(k string) (interface{}, bool)
 	Put(k string, v interface{})
 	Delete(k string)
 	Keys() []string
@@ -87,14 +107,31 @@ func NewAtomicStringMapWithDefault(def func(string) interface{}) AtomicStringMap
 
 func (am *atomicStringMapImpl) Get(k string) interface{} {
 	am.lock.RLock()
-	defer am.lock.RUnlock()
+	v, ok := am.data[k]
+	am.lock.RUnlock()
+	if ok || am.def == nil {
+		return v
+	}
+
+	// creating the default is a write, and someone else may have created it in the meantime
+	am.lock.Lock()
+	defer am.lock.Unlock()
 
-	if _, ok := am.data[k]; !ok && am.def != nil {
+	if _, ok := am.data[k]; !ok {
 		am.data[k] = am.def(k)
 	}
 	return am.data[k]
 }
 
+// Lookup returns the value for k and whether it is present, without creating a default value for it
+func (am *atomicStringMapImpl) Lookup(k string) (interface{}, bool) {
+	am.lock.RLock()
+	defer am.lock.RUnlock()
+
+	v, ok := am.data[k]
+	return v, ok
+}
+
 func (am *atomicStringMapImpl) Put(k string, v interface{}) {
 	am.lock.Lock()
 	defer am.lock.Unlock()
@@ -11,8 +11,9 @@ var (
 )
 
 type ClusterState struct {
-	IsLeader   bool
-	LeaderID   int
+	IsLeader bool
+	LeaderID int
+	// LeaderAddr is the client rpc address of the leader, or empty if it isn't known
 	LeaderAddr string
 }
 
@@ -25,6 +26,14 @@ func (cs *ClusterState) MakeRedirectError() error {
 	return LeaderRedirectError{cs.LeaderID, cs.LeaderAddr}
 }
 
+// Member is a single replica in the raft cluster
+type Member struct {
+	ID      uint64
+	PeerURL string
+	// RPCAddr is the address that clients dial to reach the member
+	RPCAddr string
+}
+
 type LeaderRedirectError struct {
 	LeaderID   int
 	LeaderAddr string
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+)
+
+// Log entries and snapshots are written as a two byte header, a zero marker byte followed by the encoding version,
+// and then the gob encoded body. A gob stream never starts with a zero byte, so data written before the header was
+// added, which is just the bare gob body, is read as the legacy version.
+//
+// gob tolerates fields being added or removed but not a field changing its type. A change like that needs a new
+// version, and the decoder for the old one has to stay around so that existing WALs and snapshots can be replayed.
+const (
+	encodingMarker byte = 0
+
+	legacyEncodingVersion  byte = 0
+	encodingVersion1       byte = 1
+	currentEncodingVersion      = encodingVersion1
+)
+
+func encodeVersioned(v interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{encodingMarker, currentEncodingVersion})
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeVersioned reads data written by encodeVersioned, or by any earlier version of it, into v
+func decodeVersioned(data []byte, v interface{}) error {
+	version := legacyEncodingVersion
+	if len(data) >= 2 && data[0] == encodingMarker {
+		version, data = data[1], data[2:]
+	}
+
+	switch version {
+	case legacyEncodingVersion, encodingVersion1:
+		// version 1 only added the header, the body is unchanged
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+	default:
+		return fmt.Errorf("unknown encoding version: %d", version)
+	}
+}
+
+func Encode(proposal Proposal) string {
+	data, err := encodeVersioned(&proposal)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return string(data)
+}
+
+// Decode reads a log entry written by Encode. An entry that can't be decoded is an error rather than being skipped,
+// since applying the rest of the log without it would leave this replica diverged from the others.
+func Decode(s string) (interface{}, error) {
+	var p Proposal
+	if err := decodeVersioned([]byte(s), &p); err != nil {
+		return nil, err
+	}
+
+	op, err := getOperation(&p)
+	if err != nil {
+		return nil, err
+	}
+	if batch, ok := op.(BatchProposal); ok {
+		for i := range batch.Proposals {
+			if _, err := getOperation(&batch.Proposals[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return op, nil
+}
+
+// getOperation is p.Get for a proposal that came off the wire, where the body may be missing for its type
+func getOperation(p *Proposal) (op interface{}, err error) {
+	defer func() {
+		if recover() != nil {
+			err = fmt.Errorf("missing body for proposal type: %d", p.Type)
+		}
+	}()
+
+	if op = p.Get(); op == nil {
+		return nil, fmt.Errorf("unknown proposal type: %d", p.Type)
+	}
+	return op, nil
+}
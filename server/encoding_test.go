@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files for the current encoding version")
+
+// encodingFixtures has one of every kind of log entry. The golden files hold these as written by each encoding
+// version, so they must not change once a version has been released.
+func encodingFixtures() map[string]Proposal {
+	sd := SessionDescriptor{Descriptor: 3}
+	nd := NodeDescriptor{Session: sd, Descriptor: 7, Path: "/foo/bar"}
+	cas := NodeContentAndStat{
+		Content: "some content",
+		Stat: NodeStat{
+			Generation:     4,
+			LastModified:   time.Date(2017, time.March, 14, 15, 9, 26, 0, time.UTC),
+			LockGeneration: 2,
+			LockDelay:      5 * time.Second,
+		},
+	}
+
+	return map[string]Proposal{
+		"openSession":        (&OpenSessionProposal{ID: 1}).Wrap(),
+		"closeSession":       (&CloseSessionProposal{ID: 2, SD: sd}).Wrap(),
+		"openNode":           (&OpenNodeProposal{ID: 3, SD: sd, Path: "/foo/bar", ReadOnly: true, Ephemeral: true, Config: EventsConfig{ContentModified: true, MasterFailed: true}}).Wrap(),
+		"closeNode":          (&CloseNodeProposal{ID: 4, ND: nd}).Wrap(),
+		"deleteNode":         (&DeleteNodeProposal{ID: 5, ND: nd}).Wrap(),
+		"tryAcquire":         (&TryAcquireProposal{ID: 6, ND: nd, Shared: true}).Wrap(),
+		"release":            (&ReleaseProposal{ID: 7, ND: nd}).Wrap(),
+		"prepareSetContent":  (&PrepareSetContentProposal{ID: 8, ND: nd, CAS: cas}).Wrap(),
+		"finalizeSetContent": (&FinalizeSetContentProposal{ID: 9, Path: "/foo/bar"}).Wrap(),
+		"nop":                (&NopProposal{ID: 10, Garbage: 42}).Wrap(),
+		"restoreSnapshot":    (&RestoreSnapshotProposal{Data: []byte("snapshot data")}).Wrap(),
+		"setLockDelay":       (&SetLockDelayProposal{ID: 11, ND: nd, Delay: time.Minute}).Wrap(),
+		"batch": (&BatchProposal{Proposals: []Proposal{
+			(&OpenSessionProposal{ID: 12}).Wrap(),
+			(&NopProposal{ID: 13, Garbage: 1}).Wrap(),
+		}}).Wrap(),
+	}
+}
+
+// encodingSnapshotFSM builds the state that is stored as the snapshot in the golden files
+func encodingSnapshotFSM(t *testing.T) (*fsmImpl, NodeDescriptor) {
+	fsm, err := NewFSM()
+	if err != nil {
+		t.Fatal("unable to create fsm:", err)
+	}
+
+	sd, _ := fsm.OpenSession(NoRequestID)
+	nd, _ := fsm.OpenNode(NoRequestID, sd, "/foo/bar", false, false, EventsConfig{LockInvalidated: true})
+	fsm.SetLocked(NoRequestID, nd)
+	fsm.PrepareSetContent(NoRequestID, nd, NodeContentAndStat{Content: "snapshot content"})
+	return fsm.(*fsmImpl), nd
+}
+
+func goldenPath(version byte) string {
+	return filepath.Join("testdata", fmt.Sprintf("encoding_v%d.json", version))
+}
+
+func readGolden(t *testing.T, version byte) map[string][]byte {
+	data, err := ioutil.ReadFile(goldenPath(version))
+	if err != nil {
+		t.Fatal("unable to read golden file:", err)
+	}
+
+	var golden map[string][]byte
+	if err := json.Unmarshal(data, &golden); err != nil {
+		t.Fatal("unable to parse golden file:", err)
+	}
+	return golden
+}
+
+func TestEncoding_RoundTrip(t *testing.T) {
+	for name, proposal := range encodingFixtures() {
+		op, err := Decode(Encode(proposal))
+		if err != nil {
+			t.Error("unable to decode", name, "proposal:", err)
+		} else if !reflect.DeepEqual(op, proposal.Get()) {
+			t.Errorf("%s proposal changed by round trip: %+v != %+v", name, op, proposal.Get())
+		}
+	}
+}
+
+func TestEncoding_Golden(t *testing.T) {
+	if *updateGolden {
+		golden := make(map[string][]byte)
+		for name, proposal := range encodingFixtures() {
+			golden[name] = []byte(Encode(proposal))
+		}
+		fsm, _ := encodingSnapshotFSM(t)
+		snapshot, err := fsm.GetSnapshot()
+		if err != nil {
+			t.Fatal("unable to get snapshot:", err)
+		}
+		golden["snapshot"] = snapshot
+
+		data, err := json.MarshalIndent(golden, "", "\t")
+		if err != nil {
+			t.Fatal("unable to encode golden file:", err)
+		}
+		if err := ioutil.WriteFile(goldenPath(currentEncodingVersion), data, 0644); err != nil {
+			t.Fatal("unable to write golden file:", err)
+		}
+	}
+
+	// every version ever written has to stay readable, since it may still be in a WAL or snapshot somewhere
+	for version := legacyEncodingVersion; version <= currentEncodingVersion; version++ {
+		golden := readGolden(t, version)
+
+		for name, proposal := range encodingFixtures() {
+			op, err := Decode(string(golden[name]))
+			if err != nil {
+				t.Errorf("unable to decode v%d %s proposal: %v", version, name, err)
+			} else if !reflect.DeepEqual(op, proposal.Get()) {
+				t.Errorf("wrong v%d %s proposal: %+v != %+v", version, name, op, proposal.Get())
+			}
+		}
+
+		restored, err := NewFSM()
+		if err != nil {
+			t.Fatal("unable to create fsm:", err)
+		}
+		if err := restored.RecoverFromSnapshot(golden["snapshot"]); err != nil {
+			t.Errorf("unable to recover from v%d snapshot: %v", version, err)
+			continue
+		}
+
+		_, nd := encodingSnapshotFSM(t)
+		nid := restored.(*fsmImpl).GetNodeDescriptor(nd)
+		if nid == nil {
+			t.Errorf("v%d snapshot descriptor not restored: %v", version, nd)
+			continue
+		}
+		if !nid.config.LockInvalidated || nid.ni.locker != nid {
+			t.Errorf("v%d snapshot descriptor state not restored", version)
+		}
+		if cas := restored.GetContentAndStat(nd); cas.Content != "snapshot content" {
+			t.Errorf("v%d snapshot content not restored: %v", version, cas)
+		}
+	}
+}
+
+func TestEncoding_DecodeErrors(t *testing.T) {
+	valid := Encode((&NopProposal{ID: 1}).Wrap())
+	unknownType := Encode(Proposal{Type: batchProposalType + 100})
+	missingBody := Encode(Proposal{Type: openSessionProposalType})
+	badBatch := Encode((&BatchProposal{Proposals: []Proposal{{Type: batchProposalType + 100}}}).Wrap())
+
+	entries := map[string]string{
+		"empty":           "",
+		"garbage":         "not a log entry",
+		"truncated":       valid[:len(valid)/2],
+		"unknown version": string([]byte{encodingMarker, currentEncodingVersion + 1}) + valid[2:],
+		"unknown type":    unknownType,
+		"missing body":    missingBody,
+		"bad batch":       badBatch,
+	}
+	for name, entry := range entries {
+		if op, err := Decode(entry); err == nil {
+			t.Errorf("decoded %s entry: %+v", name, op)
+		}
+	}
+
+	fsm, err := NewFSM()
+	if err != nil {
+		t.Fatal("unable to create fsm:", err)
+	}
+	if err := fsm.RecoverFromSnapshot([]byte{encodingMarker, currentEncodingVersion + 1}); err == nil {
+		t.Error("recovered from snapshot with unknown version")
+	}
+}
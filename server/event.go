@@ -6,6 +6,8 @@ func init() {
 	gob.Register(LockInvalidationEvent{})
 	gob.Register(ContentInvalidationEvent{})
 	gob.Register(ContentInvalidationPushEvent{})
+	gob.Register(NodeDeletedEvent{})
+	gob.Register(ResyncEvent{})
 }
 
 type EventsConfig struct {
@@ -29,3 +31,16 @@ type ContentInvalidationPushEvent struct {
 	Descriptor NodeDescriptor
 	NodeContentAndStat
 }
+
+// NodeDeletedEvent is sent to every open descriptor on a node when the node is deleted.
+// The descriptor is no longer valid once this event is received.
+type NodeDeletedEvent struct {
+	Descriptor NodeDescriptor
+}
+
+// ResyncEvent is sent by a new leader to a session that may have missed events from the old one that can't be
+// sent again, like changes to nodes that the client hasn't cached. The client should drop its cached contents
+// and read again whatever it is watching.
+type ResyncEvent struct {
+	Session SessionDescriptor
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrEventStreamClosed = errors.New("Event stream closed")
+)
+
+// SequencedEvent is an event numbered in the order it was sent to its session, so that it can be acked by number
+type SequencedEvent struct {
+	Seq   uint64
+	Event Event
+}
+
+// EventStream is a session's connection to the leader that events are pushed to as they happen, instead of
+// waiting for the next KeepAlive to return. the client acks the events it has handled by sequence number and
+// sends its keepalives on the same stream. a session should have at most one stream open at a time.
+type EventStream interface {
+	// Recv blocks until there are events for the session. it fails once the session is closed or this server
+	// stops being the leader, after which the client should open a new stream through the leader.
+	Recv() ([]SequencedEvent, error)
+	// Ack tells the server that every event up to and including seq has been handled
+	Ack(seq uint64) error
+	// KeepAlive renews the session's lease. it has to be sent more often than every maxKeepAliveDelay, and the
+	// first one has to be sent before any events are received. li.LastSeq acks the events like Ack does, and on
+	// the first keepalive the events read by an earlier stream but not received are sent again.
+	KeepAlive(li LeaseInfo, eis []EventInfo) error
+	Close() error
+}
+
+type frontendEventStream struct {
+	fe *frontendImpl
+	sd SessionDescriptor
+	sc *sessionConn
+
+	// closed by the first keepalive, since the events can't be sent until the client says which it has received
+	syncOnce sync.Once
+	synced   chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (fe *frontendImpl) OpenEventStream(sd SessionDescriptor) (EventStream, error) {
+	if cs := fe.getClusterState(); !cs.IsLeader {
+		return nil, cs.MakeRedirectError()
+	}
+
+	sc, ok := fe.sessions.Get(uint64(sd.Descriptor)).(*sessionConn)
+	if !ok {
+		return nil, ErrInvalidSessionDescriptor
+	}
+	sc.Touch()
+
+	return &frontendEventStream{fe: fe, sd: sd, sc: sc, synced: make(chan struct{}), closed: make(chan struct{})}, nil
+}
+
+// check fails once the stream's session is gone, either because it was closed or because this server stopped
+// being the leader and forgot about it
+func (es *frontendEventStream) check() error {
+	if cs := es.fe.getClusterState(); !cs.IsLeader {
+		return cs.MakeRedirectError()
+	}
+	if sc, ok := es.fe.sessions.Get(uint64(es.sd.Descriptor)).(*sessionConn); !ok || sc != es.sc {
+		return ErrInvalidSessionDescriptor
+	}
+	return nil
+}
+
+func (es *frontendEventStream) Recv() ([]SequencedEvent, error) {
+	for {
+		if err := es.check(); err != nil {
+			return nil, err
+		}
+
+		// the session is signaled when it is closed or loses its leader too, the timeouts are only a backstop
+		select {
+		case <-es.synced:
+		case <-time.After(maxKeepAliveDelay):
+			continue
+		case <-es.closed:
+			return nil, ErrEventStreamClosed
+		}
+
+		select {
+		case <-es.sc.signaler.DoneChan():
+			es.sc.signaler.Reset()
+			if events := es.sc.ReadSequencedEvents(); len(events) > 0 {
+				return events, nil
+			}
+		case <-time.After(maxKeepAliveDelay):
+		case <-es.closed:
+			return nil, ErrEventStreamClosed
+		}
+	}
+}
+
+func (es *frontendEventStream) Ack(seq uint64) error {
+	if err := es.check(); err != nil {
+		return err
+	}
+	es.sc.AckEventsThrough(seq)
+	return nil
+}
+
+func (es *frontendEventStream) KeepAlive(li LeaseInfo, eis []EventInfo) error {
+	if err := es.check(); err != nil {
+		return err
+	}
+	es.sc.Touch()
+
+	// the first keepalive sends again whatever the client lost along with its last stream
+	es.syncOnce.Do(func() {
+		if es.sc.Sync(li.LastSeq) {
+			es.fe.reconcileSession(es.sc, li, eis)
+		}
+		close(es.synced)
+	})
+	es.sc.AckEventsThrough(li.LastSeq)
+	return nil
+}
+
+func (es *frontendEventStream) Close() error {
+	es.closeOnce.Do(func() { close(es.closed) })
+	return nil
+}
@@ -2,18 +2,25 @@ package server
 
 import (
 	"errors"
+	"log"
+	"math"
+	"sort"
 	"sync"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 const (
 	maxKeepAliveDelay = 3 * time.Second
+	reapInterval      = maxKeepAliveDelay
 )
 
 var (
 	ErrInvalidSessionDescriptor = errors.New("Invalid session descriptor")
 	ErrInvalidNodeDescriptor    = errors.New("Invalid node descriptor")
 	ErrReadOnlyNodeDescriptor   = errors.New("Write from read-only node descriptor")
+	ErrAcquireCancelled         = errors.New("Acquire cancelled")
 )
 
 func minTime(keepAliveDelay time.Duration) time.Duration {
@@ -25,6 +32,7 @@ func minTime(keepAliveDelay time.Duration) time.Duration {
 }
 
 type pendingEvent struct {
+	seq   uint64
 	event Event
 	ackC  chan struct{}
 }
@@ -36,13 +44,28 @@ type sessionConn struct {
 	lastKeepAlive time.Time
 
 	eventLock sync.Mutex
-	pending   []pendingEvent
-	ackCs     []chan struct{}
+	// the sequence number of the last event sent to the session, which numbers its events from 1
+	lastSeq uint64
+	pending []pendingEvent
+	// the events that have been read but not acked yet, in sequence order
+	unacked []pendingEvent
+	// false for a session taken over from the old leader until its client reports the last event it received
+	synced bool
 
 	signaler Signaler
 }
 
 func NewSessionConn() *sessionConn {
+	return &sessionConn{
+		lastKeepAlive: time.Now(),
+		synced:        true,
+		signaler:      NewSignaler(),
+	}
+}
+
+// newRecoveredSessionConn makes the connection for a session that was opened through an older leader, whose
+// events are numbered after the last one the client received from it once the client syncs
+func newRecoveredSessionConn() *sessionConn {
 	return &sessionConn{
 		lastKeepAlive: time.Now(),
 		signaler:      NewSignaler(),
@@ -65,6 +88,15 @@ func (sc *sessionConn) ExitKeepAlive() {
 }
 
 func (sc *sessionConn) IsAlive() bool {
+	return sc.isAliveWithin(timeoutThreshold)
+}
+
+// IsExpired returns whether the session's lease has run out, meaning that it should be closed
+func (sc *sessionConn) IsExpired() bool {
+	return !sc.isAliveWithin(sessionLeaseTimeout)
+}
+
+func (sc *sessionConn) isAliveWithin(threshold time.Duration) bool {
 	sc.aliveLock.Lock()
 	defer sc.aliveLock.Unlock()
 
@@ -72,20 +104,25 @@ func (sc *sessionConn) IsAlive() bool {
 		return true
 	}
 
-	return time.Since(sc.lastKeepAlive) < timeoutThreshold
+	return time.Since(sc.lastKeepAlive) < threshold
 }
 
 // SendEvent sends an event to this session and either blocks until the session acks it or times out
 func (sc *sessionConn) SendEvent(event Event) bool {
+	eventsPending.Inc()
+	defer eventsPending.Dec()
+
 	ac := make(chan struct{})
 
 	sc.eventLock.Lock()
-	sc.pending = append(sc.pending, pendingEvent{event, ac})
+	sc.lastSeq++
+	sc.pending = append(sc.pending, pendingEvent{sc.lastSeq, event, ac})
 	sc.eventLock.Unlock()
 
 	sc.signaler.Signal()
 
 	if !sc.IsAlive() {
+		eventAckTimeouts.Inc()
 		return false
 	}
 
@@ -94,32 +131,106 @@ func (sc *sessionConn) SendEvent(event Event) bool {
 		return true
 	case <-time.Tick(timeoutThreshold):
 		// TODO: maybe reduce this from timeoutThreshold to (timeoutThreshold - time.Since(sc.lastKeepAlive))
+		eventAckTimeouts.Inc()
 		return false
 	}
 }
 
 func (sc *sessionConn) ReadEvents() []Event {
+	var events []Event
+	for _, se := range sc.ReadSequencedEvents() {
+		events = append(events, se.Event)
+	}
+	return events
+}
+
+// ReadSequencedEvents returns the events that haven't been read yet, which then wait to be acked
+func (sc *sessionConn) ReadSequencedEvents() []SequencedEvent {
 	sc.eventLock.Lock()
 	defer sc.eventLock.Unlock()
 
-	var events []Event
+	var events []SequencedEvent
 	for _, pe := range sc.pending {
-		events = append(events, pe.event)
-		sc.ackCs = append(sc.ackCs, pe.ackC)
+		events = append(events, SequencedEvent{pe.seq, pe.event})
 	}
+	sc.unacked = append(sc.unacked, sc.pending...)
 	sc.pending = nil
 
 	return events
 }
 
+// AckEvents acks every event that has been read, for the KeepAlive calls that ack by asking for more
 func (sc *sessionConn) AckEvents() {
+	sc.AckEventsThrough(math.MaxUint64)
+}
+
+// AckEventsThrough acks the events that have been read with sequence numbers up to and including seq
+func (sc *sessionConn) AckEventsThrough(seq uint64) {
+	sc.eventLock.Lock()
+	defer sc.eventLock.Unlock()
+
+	for len(sc.unacked) > 0 && sc.unacked[0].seq <= seq {
+		close(sc.unacked[0].ackC)
+		sc.unacked = sc.unacked[1:]
+	}
+}
+
+// Sync catches the session up with lastSeq, the last event its client reports receiving. the events read up to
+// lastSeq are acked and the ones read after it were lost on the way, so they are sent again. the first Sync of a
+// recovered session numbers its events after lastSeq and returns true, since the client may have missed events
+// that the old leader never got to send.
+func (sc *sessionConn) Sync(lastSeq uint64) bool {
 	sc.eventLock.Lock()
 	defer sc.eventLock.Unlock()
 
-	for _, ackC := range sc.ackCs {
-		close(ackC)
+	var redeliver []pendingEvent
+	for _, pe := range sc.unacked {
+		if pe.seq <= lastSeq {
+			close(pe.ackC)
+		} else {
+			redeliver = append(redeliver, pe)
+		}
+	}
+	sc.unacked = nil
+	sc.pending = append(redeliver, sc.pending...)
+
+	recovered := !sc.synced
+	if recovered {
+		for i := range sc.pending {
+			sc.pending[i].seq = lastSeq + uint64(i) + 1
+		}
+		sc.lastSeq = lastSeq + uint64(len(sc.pending))
+		sc.synced = true
+	}
+
+	if len(sc.pending) > 0 {
+		sc.signaler.Signal()
+	}
+	return recovered
+}
+
+// QueueEvents sends events to this session without waiting for them to be acked
+func (sc *sessionConn) QueueEvents(events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	sc.eventLock.Lock()
+	for _, event := range events {
+		sc.lastSeq++
+		sc.pending = append(sc.pending, pendingEvent{sc.lastSeq, event, make(chan struct{})})
 	}
-	sc.ackCs = nil
+	sc.eventLock.Unlock()
+
+	sc.signaler.Signal()
+}
+
+// Touch renews the session's lease without a KeepAlive call in progress, for keepalives sent on an event stream
+func (sc *sessionConn) Touch() {
+	sc.aliveLock.Lock()
+	defer sc.aliveLock.Unlock()
+
+	sc.lastKeepAlive = time.Now()
 }
 
 // TODO: error handling
@@ -129,9 +240,13 @@ type frontendImpl struct {
 	csLock sync.RWMutex
 	cs     ClusterState
 
-	sessions  AtomicMap
-	lockLocks AtomicStringMap
-	setLocks  AtomicStringMap
+	sessions   AtomicMap
+	lockLocks  AtomicStringMap
+	lockQueues AtomicStringMap
+	setLocks   AtomicStringMap
+
+	closeOnce sync.Once
+	closed    chan struct{}
 }
 
 func NewFrontend() (Server, error) {
@@ -142,25 +257,40 @@ func NewFrontend() (Server, error) {
 
 	c := make(chan string, 1)
 	c2 := make(chan *string, 1)
-	go func() {
-		for {
-			s := <-c
-			c2 <- &s
-		}
-	}()
 
-	fsm = NewRaftFSM(c, c2, fsm)
+	fsm = NewRaftFSM(c, c2, nil, fsm)
 	stateC := make(chan ClusterState, 1)
 	stateC <- ClusterState{true, 1, ""}
-	return NewFrontendWithFSM(fsm, stateC)
+	s, err := NewFrontendWithFSM(fsm, stateC)
+	if err != nil {
+		return nil, err
+	}
+
+	// the in-memory log and cluster state only serve this frontend, so they stop along with it
+	go func(closed <-chan struct{}) {
+		for {
+			select {
+			case s := <-c:
+				c2 <- &s
+			case <-closed:
+				close(c2)
+				close(stateC)
+				return
+			}
+		}
+	}(s.(*frontendImpl).closed)
+
+	return s, nil
 }
 
 func NewFrontendWithFSM(fsm FSM, stateChanges <-chan ClusterState) (Server, error) {
 	fe := &frontendImpl{
-		fsm:       fsm,
-		sessions:  NewAtomicMap(),
-		lockLocks: NewAtomicStringMapWithDefault(func(string) interface{} { return &sync.Mutex{} }),
-		setLocks:  NewAtomicStringMapWithDefault(func(string) interface{} { return &sync.Mutex{} }),
+		fsm:        fsm,
+		sessions:   NewAtomicMap(),
+		lockLocks:  NewAtomicStringMapWithDefault(func(string) interface{} { return &sync.Mutex{} }),
+		lockQueues: NewAtomicStringMapWithDefault(func(string) interface{} { return &lockQueue{} }),
+		setLocks:   NewAtomicStringMapWithDefault(func(string) interface{} { return &sync.Mutex{} }),
+		closed:     make(chan struct{}),
 	}
 
 	cs := <-stateChanges
@@ -172,23 +302,85 @@ func NewFrontendWithFSM(fsm FSM, stateChanges <-chan ClusterState) (Server, erro
 		}
 	}()
 
+	go fe.reapSessions()
+
 	return fe, nil
 }
 
+// Close stops the frontend's background work, like reaping sessions. the calls in progress are left to finish.
+func (fe *frontendImpl) Close() error {
+	fe.closeOnce.Do(func() { close(fe.closed) })
+	return nil
+}
+
+// reapSessions periodically closes the sessions whose leases have expired while this node is the leader,
+// until the frontend is closed
+func (fe *frontendImpl) reapSessions() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-fe.closed:
+			return
+		}
+
+		if cs := fe.getClusterState(); cs.IsLeader {
+			fe.reapExpiredSessions()
+		}
+	}
+}
+
+func (fe *frontendImpl) reapExpiredSessions() {
+	for _, key := range fe.sessions.Keys() {
+		session, ok := fe.sessions.Get(key).(*sessionConn)
+		if !ok || !session.IsExpired() {
+			continue
+		}
+
+		// closing the session waits for any SetContent in progress on its ephemeral nodes before deleting them
+		sd := SessionDescriptor{descriptorKey(key)}
+		log.Println("reaping expired session:", sd)
+		if err := fe.closeSession(NoRequestID, sd, true); err != nil {
+			log.Println("unable to reap session:", sd, err)
+		}
+	}
+}
+
 func (fe *frontendImpl) setClusterState(cs ClusterState) {
 	fe.csLock.Lock()
 	defer fe.csLock.Unlock()
 	wasLeader := fe.cs.IsLeader
+	if cs.LeaderID != fe.cs.LeaderID {
+		leaderChanges.Inc()
+	}
 	fe.cs = cs
+	if cs.IsLeader {
+		isLeader.Set(1)
+	} else {
+		isLeader.Set(0)
+	}
 
 	if wasLeader && !cs.IsLeader {
+		// the writes still in flight may never be applied, so send their callers to the new leader
+		fe.fsm.AbortProposals()
+
+		// wake up the event streams of the sessions so that they send their clients to the new leader
+		for _, key := range fe.sessions.Keys() {
+			if session, ok := fe.sessions.Get(key).(*sessionConn); ok {
+				session.signaler.Signal()
+			}
+		}
+
 		fe.sessions = NewAtomicMap()
 		fe.lockLocks = NewAtomicStringMapWithDefault(func(string) interface{} { return &sync.Mutex{} })
+		fe.lockQueues = NewAtomicStringMapWithDefault(func(string) interface{} { return &lockQueue{} })
 		fe.setLocks = NewAtomicStringMapWithDefault(func(string) interface{} { return &sync.Mutex{} })
 	} else if !wasLeader && cs.IsLeader {
 		sds := fe.fsm.GetSessionDescriptors()
 		for _, sd := range sds {
-			fe.sessions.Put(uint64(sd.Descriptor), NewSessionConn())
+			fe.sessions.Put(uint64(sd.Descriptor), newRecoveredSessionConn())
 		}
 
 		// TODO: finish propagating events
@@ -199,6 +391,11 @@ func (fe *frontendImpl) setClusterState(cs ClusterState) {
 			mut.Lock()
 			go fe.finalizeSetContent(ni)
 		}
+
+		// the lock-delays that the old leader started are replicated, but their waiters now queue up here
+		for _, ni := range fe.fsm.GetLockDelayedNodes() {
+			fe.startLockDelay(ni)
+		}
 	}
 }
 
@@ -208,15 +405,45 @@ func (fe *frontendImpl) getClusterState() ClusterState {
 	return fe.cs
 }
 
+// linearizableRead waits until the fsm reflects every write that finished before the read began.
+// if this node stops being the leader in the meantime then the client is redirected to the new one.
+func (fe *frontendImpl) linearizableRead() error {
+	if err := fe.fsm.ReadBarrier(); err != nil {
+		if cs := fe.getClusterState(); !cs.IsLeader {
+			return cs.MakeRedirectError()
+		}
+		return err
+	}
+	return nil
+}
+
+// proposalError turns the error from a failed fsm write into the error for the client. if this node lost its
+// leadership while the write was pending then the client is redirected to the new leader.
+func (fe *frontendImpl) proposalError(err error) error {
+	if err == ErrLeadershipLost {
+		if cs := fe.getClusterState(); !cs.IsLeader {
+			return cs.MakeRedirectError()
+		}
+	}
+	return err
+}
+
 func (fe *frontendImpl) KeepAlive(li LeaseInfo, eis []EventInfo, keepAliveDelay time.Duration) ([]Event, error) {
 	if cs := fe.getClusterState(); !cs.IsLeader {
 		return nil, cs.MakeRedirectError()
 	}
 
-	sc := fe.sessions.Get(uint64(li.Session.Descriptor)).(*sessionConn)
+	sc, ok := fe.sessions.Get(uint64(li.Session.Descriptor)).(*sessionConn)
+	if !ok {
+		// the session was closed, most likely because its lease expired
+		return nil, ErrInvalidSessionDescriptor
+	}
 	sc.EnterKeepAlive()
 	defer sc.ExitKeepAlive()
 	sc.AckEvents()
+	if sc.Sync(li.LastSeq) {
+		fe.reconcileSession(sc, li, eis)
+	}
 
 	var events []Event
 	select {
@@ -230,73 +457,412 @@ func (fe *frontendImpl) KeepAlive(li LeaseInfo, eis []EventInfo, keepAliveDelay
 	return events, nil
 }
 
-func (fe *frontendImpl) OpenSession() (SessionDescriptor, error) {
+// reconcileSession sends a session taken over from the old leader the events that its client may have missed,
+// judging by the locks it thinks it holds and the generations of the nodes it has cached. the changes that the old
+// leader was still sending out are sent again by finalizeSetContent, so unfinalized nodes are skipped here.
+func (fe *frontendImpl) reconcileSession(sc *sessionConn, li LeaseInfo, eis []EventInfo) {
+	var events []Event
+
+	for _, nd := range li.LockedNodes {
+		nid := fe.fsm.GetNodeDescriptor(nd)
+		if nid == nil {
+			events = append(events, LockInvalidationEvent{nd})
+		} else if held, _ := nid.ni.GetLockMode(nid); !held {
+			events = append(events, LockInvalidationEvent{nd})
+		}
+	}
+
+	reported := make(map[NodeDescriptor]bool)
+	for _, ei := range eis {
+		reported[ei.Descriptor] = true
+
+		nid := fe.fsm.GetNodeDescriptor(ei.Descriptor)
+		if nid == nil {
+			events = append(events, NodeDeletedEvent{ei.Descriptor})
+			continue
+		} else if !nid.ni.IsFinalized() {
+			continue
+		}
+
+		if cas := nid.ni.GetContentAndStat(); cas.Stat.Generation != ei.Generation {
+			events = append(events, createInvalidationEvent(ei.Descriptor, cas, nid.config))
+		}
+	}
+
+	// changes pushed to nodes the client hasn't cached can't be checked, so the client has to read them again
+	for _, nid := range fe.fsm.GetSession(li.Session).GetDescriptors() {
+		if nid.config.ContentModified && !reported[nid.GetND()] {
+			events = append([]Event{ResyncEvent{li.Session}}, events...)
+			break
+		}
+	}
+
+	if len(events) > 0 {
+		log.Println("resending missed events to session:", li.Session, len(events))
+	}
+	sc.QueueEvents(events...)
+}
+
+func (fe *frontendImpl) OpenSession(id RequestID) (SessionDescriptor, error) {
 	if cs := fe.getClusterState(); !cs.IsLeader {
 		return SessionDescriptor{}, cs.MakeRedirectError()
 	}
 
-	sd := fe.fsm.OpenSession()
-	fe.sessions.Put(uint64(sd.Descriptor), NewSessionConn())
+	if result, ok := fe.fsm.GetRequestResult(SessionDescriptor{}, id); ok {
+		return result.SD, nil
+	}
+
+	sd, err := fe.fsm.OpenSession(id)
+	if err != nil {
+		return SessionDescriptor{}, fe.proposalError(err)
+	}
+	// a retry that was applied again gets back the session from the first time, which may already be connected
+	if fe.sessions.Get(uint64(sd.Descriptor)) == nil {
+		fe.sessions.Put(uint64(sd.Descriptor), NewSessionConn())
+	}
 	return sd, nil
 }
 
-func (fe *frontendImpl) CloseSession(sd SessionDescriptor) error {
+func (fe *frontendImpl) CloseSession(id RequestID, sd SessionDescriptor) error {
+	return fe.closeSession(id, sd, false)
+}
+
+// closeSession closes sd. if the session was lost rather than closed by its client then the locks it held
+// are subject to their lock-delay.
+func (fe *frontendImpl) closeSession(id RequestID, sd SessionDescriptor, lost bool) error {
 	if cs := fe.getClusterState(); !cs.IsLeader {
 		return cs.MakeRedirectError()
 	}
 
-	fe.fsm.CloseSession(sd)
+	if result, ok := fe.fsm.GetRequestResult(SessionDescriptor{}, id); ok {
+		if !result.OK {
+			return ErrInvalidSessionDescriptor
+		}
+		return nil
+	}
+
+	// like Delete, don't delete the ephemeral nodes out from under an in progress SetContent. the paths are
+	// locked in order so that two closes of the same session can't deadlock.
+	ephemeral := fe.fsm.GetEphemeralNodes(sd)
+	sort.Strings(ephemeral)
+	for _, path := range ephemeral {
+		mut := fe.setLocks.Get(path).(*sync.Mutex)
+		mut.Lock()
+		defer mut.Unlock()
+	}
+	if fe.fsm.GetSession(sd) == nil {
+		return ErrInvalidSessionDescriptor
+	}
+
+	// closing the session deletes its ephemeral nodes, so find out who has them open first
+	open := make(map[*sessionConn][]NodeDescriptor)
+	for _, path := range ephemeral {
+		for session, nds := range fe.getOpenDescriptors(path) {
+			open[session] = append(open[session], nds...)
+		}
+	}
+
+	// every lock the session held or waited on may have a new next waiter once it is gone
+	var paths []string
+	var held []*nodeDescriptor
+	for _, nid := range fe.fsm.GetSession(sd).GetDescriptors() {
+		paths = append(paths, nid.ni.path)
+		if ok, _ := nid.ni.GetLockMode(nid); ok {
+			held = append(held, nid)
+		}
+	}
+
+	// closing the session would release its locks anyway, but a lost session's are released first so that the
+	// time it was lost is replicated along with them and their lock-delays survive a change of leader
+	if lost {
+		for _, nid := range held {
+			lock := fe.lockLocks.Get(nid.ni.path).(*sync.Mutex)
+			lock.Lock()
+			_, err := fe.fsm.ReleaseLock(NoRequestID, nid.GetND(), time.Now())
+			if err == nil {
+				fe.startLockDelay(nid.ni)
+			}
+			lock.Unlock()
+			if err != nil {
+				return fe.proposalError(err)
+			}
+		}
+	}
+
+	if err := fe.fsm.CloseSession(id, sd); err != nil {
+		return fe.proposalError(err)
+	}
 	// TODO: internal cleanup?
+	session, hasConn := fe.sessions.Get(uint64(sd.Descriptor)).(*sessionConn)
+	if hasConn {
+		delete(open, session)
+	}
 	fe.sessions.Delete(uint64(sd.Descriptor))
+	if hasConn {
+		// the session's event stream finds out that it is gone once it wakes up
+		session.signaler.Signal()
+	}
+
+	for _, path := range append(paths, ephemeral...) {
+		fe.grantNextWaiter(path)
+	}
+
+	// don't make the closing session wait on everyone else to ack
+	go fe.sendNodeDeletedEvents(open)
 	return nil
 }
 
-func (fe *frontendImpl) Open(sd SessionDescriptor, path string, readOnly bool, config EventsConfig) (NodeDescriptor, error) {
+func (fe *frontendImpl) Open(id RequestID, sd SessionDescriptor, path string, readOnly bool, ephemeral bool, config EventsConfig) (NodeDescriptor, error) {
 	if cs := fe.getClusterState(); !cs.IsLeader {
 		return NodeDescriptor{}, cs.MakeRedirectError()
 	}
 
+	if result, ok := fe.fsm.GetRequestResult(sd, id); ok {
+		return result.ND, nil
+	}
+
 	if session := fe.fsm.GetSession(sd); session == nil {
 		return NodeDescriptor{}, ErrInvalidSessionDescriptor
 	}
 
-	return fe.fsm.OpenNode(sd, path, readOnly, config), nil
+	nd, err := fe.fsm.OpenNode(id, sd, path, readOnly, ephemeral, config)
+	if err != nil {
+		return NodeDescriptor{}, fe.proposalError(err)
+	}
+	return nd, nil
 }
 
-func (fe *frontendImpl) CloseNode(nd NodeDescriptor) error {
+func (fe *frontendImpl) CloseNode(id RequestID, nd NodeDescriptor) error {
 	if cs := fe.getClusterState(); !cs.IsLeader {
 		return cs.MakeRedirectError()
 	}
 
-	fe.fsm.CloseNode(nd)
+	if _, ok := fe.fsm.GetRequestResult(nd.Session, id); ok {
+		return nil
+	}
+
+	nid := fe.fsm.GetNodeDescriptor(nd)
+	if err := fe.fsm.CloseNode(id, nd); err != nil {
+		return fe.proposalError(err)
+	}
 	// TODO: internal cleanup?
+
+	// closing the descriptor released any lock held through it, and its own waits are now invalid
+	if nid != nil {
+		fe.grantNextWaiter(nid.ni.path)
+	}
 	return nil
 }
 
+func (fe *frontendImpl) Delete(id RequestID, nd NodeDescriptor) error {
+	if cs := fe.getClusterState(); !cs.IsLeader {
+		return cs.MakeRedirectError()
+	}
+
+	if result, ok := fe.fsm.GetRequestResult(nd.Session, id); ok && !result.OK {
+		return ErrInvalidNodeDescriptor
+	} else if ok {
+		return nil
+	}
+
+	var nid *nodeDescriptor
+	if nid = fe.fsm.GetNodeDescriptor(nd); nid == nil {
+		return ErrInvalidNodeDescriptor
+	} else if nid.readOnly {
+		return ErrReadOnlyNodeDescriptor
+	}
+
+	// don't delete the node out from under an in progress SetContent
+	mut := fe.setLocks.Get(nid.ni.path).(*sync.Mutex)
+	mut.Lock()
+	defer mut.Unlock()
+
+	// the fsm forgets about the open descriptors when it deletes the node, so look them up first
+	open := fe.getOpenDescriptors(nid.ni.path)
+
+	if ok, err := fe.fsm.DeleteNode(id, nd); err != nil {
+		return fe.proposalError(err)
+	} else if !ok {
+		return ErrInvalidNodeDescriptor
+	}
+
+	// anyone waiting on the lock was waiting through a descriptor that is now closed
+	fe.grantNextWaiter(nid.ni.path)
+	fe.sendNodeDeletedEvents(open)
+
+	return nil
+}
+
+// sendNodeDeletedEvents notifies every descriptor in open that its node is gone and waits for the acks
+func (fe *frontendImpl) sendNodeDeletedEvents(open map[*sessionConn][]NodeDescriptor) {
+	wg := sync.WaitGroup{}
+	for session, nds := range open {
+		wg.Add(len(nds))
+		for _, snd := range nds {
+			go func(session *sessionConn, snd NodeDescriptor) {
+				session.SendEvent(NodeDeletedEvent{snd})
+				wg.Done()
+			}(session, snd)
+		}
+	}
+	wg.Wait()
+}
+
+func (fe *frontendImpl) List(sd SessionDescriptor, dir string) ([]DirEntry, error) {
+	if cs := fe.getClusterState(); !cs.IsLeader {
+		return nil, cs.MakeRedirectError()
+	}
+
+	if err := fe.linearizableRead(); err != nil {
+		return nil, err
+	}
+
+	if session := fe.fsm.GetSession(sd); session == nil {
+		return nil, ErrInvalidSessionDescriptor
+	}
+
+	return fe.fsm.ListChildren(dir), nil
+}
+
 func (fe *frontendImpl) Acquire(nd NodeDescriptor) error {
+	return fe.AcquireContext(context.Background(), nd)
+}
+
+func (fe *frontendImpl) AcquireContext(ctx context.Context, nd NodeDescriptor) error {
+	return fe.acquire(ctx, nd, false)
+}
+
+func (fe *frontendImpl) AcquireShared(nd NodeDescriptor) error {
+	return fe.acquire(context.Background(), nd, true)
+}
+
+func (fe *frontendImpl) acquire(ctx context.Context, nd NodeDescriptor, shared bool) error {
 	if cs := fe.getClusterState(); !cs.IsLeader {
 		return cs.MakeRedirectError()
 	}
 
+	// read-only descriptors may share the lock with other readers, but not exclude them
+	var nid *nodeDescriptor
+	if nid = fe.fsm.GetNodeDescriptor(nd); nid == nil {
+		return ErrInvalidNodeDescriptor
+	} else if nid.readOnly && !shared {
+		return ErrReadOnlyNodeDescriptor
+	}
+
+	lock := fe.lockLocks.Get(nid.ni.path).(*sync.Mutex)
+	lock.Lock()
+	// waiting on a lock we already hold would never finish
+	if held, heldShared := nid.ni.GetLockMode(nid); held {
+		lock.Unlock()
+		if heldShared != shared {
+			return ErrLockModeHeld
+		}
+		return nil
+	}
+
+	queue := fe.lockQueues.Get(nid.ni.path).(*lockQueue)
+	if queue.Len() == 0 {
+		if ok, err := fe.tryAcquireLockedMode(NoRequestID, nd, nid.ni, shared); err != nil || ok {
+			lock.Unlock()
+			return fe.proposalError(err)
+		}
+	}
+
+	// park until a Release hands us the lock
+	waiter := newLockWaiter(nd, shared)
+	queue.Push(waiter)
+	lock.Unlock()
+
+	start := time.Now()
 	for {
-		locked, err := fe.TryAcquire(nd)
-		if err != nil {
-			return err
-		} else if locked {
-			return nil
+		select {
+		case <-waiter.grantedC:
+			observeLockWait(shared, start, waiter.err)
+			return waiter.err
+		case <-ctx.Done():
+			fe.withdrawWaiter(nid.ni.path, waiter)
+			observeLockWait(shared, start, ctx.Err())
+			return ctx.Err()
+		case <-time.After(timeoutThreshold):
+			if cs := fe.getClusterState(); !cs.IsLeader {
+				err := cs.MakeRedirectError()
+				observeLockWait(shared, start, err)
+				return err
+			}
+
+			// the holder may have died without releasing, in which case nothing else would wake us up
+			fe.grantNextWaiter(nid.ni.path)
 		}
 	}
 }
 
-func (fe *frontendImpl) TryAcquire(nd NodeDescriptor) (bool, error) {
+// withdrawWaiter takes a waiter that gave up out of the queue. if the lock was handed to it in the
+// meantime then it is released again so that it goes to the next waiter instead.
+func (fe *frontendImpl) withdrawWaiter(path string, waiter *lockWaiter) {
+	lock := fe.lockLocks.Get(path).(*sync.Mutex)
+	lock.Lock()
+	removed := fe.lockQueues.Get(path).(*lockQueue).Remove(waiter)
+	lock.Unlock()
+
+	if removed {
+		return
+	}
+
+	<-waiter.grantedC
+	if waiter.err != nil {
+		return
+	}
+	if ok, err := fe.fsm.ReleaseLock(NoRequestID, waiter.nd, time.Time{}); err != nil {
+		log.Println("unable to release withdrawn lock:", waiter.nd, err)
+	} else if ok {
+		fe.grantNextWaiter(path)
+	}
+}
+
+// CancelAcquire withdraws any Acquire calls that are waiting on the lock through nd.
+// the cancelled calls return ErrAcquireCancelled.
+func (fe *frontendImpl) CancelAcquire(nd NodeDescriptor) error {
+	if cs := fe.getClusterState(); !cs.IsLeader {
+		return cs.MakeRedirectError()
+	}
+
+	nid := fe.fsm.GetNodeDescriptor(nd)
+	if nid == nil {
+		return ErrInvalidNodeDescriptor
+	}
+
+	lock := fe.lockLocks.Get(nid.ni.path).(*sync.Mutex)
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, waiter := range fe.lockQueues.Get(nid.ni.path).(*lockQueue).RemoveDescriptor(nid.GetND()) {
+		waiter.grant(ErrAcquireCancelled)
+	}
+	return nil
+}
+
+func (fe *frontendImpl) TryAcquire(id RequestID, nd NodeDescriptor) (bool, error) {
+	return fe.tryAcquire(id, nd, false)
+}
+
+func (fe *frontendImpl) TryAcquireShared(id RequestID, nd NodeDescriptor) (bool, error) {
+	return fe.tryAcquire(id, nd, true)
+}
+
+func (fe *frontendImpl) tryAcquire(id RequestID, nd NodeDescriptor, shared bool) (bool, error) {
 	if cs := fe.getClusterState(); !cs.IsLeader {
 		return false, cs.MakeRedirectError()
 	}
 
+	// only the attempts that took the lock are remembered, the others are safe to try again
+	if result, ok := fe.fsm.GetRequestResult(nd.Session, id); ok {
+		return result.OK, nil
+	}
+
 	var nid *nodeDescriptor
 	if nid = fe.fsm.GetNodeDescriptor(nd); nid == nil {
 		return false, ErrInvalidNodeDescriptor
-	} else if nid.readOnly {
+	} else if nid.readOnly && !shared {
 		return false, ErrReadOnlyNodeDescriptor
 	}
 
@@ -304,49 +870,263 @@ func (fe *frontendImpl) TryAcquire(nd NodeDescriptor) (bool, error) {
 	lock.Lock()
 	defer lock.Unlock()
 
-	currentLocker := nid.ni.locker
-	if currentLocker == nil {
-		// there is no locker, so take the lock
-		fe.fsm.SetLocked(nd)
-		return true, nil
+	if held, heldShared := nid.ni.GetLockMode(nid); held {
+		if heldShared != shared {
+			return false, ErrLockModeHeld
+		}
+		return false, nil
+	}
+
+	// don't cut in front of the callers that are already waiting in Acquire
+	if queue := fe.lockQueues.Get(nid.ni.path).(*lockQueue); queue.Len() > 0 {
+		return false, nil
+	}
+
+	ok, err := fe.tryAcquireLockedMode(id, nd, nid.ni, shared)
+	return ok, fe.proposalError(err)
+}
+
+func (fe *frontendImpl) tryAcquireLockedMode(id RequestID, nd NodeDescriptor, ni *nodeInfo, shared bool) (bool, error) {
+	if shared {
+		return fe.tryAcquireSharedLocked(id, nd, ni)
+	}
+	return fe.tryAcquireLocked(id, nd, ni)
+}
+
+// tryAcquireLocked takes the lock on ni for nd if nobody holds it or if its holders died.
+// callers must hold the lock lock for ni's path.
+func (fe *frontendImpl) tryAcquireLocked(id RequestID, nd NodeDescriptor, ni *nodeInfo) (bool, error) {
+	currentLocker, lockers := ni.GetLockers()
+	if currentLocker != nil {
+		lockers = append(lockers, currentLocker)
+	}
+
+	// every holder has to be dead before we can take the lock from them
+	if ok, err := fe.reclaimLock(ni, lockers); !ok || err != nil {
+		return false, err
+	}
+
+	if err := fe.fsm.SetLocked(id, nd); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// tryAcquireSharedLocked adds nd to the shared holders of the lock on ni if nobody holds it exclusively,
+// or if its exclusive holder died. callers must hold the lock lock for ni's path.
+func (fe *frontendImpl) tryAcquireSharedLocked(id RequestID, nd NodeDescriptor, ni *nodeInfo) (bool, error) {
+	var lockers []*nodeDescriptor
+	if currentLocker, _ := ni.GetLockers(); currentLocker != nil {
+		lockers = append(lockers, currentLocker)
+	}
+
+	if ok, err := fe.reclaimLock(ni, lockers); !ok || err != nil {
+		return false, err
+	}
+
+	if err := fe.fsm.SetSharedLocked(id, nd); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// reclaimLock takes the lock on ni away from lockers if all of them died and sends them invalidation events.
+// it reports whether the lock is free to be taken, which it isn't while the lock-delay of a lost holder runs.
+// callers must hold the lock lock for ni's path.
+func (fe *frontendImpl) reclaimLock(ni *nodeInfo, lockers []*nodeDescriptor) (bool, error) {
+	for _, locker := range lockers {
+		lockerSession, ok := fe.sessions.Get(uint64(locker.cs.key)).(*sessionConn)
+		if ok && lockerSession.IsAlive() {
+			// we don't get the lock :(
+			return false, nil
+		}
+	}
+
+	if len(lockers) > 0 {
+		if err := fe.revokeLock(ni, lockers); err != nil {
+			return false, err
+		}
+	}
+
+	return !fe.inLockDelay(ni), nil
+}
+
+// revokeLock releases the lock on ni from lockers, starts its lock-delay and sends the lockers invalidation events.
+// the events aren't waited on, since a holder that is alive may take a while to ack them.
+// callers must hold the lock lock for ni's path.
+func (fe *frontendImpl) revokeLock(ni *nodeInfo, lockers []*nodeDescriptor) error {
+	lost := time.Now()
+	for _, locker := range lockers {
+		if _, err := fe.fsm.ReleaseLock(NoRequestID, locker.GetND(), lost); err != nil {
+			return err
+		}
+	}
+	fe.startLockDelay(ni)
+
+	for _, locker := range lockers {
+		if lockerSession, ok := fe.sessions.Get(uint64(locker.cs.key)).(*sessionConn); ok {
+			go lockerSession.SendEvent(LockInvalidationEvent{locker.GetND()})
+		}
+	}
+	return nil
+}
+
+// startLockDelay hands the lock on ni to the next waiter once the lock-delay that the fsm started for its lost
+// holder runs out. until then inLockDelay keeps the lock from being taken.
+func (fe *frontendImpl) startLockDelay(ni *nodeInfo) {
+	remaining := time.Until(ni.GetLockDelayEnd())
+	if remaining <= 0 {
+		return
+	}
+
+	time.AfterFunc(remaining, func() {
+		fe.grantNextWaiter(ni.path)
+	})
+}
+
+func (fe *frontendImpl) inLockDelay(ni *nodeInfo) bool {
+	return time.Now().Before(ni.GetLockDelayEnd())
+}
+
+// grantNextWaiter hands the lock on path to the waiters at the front of its queue, if it is free
+func (fe *frontendImpl) grantNextWaiter(path string) {
+	lock := fe.lockLocks.Get(path).(*sync.Mutex)
+	lock.Lock()
+	defer lock.Unlock()
+
+	queue := fe.lockQueues.Get(path).(*lockQueue)
+	for waiter := queue.Peek(); waiter != nil; waiter = queue.Peek() {
+		nid := fe.fsm.GetNodeDescriptor(waiter.nd)
+		if nid == nil {
+			// the descriptor was closed or its node deleted while it waited
+			queue.Pop().grant(ErrInvalidNodeDescriptor)
+			continue
+		}
+
+		if ok, err := fe.tryAcquireLockedMode(NoRequestID, waiter.nd, nid.ni, waiter.shared); err != nil {
+			queue.Pop().grant(fe.proposalError(err))
+			return
+		} else if !ok {
+			return
+		}
+		queue.Pop().grant(nil)
+
+		// every shared waiter at the front of the queue can hold the lock together
+		if !waiter.shared {
+			return
+		}
+	}
+}
+
+func (fe *frontendImpl) Release(id RequestID, nd NodeDescriptor) error {
+	if cs := fe.getClusterState(); !cs.IsLeader {
+		return cs.MakeRedirectError()
+	}
+
+	if result, ok := fe.fsm.GetRequestResult(nd.Session, id); ok && !result.OK {
+		return ErrLockNotHeld
+	} else if ok {
+		return nil
+	}
+
+	// read-only descriptors can only hold the lock in shared mode, which they are allowed to release
+	var nid *nodeDescriptor
+	if nid = fe.fsm.GetNodeDescriptor(nd); nid == nil {
+		return ErrInvalidNodeDescriptor
 	}
 
-	lockerSession := fe.sessions.Get(uint64(currentLocker.cs.key)).(*sessionConn)
-	if !lockerSession.IsAlive() {
-		// the locker died, so take the lock and send them an event
-		// TODO: what if the leader dies here?
-		fe.fsm.SetLocked(nd)
-		lockInvalidationEvent := LockInvalidationEvent{currentLocker.GetND()}
-		lockerSession.SendEvent(lockInvalidationEvent)
-		return true, nil
+	if ok, err := fe.fsm.ReleaseLock(id, nd, time.Time{}); err != nil {
+		return fe.proposalError(err)
+	} else if !ok {
+		return ErrLockNotHeld
 	}
 
-	// we don't get the lock :(
-	return false, nil
+	fe.grantNextWaiter(nid.ni.path)
+	return nil
 }
 
-func (fe *frontendImpl) Release(nd NodeDescriptor) error {
+func (fe *frontendImpl) SetLockDelay(id RequestID, nd NodeDescriptor, delay time.Duration) error {
 	if cs := fe.getClusterState(); !cs.IsLeader {
 		return cs.MakeRedirectError()
 	}
 
-	if node := fe.fsm.GetNodeDescriptor(nd); node == nil {
+	if result, ok := fe.fsm.GetRequestResult(nd.Session, id); ok && !result.OK {
+		return ErrInvalidNodeDescriptor
+	} else if ok {
+		return nil
+	}
+
+	if delay < 0 || delay > maxLockDelay {
+		return ErrInvalidLockDelay
+	}
+
+	var nid *nodeDescriptor
+	if nid = fe.fsm.GetNodeDescriptor(nd); nid == nil {
 		return ErrInvalidNodeDescriptor
-	} else if node.readOnly {
+	} else if nid.readOnly {
 		return ErrReadOnlyNodeDescriptor
 	}
 
-	if ok := fe.fsm.ReleaseLock(nd); !ok {
-		return ErrLockNotHeld
+	if ok, err := fe.fsm.SetLockDelay(id, nd, delay); err != nil {
+		return fe.proposalError(err)
+	} else if !ok {
+		return ErrInvalidNodeDescriptor
 	}
 	return nil
 }
 
+func (fe *frontendImpl) GetSequencer(nd NodeDescriptor) (Sequencer, error) {
+	if cs := fe.getClusterState(); !cs.IsLeader {
+		return Sequencer{}, cs.MakeRedirectError()
+	}
+
+	if err := fe.linearizableRead(); err != nil {
+		return Sequencer{}, err
+	}
+
+	if nid := fe.fsm.GetNodeDescriptor(nd); nid == nil {
+		return Sequencer{}, ErrInvalidNodeDescriptor
+	}
+
+	seq, ok := fe.fsm.GetSequencer(nd)
+	if !ok {
+		return Sequencer{}, ErrNoSequencerHeld
+	}
+	return seq, nil
+}
+
+func (fe *frontendImpl) CheckSequencer(seq Sequencer) (bool, error) {
+	if cs := fe.getClusterState(); !cs.IsLeader {
+		return false, cs.MakeRedirectError()
+	}
+
+	if err := fe.linearizableRead(); err != nil {
+		return false, err
+	}
+
+	return fe.fsm.CheckSequencer(seq), nil
+}
+
 func (fe *frontendImpl) GetContentAndStat(nd NodeDescriptor) (NodeContentAndStat, error) {
 	if cs := fe.getClusterState(); !cs.IsLeader {
 		return NodeContentAndStat{}, cs.MakeRedirectError()
 	}
 
+	return fe.getContentAndStat(nd)
+}
+
+// GetContentAndStatFollower is GetContentAndStat for any member of the cluster, not just the leader.
+// the read is still linearizable because the member waits until it has applied everything that the leader
+// had committed when the read began.
+func (fe *frontendImpl) GetContentAndStatFollower(nd NodeDescriptor) (NodeContentAndStat, error) {
+	return fe.getContentAndStat(nd)
+}
+
+func (fe *frontendImpl) getContentAndStat(nd NodeDescriptor) (NodeContentAndStat, error) {
+	if err := fe.linearizableRead(); err != nil {
+		return NodeContentAndStat{}, err
+	}
+
 	if node := fe.fsm.GetNodeDescriptor(nd); node == nil {
 		return NodeContentAndStat{}, ErrInvalidNodeDescriptor
 	}
@@ -361,11 +1141,15 @@ func createInvalidationEvent(nd NodeDescriptor, cas NodeContentAndStat, config E
 	return ContentInvalidationEvent{nd}
 }
 
-func (fe *frontendImpl) SetContent(nd NodeDescriptor, content string, generation uint64) (bool, error) {
+func (fe *frontendImpl) SetContent(id RequestID, nd NodeDescriptor, content string, generation uint64) (bool, error) {
 	if cs := fe.getClusterState(); !cs.IsLeader {
 		return false, cs.MakeRedirectError()
 	}
 
+	if result, ok := fe.fsm.GetRequestResult(nd.Session, id); ok {
+		return result.OK, nil
+	}
+
 	var nid *nodeDescriptor
 	if nid = fe.fsm.GetNodeDescriptor(nd); nid == nil {
 		return false, ErrInvalidNodeDescriptor
@@ -376,8 +1160,11 @@ func (fe *frontendImpl) SetContent(nd NodeDescriptor, content string, generation
 	mut := fe.setLocks.Get(nid.ni.path).(*sync.Mutex)
 	mut.Lock()
 
-	ok := fe.fsm.PrepareSetContent(nd, NodeContentAndStat{content, NodeStat{generation, time.Now()}})
-	if !ok {
+	ok, err := fe.fsm.PrepareSetContent(id, nd, NodeContentAndStat{content, NodeStat{Generation: generation, LastModified: time.Now()}})
+	if err != nil {
+		mut.Unlock()
+		return false, fe.proposalError(err)
+	} else if !ok {
 		mut.Unlock()
 		return false, nil
 	}
@@ -415,17 +1202,43 @@ func (fe *frontendImpl) finalizeSetContent(ni *nodeInfo) {
 
 	wg.Wait()
 
-	fe.fsm.FinalizeSetContent(ni.path)
+	// if this fails then the node stays unfinalized until the next leader finalizes it
+	if err := fe.fsm.FinalizeSetContent(ni.path); err != nil {
+		log.Println("unable to finalize set content:", ni.path, err)
+	}
 
 	mut := fe.setLocks.Get(ni.path).(*sync.Mutex)
 	mut.Unlock()
 }
 
+// getOpenDescriptors returns every open descriptor on path grouped by the connection of its session
+func (fe *frontendImpl) getOpenDescriptors(path string) map[*sessionConn][]NodeDescriptor {
+	open := make(map[*sessionConn][]NodeDescriptor)
+
+	sds := fe.sessions.Keys()
+	for _, sd := range sds {
+		// if the session has been closed since, just ignore it
+		session, ok := fe.sessions.Get(sd).(*sessionConn)
+		if !ok {
+			continue
+		}
+
+		cs := fe.fsm.GetSession(SessionDescriptor{descriptorKey(sd)})
+		for _, key := range cs.GetDescriptorKeys(path) {
+			open[session] = append(open[session], NodeDescriptor{SessionDescriptor{descriptorKey(sd)}, key, path})
+		}
+	}
+
+	return open
+}
+
 func (fe *frontendImpl) Nop(numOps uint64) error {
 	var i uint64 = 0
 
 	for ; i < numOps; i++ {
-		fe.fsm.Nop(0)
+		if err := fe.fsm.Nop(0); err != nil {
+			return fe.proposalError(err)
+		}
 	}
 
 	return nil
@@ -1,8 +1,12 @@
 package server
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 // These test functions just immediately delegate to the shared tester functions in server_test_common.go
@@ -12,6 +16,7 @@ func TestFrontend_KeepAlive(t *testing.T) {
 	if err != nil {
 		t.Fatal("Unable to start server:", err)
 	}
+	defer s.(*frontendImpl).Close()
 
 	DoServerTest_KeepAlive(t, s)
 }
@@ -21,6 +26,7 @@ func TestFrontend_OpenGetSet(t *testing.T) {
 	if err != nil {
 		t.Fatal("Unable to start server:", err)
 	}
+	defer s.(*frontendImpl).Close()
 
 	DoServerTest_OpenGetSet(t, s)
 }
@@ -30,6 +36,7 @@ func TestFrontend_OpenReadOnly(t *testing.T) {
 	if err != nil {
 		t.Fatal("Unable to start server:", err)
 	}
+	defer s.(*frontendImpl).Close()
 
 	DoServerTest_OpenReadOnly(t, s)
 }
@@ -39,6 +46,7 @@ func TestFrontend_SetContentGeneration(t *testing.T) {
 	if err != nil {
 		t.Fatal("Unable to start server:", err)
 	}
+	defer s.(*frontendImpl).Close()
 
 	DoServerTest_SetContentGeneration(t, s)
 }
@@ -48,6 +56,7 @@ func TestFrontend_ConcurrentOpen(t *testing.T) {
 	if err != nil {
 		t.Fatal("Unable to start server:", err)
 	}
+	defer s.(*frontendImpl).Close()
 
 	DoServerTest_ConcurrentOpen(t, s)
 }
@@ -57,6 +66,7 @@ func TestFrontend_TryAcquire(t *testing.T) {
 	if err != nil {
 		t.Fatal("Unable to start server:", err)
 	}
+	defer s.(*frontendImpl).Close()
 
 	DoServerTest_TryAcquire(t, s)
 }
@@ -66,10 +76,131 @@ func TestFrontend_BadRelease(t *testing.T) {
 	if err != nil {
 		t.Fatal("Unable to start server:", err)
 	}
+	defer s.(*frontendImpl).Close()
 
 	DoServerTest_BadRelease(t, s)
 }
 
+func TestFrontend_Delete(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	DoServerTest_Delete(t, s)
+}
+
+func TestFrontend_List(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	DoServerTest_List(t, s)
+}
+
+func TestFrontend_Ephemeral(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	DoServerTest_Ephemeral(t, s)
+}
+
+func TestFrontend_AcquireFIFO(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	DoServerTest_AcquireFIFO(t, s)
+}
+
+func TestFrontend_AcquireContext(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	DoServerTest_AcquireContext(t, s)
+}
+
+func TestFrontend_Sequencer(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	DoServerTest_Sequencer(t, s)
+}
+
+func TestFrontend_SharedLocks(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	DoServerTest_SharedLocks(t, s)
+}
+
+func TestFrontend_SetLockDelay(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	DoServerTest_SetLockDelay(t, s)
+}
+
+func TestFrontend_GetContentAndStatFollower(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	DoServerTest_GetContentAndStatFollower(t, s)
+}
+
+func TestFrontend_RetriedRequests(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	DoServerTest_RetriedRequests(t, s)
+}
+
+func TestFrontend_EventStream(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	DoServerTest_EventStream(t, s)
+}
+
+func TestFrontend_EventStreamRedelivery(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	DoServerTest_EventStreamRedelivery(t, s)
+}
+
 func TestFrontendImpl_SetContentFailover(t *testing.T) {
 	fsm, err := NewFSM()
 	if err != nil {
@@ -77,13 +208,13 @@ func TestFrontendImpl_SetContentFailover(t *testing.T) {
 	}
 
 	// grab a session and node descriptor
-	sd := fsm.OpenSession()
-	nd := fsm.OpenNode(sd, "/foo", false, EventsConfig{ContentModified: true})
+	sd, _ := fsm.OpenSession(NoRequestID)
+	nd, _ := fsm.OpenNode(NoRequestID, sd, "/foo", false, false, EventsConfig{ContentModified: true})
 
 	nid := fsm.GetNodeDescriptor(nd)
 
 	// add an incomplete SetContent to run failover for
-	fsm.PrepareSetContent(nd, NodeContentAndStat{Content: "new set", Stat: NodeStat{Generation: 10, LastModified: time.Now()}})
+	fsm.PrepareSetContent(NoRequestID, nd, NodeContentAndStat{Content: "new set", Stat: NodeStat{Generation: 10, LastModified: time.Now()}})
 
 	stateC := make(chan ClusterState, 1)
 	stateC <- ClusterState{true, 1, ""}
@@ -91,6 +222,7 @@ func TestFrontendImpl_SetContentFailover(t *testing.T) {
 	if err != nil {
 		t.Fatal("unable to create frontend with fsm:", err)
 	}
+	defer s.(*frontendImpl).Close()
 
 	// check in for events
 	events, err := s.KeepAlive(LeaseInfo{Session: sd}, []EventInfo{{nd, 0, true}}, time.Second)
@@ -109,7 +241,7 @@ func TestFrontendImpl_SetContentFailover(t *testing.T) {
 		}
 	}
 
-	ok, err := s.SetContent(nd, "final set", 10)
+	ok, err := s.SetContent(NewRequestID(), nd, "final set", 10)
 	if err != nil || !ok {
 		t.Error("failed to do final set")
 	}
@@ -118,3 +250,503 @@ func TestFrontendImpl_SetContentFailover(t *testing.T) {
 		t.Error("not finalized")
 	}
 }
+
+func TestFrontendImpl_EventStreamFailover(t *testing.T) {
+	fsm, err := NewFSM()
+	if err != nil {
+		t.Fatal("unable to create fsm:", err)
+	}
+
+	// a session that watches one node it has cached and one it hasn't
+	sd, _ := fsm.OpenSession(NoRequestID)
+	cached, _ := fsm.OpenNode(NoRequestID, sd, "/foo", false, false, EventsConfig{ContentModified: true})
+	fsm.OpenNode(NoRequestID, sd, "/bar", false, false, EventsConfig{ContentModified: true})
+
+	// the cached node changed and its invalidation was sent by the old leader, but the client never got it
+	fsm.PrepareSetContent(NoRequestID, cached, NodeContentAndStat{Content: "missed set", Stat: NodeStat{Generation: 1, LastModified: time.Now()}})
+	fsm.FinalizeSetContent("/foo")
+
+	stateC := make(chan ClusterState, 1)
+	stateC <- ClusterState{true, 1, ""}
+	s, err := NewFrontendWithFSM(fsm, stateC)
+	if err != nil {
+		t.Fatal("unable to create frontend with fsm:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	stream, err := s.OpenEventStream(sd)
+	if err != nil {
+		t.Fatal("unable to open event stream:", err)
+	}
+	defer stream.Close()
+
+	// the client got 41 events from the old leader and thinks it still holds a lock on the cached node
+	li := LeaseInfo{Session: sd, LockedNodes: []NodeDescriptor{cached}, LastSeq: 41}
+	if err := stream.KeepAlive(li, []EventInfo{{cached, 0, true}}); err != nil {
+		t.Fatal("unable to send keepalive:", err)
+	}
+
+	events, err := stream.Recv()
+	if err != nil {
+		t.Fatal("unable to receive events:", err)
+	} else if len(events) != 3 {
+		t.Fatal("expected 3 events, got:", events)
+	}
+
+	for i, se := range events {
+		if se.Seq != uint64(42+i) {
+			t.Error("event not numbered after the last one received:", se)
+		}
+	}
+	if e, ok := events[0].Event.(ResyncEvent); !ok || e.Session != sd {
+		t.Errorf("expected resync event, got: %#v", events[0].Event)
+	}
+	if e, ok := events[1].Event.(LockInvalidationEvent); !ok || e.Descriptor != cached {
+		t.Errorf("expected lock invalidation event, got: %#v", events[1].Event)
+	}
+	if e, ok := events[2].Event.(ContentInvalidationPushEvent); !ok || e.Descriptor != cached || e.Content != "missed set" {
+		t.Errorf("expected content invalidation push event, got: %#v", events[2].Event)
+	}
+}
+
+func TestFrontendImpl_ReapExpiredSessions(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+	fe := s.(*frontendImpl)
+
+	expired, _ := s.OpenSession(NewRequestID())
+	expiredNd, _ := s.Open(NewRequestID(), expired, "/foo/reaped", false, false, EventsConfig{})
+	if ok, err := s.TryAcquire(NewRequestID(), expiredNd); err != nil || !ok {
+		t.Fatal("unable to acquire lock:", err)
+	}
+
+	live, _ := s.OpenSession(NewRequestID())
+	liveNd, _ := s.Open(NewRequestID(), live, "/foo/reaped", false, false, EventsConfig{})
+
+	// pretend the first session stopped sending keepalives a long time ago
+	sc := fe.sessions.Get(uint64(expired.Descriptor)).(*sessionConn)
+	sc.aliveLock.Lock()
+	sc.lastKeepAlive = time.Now().Add(-sessionLeaseTimeout)
+	sc.aliveLock.Unlock()
+
+	fe.reapExpiredSessions()
+
+	if _, err := s.KeepAlive(LeaseInfo{Session: expired}, nil, time.Millisecond); err != ErrInvalidSessionDescriptor {
+		t.Error("expected invalid session from KeepAlive on reaped session, got:", err)
+	}
+	if _, err := s.GetContentAndStat(expiredNd); err == nil {
+		t.Error("descriptor of reaped session still valid")
+	}
+	if nid := fe.fsm.GetNodeDescriptor(liveNd); nid.ni.locker != nil {
+		t.Error("reaped session still holds its lock")
+	}
+	if _, err := s.KeepAlive(LeaseInfo{Session: live}, nil, time.Millisecond); err != nil {
+		t.Error("live session was reaped:", err)
+	}
+}
+
+// doCloseOwnerDuringSetContent closes the owner of an ephemeral node with closeOwner while another session's
+// SetContent on the node is still waiting on invalidation acks. the node mustn't be deleted until the write has
+// been finalized, since finalizing a node that is gone used to panic in every replica.
+func doCloseOwnerDuringSetContent(t *testing.T, closeOwner func(fe *frontendImpl, owner SessionDescriptor) error) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+	fe := s.(*frontendImpl)
+
+	owner, _ := s.OpenSession(NewRequestID())
+	if _, err := s.Open(NewRequestID(), owner, "/foo/ephemeral", false, true, EventsConfig{}); err != nil {
+		t.Fatal("unable to open ephemeral node:", err)
+	}
+	writer, _ := s.OpenSession(NewRequestID())
+	writerNd, _ := s.Open(NewRequestID(), writer, "/foo/ephemeral", false, false, EventsConfig{})
+	watcher, _ := s.OpenSession(NewRequestID())
+	if _, err := s.Open(NewRequestID(), watcher, "/foo/ephemeral", true, false, EventsConfig{}); err != nil {
+		t.Fatal("unable to open node:", err)
+	}
+
+	// the owner's lease has run out and the writer looks dead, so only the watcher's ack is waited on
+	for sd, age := range map[SessionDescriptor]time.Duration{owner: sessionLeaseTimeout, writer: timeoutThreshold} {
+		sc := fe.sessions.Get(uint64(sd.Descriptor)).(*sessionConn)
+		sc.aliveLock.Lock()
+		sc.lastKeepAlive = time.Now().Add(-age)
+		sc.aliveLock.Unlock()
+	}
+
+	setC := make(chan error, 1)
+	go func() {
+		ok, err := s.SetContent(NewRequestID(), writerNd, "contents", 0)
+		if err == nil && !ok {
+			err = fmt.Errorf("set content failed")
+		}
+		setC <- err
+	}()
+	for start := time.Now(); len(fe.fsm.GetUnfinalizedNodes()) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("set content never started")
+		}
+	}
+
+	closeC := make(chan error, 1)
+	go func() {
+		closeC <- closeOwner(fe, owner)
+	}()
+	select {
+	case err := <-closeC:
+		t.Fatal("owner closed while set content was in progress:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the watcher acks its invalidation, which lets the write finish and the close go ahead
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				s.KeepAlive(LeaseInfo{Session: watcher}, nil, 10*time.Millisecond)
+			}
+		}
+	}()
+
+	if err := <-setC; err != nil {
+		t.Error("unable to set content:", err)
+	}
+	if err := <-closeC; err != nil {
+		t.Error("unable to close owner:", err)
+	}
+	if ni := fe.fsm.GetNode("/foo/ephemeral"); ni != nil {
+		t.Error("ephemeral node not deleted with its owner")
+	}
+	if _, err := s.OpenSession(NewRequestID()); err != nil {
+		t.Error("unable to use the fsm after the close:", err)
+	}
+}
+
+func TestFrontendImpl_CloseSessionDuringSetContent(t *testing.T) {
+	doCloseOwnerDuringSetContent(t, func(fe *frontendImpl, owner SessionDescriptor) error {
+		return fe.CloseSession(NewRequestID(), owner)
+	})
+}
+
+func TestFrontendImpl_ReapSessionDuringSetContent(t *testing.T) {
+	doCloseOwnerDuringSetContent(t, func(fe *frontendImpl, owner SessionDescriptor) error {
+		// only the owner's lease has run out
+		fe.reapExpiredSessions()
+		if fe.fsm.GetSession(owner) != nil {
+			return fmt.Errorf("expired owner was not reaped")
+		}
+		return nil
+	})
+}
+
+func TestFrontendImpl_ExpireSessionDuringSetContent(t *testing.T) {
+	doCloseOwnerDuringSetContent(t, func(fe *frontendImpl, owner SessionDescriptor) error {
+		return fe.ExpireSession(owner)
+	})
+}
+
+func TestFrontendImpl_CloseNodeReleasesLock(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	holder, _ := s.OpenSession(NewRequestID())
+	holderNd, _ := s.Open(NewRequestID(), holder, "/foo/closed", false, false, EventsConfig{})
+	if ok, err := s.TryAcquire(NewRequestID(), holderNd); err != nil || !ok {
+		t.Fatal("unable to acquire lock:", err)
+	}
+
+	waiter, _ := s.OpenSession(NewRequestID())
+	waiterNd, _ := s.Open(NewRequestID(), waiter, "/foo/closed", false, false, EventsConfig{})
+	acquired := make(chan error, 1)
+	go func() { acquired <- s.Acquire(waiterNd) }()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		if locks := s.(Introspector).GetLocks(); len(locks) == 1 && len(locks[0].Waiters) == 1 {
+			break
+		}
+	}
+
+	if err := s.CloseNode(NewRequestID(), holderNd); err != nil {
+		t.Fatal("unable to close node:", err)
+	}
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Error("unable to acquire lock after its holder was closed:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("waiter not granted the lock after its holder was closed")
+	}
+}
+
+func TestFrontendImpl_LockDelay(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+	fe := s.(*frontendImpl)
+
+	lost, _ := s.OpenSession(NewRequestID())
+	lostNd, _ := s.Open(NewRequestID(), lost, "/foo/lockdelay", false, false, EventsConfig{})
+	if err := s.SetLockDelay(NewRequestID(), lostNd, 500*time.Millisecond); err != nil {
+		t.Fatal("unable to set lock delay:", err)
+	}
+	if ok, err := s.TryAcquire(NewRequestID(), lostNd); err != nil || !ok {
+		t.Fatal("unable to acquire lock:", err)
+	}
+
+	// make the holder look dead without its lease running out
+	sc := fe.sessions.Get(uint64(lost.Descriptor)).(*sessionConn)
+	sc.aliveLock.Lock()
+	sc.lastKeepAlive = time.Now().Add(-timeoutThreshold)
+	sc.aliveLock.Unlock()
+
+	other, _ := s.OpenSession(NewRequestID())
+	otherNd, _ := s.Open(NewRequestID(), other, "/foo/lockdelay", false, false, EventsConfig{})
+	if ok, err := s.TryAcquire(NewRequestID(), otherNd); err != nil || ok {
+		t.Error("acquired lock during lock delay:", err)
+	}
+	if nid := fe.fsm.GetNodeDescriptor(lostNd); nid.ni.locker != nil {
+		t.Error("lost holder still holds the lock")
+	}
+
+	start := time.Now()
+	if err := s.Acquire(otherNd); err != nil {
+		t.Error("unable to acquire lock after lock delay:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Error("waiter was not woken when the lock delay ran out, took:", elapsed)
+	}
+}
+
+func TestFrontendImpl_LockDelayFailover(t *testing.T) {
+	fsm, err := NewFSM()
+	if err != nil {
+		t.Fatal("unable to create fsm:", err)
+	}
+
+	// the old leader took the lock from a lost holder just before leadership moved
+	lost, _ := fsm.OpenSession(NoRequestID)
+	lostNd, _ := fsm.OpenNode(NoRequestID, lost, "/foo/lockdelay", false, false, EventsConfig{})
+	fsm.SetLockDelay(NoRequestID, lostNd, 500*time.Millisecond)
+	fsm.SetLocked(NoRequestID, lostNd)
+	fsm.ReleaseLock(NoRequestID, lostNd, time.Now())
+
+	stateC := make(chan ClusterState, 1)
+	stateC <- ClusterState{true, 1, ""}
+	s, err := NewFrontendWithFSM(fsm, stateC)
+	if err != nil {
+		t.Fatal("unable to create frontend with fsm:", err)
+	}
+	defer s.(*frontendImpl).Close()
+
+	other, _ := s.OpenSession(NewRequestID())
+	otherNd, _ := s.Open(NewRequestID(), other, "/foo/lockdelay", false, false, EventsConfig{})
+	if ok, err := s.TryAcquire(NewRequestID(), otherNd); err != nil || ok {
+		t.Error("new leader granted the lock during the old leader's lock delay:", err)
+	}
+	if locks := s.(Introspector).GetLocks(); len(locks) != 1 || locks[0].DelayedUntil.IsZero() {
+		t.Error("lock delay not shown by the new leader:", locks)
+	}
+
+	start := time.Now()
+	if err := s.Acquire(otherNd); err != nil {
+		t.Error("unable to acquire lock after lock delay:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Error("waiter was not woken when the lock delay ran out, took:", elapsed)
+	}
+}
+
+func TestFrontendImpl_Introspect(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+	in := s.(Introspector)
+
+	if cs := in.GetClusterState(); !cs.IsLeader {
+		t.Error("wrong cluster state:", cs)
+	}
+
+	holder, _ := s.OpenSession(NewRequestID())
+	holderNd, _ := s.Open(NewRequestID(), holder, "/foo/introspect", false, false, EventsConfig{})
+	if ok, err := s.TryAcquire(NewRequestID(), holderNd); err != nil || !ok {
+		t.Fatal("unable to acquire lock:", err)
+	}
+
+	waiter, _ := s.OpenSession(NewRequestID())
+	waiterNd, _ := s.Open(NewRequestID(), waiter, "/foo/introspect", true, false, EventsConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.(*frontendImpl).acquire(ctx, waiterNd, true)
+
+	sessions := in.GetSessions()
+	if len(sessions) != 2 || sessions[0].SD != holder || sessions[1].SD != waiter {
+		t.Fatal("wrong sessions:", sessions)
+	}
+	if sessions[0].LastKeepAlive.IsZero() {
+		t.Error("missing last keepalive:", sessions[0])
+	}
+	if ds := sessions[1].Descriptors; len(ds) != 1 || ds[0].ND != waiterNd || !ds[0].ReadOnly {
+		t.Error("wrong descriptors:", ds)
+	}
+	if si, ok := in.GetSession(uint64(waiter.Descriptor)); !ok || si.SD != waiter || len(si.Descriptors) != 1 {
+		t.Error("wrong session:", si, ok)
+	}
+	if si, ok := in.GetSession(1 << 40); ok {
+		t.Error("got missing session:", si)
+	}
+
+	// the waiter shows up once it has been queued
+	var locks []LockInfo
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		if locks = in.GetLocks(); len(locks) == 1 && len(locks[0].Waiters) == 1 {
+			break
+		}
+	}
+	if len(locks) != 1 || locks[0].Holder == nil || *locks[0].Holder != holderNd {
+		t.Fatal("wrong locks:", locks)
+	}
+	if ws := locks[0].Waiters; len(ws) != 1 || ws[0].ND != waiterNd || !ws[0].Shared {
+		t.Error("wrong waiters:", ws)
+	}
+
+	if cas, ok := in.GetNode("/foo/introspect"); !ok || cas.Stat.LockGeneration != 1 {
+		t.Error("wrong node:", cas, ok)
+	}
+	if _, ok := in.GetNode("/foo/missing"); ok {
+		t.Error("got missing node")
+	}
+}
+
+func TestFrontendImpl_IntrospectLocksReadOnly(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+	fe := s.(*frontendImpl)
+
+	sd, _ := s.OpenSession(NewRequestID())
+	nd, _ := s.Open(NewRequestID(), sd, "/foo/readonly", false, false, EventsConfig{})
+	if ok, err := s.TryAcquire(NewRequestID(), nd); err != nil || !ok {
+		t.Fatal("unable to acquire lock:", err)
+	}
+
+	// like a new leader, which knows about the held lock from the log but has no lock state for it yet
+	fe.lockLocks = NewAtomicStringMapWithDefault(func(string) interface{} { return &sync.Mutex{} })
+	fe.lockQueues = NewAtomicStringMapWithDefault(func(string) interface{} { return &lockQueue{} })
+
+	if locks := fe.GetLocks(); len(locks) != 1 || locks[0].Holder == nil || *locks[0].Holder != nd {
+		t.Error("wrong locks:", locks)
+	}
+	if keys := fe.lockLocks.Keys(); len(keys) != 0 {
+		t.Error("lock locks created by introspection:", keys)
+	}
+	if keys := fe.lockQueues.Keys(); len(keys) != 0 {
+		t.Error("lock queues created by introspection:", keys)
+	}
+}
+
+func TestFrontendImpl_ForceReleaseLock(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+	op := s.(Operator)
+
+	wedged, _ := s.OpenSession(NewRequestID())
+	wedgedNd, _ := s.Open(NewRequestID(), wedged, "/foo/forced", false, false, EventsConfig{})
+	if ok, err := s.TryAcquire(NewRequestID(), wedgedNd); err != nil || !ok {
+		t.Fatal("unable to acquire lock:", err)
+	}
+
+	if _, err := op.ForceReleaseLock("/foo/missing"); err != ErrNodeNotFound {
+		t.Error("expected node not found, got:", err)
+	}
+
+	other, _ := s.OpenSession(NewRequestID())
+	otherNd, _ := s.Open(NewRequestID(), other, "/foo/forced", false, false, EventsConfig{})
+	acquired := make(chan error)
+	go func() { acquired <- s.Acquire(otherNd) }()
+
+	nds, err := op.ForceReleaseLock("/foo/forced")
+	if err != nil || len(nds) != 1 || nds[0] != wedgedNd {
+		t.Fatal("wrong force release:", nds, err)
+	}
+	if err := <-acquired; err != nil {
+		t.Error("waiter didn't get the released lock:", err)
+	}
+
+	// the session that lost the lock is still alive and hears about it on its next keepalive
+	events, err := s.KeepAlive(LeaseInfo{Session: wedged}, nil, time.Second)
+	if err != nil || len(events) != 1 || events[0] != (LockInvalidationEvent{wedgedNd}) {
+		t.Error("expected lock invalidation event, got:", events, err)
+	}
+
+	s.Release(NewRequestID(), otherNd)
+	if _, err := op.ForceReleaseLock("/foo/forced"); err != ErrLockNotHeld {
+		t.Error("expected lock not held, got:", err)
+	}
+}
+
+func TestFrontendImpl_ExpireSession(t *testing.T) {
+	s, err := NewFrontend()
+	if err != nil {
+		t.Fatal("Unable to start server:", err)
+	}
+	defer s.(*frontendImpl).Close()
+	op := s.(Operator)
+
+	wedged, _ := s.OpenSession(NewRequestID())
+	wedgedNd, _ := s.Open(NewRequestID(), wedged, "/foo/expired", false, false, EventsConfig{})
+	if ok, err := s.TryAcquire(NewRequestID(), wedgedNd); err != nil || !ok {
+		t.Fatal("unable to acquire lock:", err)
+	}
+
+	// a keepalive in progress is what keeps a wedged session from being reaped, and gets the invalidation
+	keepAlive := make(chan []Event)
+	go func() {
+		events, _ := s.KeepAlive(LeaseInfo{Session: wedged}, nil, 5*time.Second)
+		keepAlive <- events
+	}()
+	for sc := s.(*frontendImpl).sessions.Get(uint64(wedged.Descriptor)).(*sessionConn); ; time.Sleep(time.Millisecond) {
+		if _, inKeepAlive := sc.KeepAliveState(); inKeepAlive {
+			break
+		}
+	}
+
+	if err := op.ExpireSession(wedged); err != nil {
+		t.Fatal("unable to expire session:", err)
+	}
+	if events := <-keepAlive; len(events) != 1 || events[0] != (LockInvalidationEvent{wedgedNd}) {
+		t.Error("expected lock invalidation event, got:", events)
+	}
+
+	if _, err := s.KeepAlive(LeaseInfo{Session: wedged}, nil, time.Millisecond); err != ErrInvalidSessionDescriptor {
+		t.Error("expected invalid session from KeepAlive on expired session, got:", err)
+	}
+	if err := op.ExpireSession(wedged); err != ErrInvalidSessionDescriptor {
+		t.Error("expected invalid session expiring it again, got:", err)
+	}
+
+	other, _ := s.OpenSession(NewRequestID())
+	otherNd, _ := s.Open(NewRequestID(), other, "/foo/expired", false, false, EventsConfig{})
+	if ok, err := s.TryAcquire(NewRequestID(), otherNd); err != nil || !ok {
+		t.Error("lock of expired session wasn't released:", err)
+	}
+}
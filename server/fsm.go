@@ -2,28 +2,70 @@ package server
 
 import (
 	"log"
+	"time"
 )
 
 // TODO: does this need a keepalive? where should keepalive information live? maybe just the front end?
+// the methods that change the state return an error if the change could not be replicated, in which case it
+// may or may not have been applied. the ones that take a RequestID apply each request at most once, returning
+// the result from the first time if the same request is applied again.
 type FSM interface {
-	OpenSession() SessionDescriptor
-	CloseSession(sd SessionDescriptor)
+	OpenSession(id RequestID) (SessionDescriptor, error)
+	CloseSession(id RequestID, sd SessionDescriptor) error
 	GetSession(sd SessionDescriptor) *clientSession
 	GetSessionDescriptors() []SessionDescriptor
 
-	OpenNode(sd SessionDescriptor, path string, readOnly bool, config EventsConfig) NodeDescriptor
-	CloseNode(nd NodeDescriptor)
+	OpenNode(id RequestID, sd SessionDescriptor, path string, readOnly bool, ephemeral bool, config EventsConfig) (NodeDescriptor, error)
+	CloseNode(id RequestID, nd NodeDescriptor) error
+	DeleteNode(id RequestID, nd NodeDescriptor) (bool, error)
 	GetNodeDescriptor(nd NodeDescriptor) *nodeDescriptor
 	GetUnfinalizedNodes() []*nodeInfo
+	GetLockedNodes() []*nodeInfo
+	GetLockDelayedNodes() []*nodeInfo
+	GetNode(path string) *nodeInfo
+	GetEphemeralNodes(sd SessionDescriptor) []string
+	ListChildren(dir string) []DirEntry
 
-	SetLocked(nd NodeDescriptor)
-	ReleaseLock(nd NodeDescriptor) bool
+	SetLocked(id RequestID, nd NodeDescriptor) error
+	SetSharedLocked(id RequestID, nd NodeDescriptor) error
+	// ReleaseLock releases the lock held through nd. lost is when its holder was lost, which starts the node's
+	// lock-delay, or zero if the holder released the lock itself.
+	ReleaseLock(id RequestID, nd NodeDescriptor, lost time.Time) (bool, error)
+	SetLockDelay(id RequestID, nd NodeDescriptor, delay time.Duration) (bool, error)
+	GetSequencer(nd NodeDescriptor) (Sequencer, bool)
+	CheckSequencer(seq Sequencer) bool
 
 	GetContentAndStat(nd NodeDescriptor) NodeContentAndStat
-	PrepareSetContent(nd NodeDescriptor, cas NodeContentAndStat) bool
-	FinalizeSetContent(path string)
+	PrepareSetContent(id RequestID, nd NodeDescriptor, cas NodeContentAndStat) (bool, error)
+	FinalizeSetContent(path string) error
 
-	Nop(garbage int)
+	Nop(garbage int) error
+
+	// GetStats counts the sessions, descriptors, nodes and held locks
+	GetStats() FSMStats
+
+	// GetRequestResult returns what request id from sd returned if it has already been applied. requests that
+	// open or close a session are looked up with the zero SessionDescriptor.
+	GetRequestResult(sd SessionDescriptor, id RequestID) (requestResult, bool)
+
+	// ReadBarrier blocks until the fsm reflects every change that was committed anywhere in the cluster before
+	// it was called, so that the reads after it are linearizable
+	ReadBarrier() error
+	// AbortProposals fails the changes that are still waiting to be replicated with ErrLeadershipLost
+	AbortProposals()
+
+	GetSnapshot() ([]byte, error)
+	RecoverFromSnapshot(data []byte) error
+}
+
+// FSMStats counts the replicated state of an fsm
+type FSMStats struct {
+	Sessions    int
+	Descriptors int
+	Nodes       int
+	// locks held in exclusive mode, and in shared mode by at least one descriptor
+	ExclusiveLocks int
+	SharedLocks    int
 }
 
 type fsmImpl struct {
@@ -38,13 +80,37 @@ func NewFSM() (FSM, error) {
 	}, nil
 }
 
-func (fsm *fsmImpl) OpenSession() SessionDescriptor {
-	key := fsm.sessions.OpenSession()
-	return SessionDescriptor{Descriptor: key}
+func (fsm *fsmImpl) OpenSession(id RequestID) (SessionDescriptor, error) {
+	result := fsm.applyRequest(SessionDescriptor{}, id, func() requestResult {
+		key := fsm.sessions.OpenSession()
+		return requestResult{SD: SessionDescriptor{Descriptor: key}}
+	})
+	return result.SD, nil
 }
 
-func (fsm *fsmImpl) CloseSession(sd SessionDescriptor) {
-	fsm.sessions.CloseSession(sd)
+func (fsm *fsmImpl) CloseSession(id RequestID, sd SessionDescriptor) error {
+	result := fsm.applyRequest(SessionDescriptor{}, id, func() requestResult {
+		if fsm.sessions.GetSession(sd.Descriptor) == nil {
+			return requestResult{}
+		}
+
+		// ephemeral nodes only live as long as the session that created them
+		for _, path := range fsm.nodes.GetEphemeralNodes(sd.Descriptor) {
+			fsm.deleteNode(path)
+		}
+
+		// nobody could ever release the session's locks once it is gone
+		for _, nd := range fsm.sessions.GetSession(sd.Descriptor).GetDescriptors() {
+			nd.ni.Release(nd)
+		}
+
+		fsm.sessions.CloseSession(sd)
+		return requestResult{OK: true}
+	})
+	if !result.OK {
+		return ErrInvalidSessionDescriptor
+	}
+	return nil
 }
 
 func (fsm *fsmImpl) GetSession(sd SessionDescriptor) *clientSession {
@@ -62,26 +128,61 @@ func (fsm *fsmImpl) GetSessionDescriptors() []SessionDescriptor {
 	return sds
 }
 
-func (fsm *fsmImpl) OpenNode(sd SessionDescriptor, path string, readOnly bool, config EventsConfig) NodeDescriptor {
-	session := fsm.sessions.GetSession(sd.Descriptor)
+func (fsm *fsmImpl) OpenNode(id RequestID, sd SessionDescriptor, path string, readOnly bool, ephemeral bool, config EventsConfig) (NodeDescriptor, error) {
+	result := fsm.applyRequest(sd, id, func() requestResult {
+		session := fsm.sessions.GetSession(sd.Descriptor)
 
-	ni := fsm.nodes.GetOrCreateNode(path)
-	key := session.OpenDescriptor(ni, readOnly, config)
-	return NodeDescriptor{
-		Session:    sd,
-		Descriptor: key,
-		Path:       path,
-	}
+		var ni *nodeInfo
+		if ephemeral {
+			ni = fsm.nodes.GetOrCreateEphemeralNode(path, sd.Descriptor)
+		} else {
+			ni = fsm.nodes.GetOrCreateNode(path)
+		}
+		key := session.OpenDescriptor(ni, readOnly, config)
+		return requestResult{ND: NodeDescriptor{
+			Session:    sd,
+			Descriptor: key,
+			Path:       path,
+		}}
+	})
+	return result.ND, nil
 }
 
-func (fsm *fsmImpl) CloseNode(nd NodeDescriptor) {
-	session := fsm.sessions.GetSession(nd.Session.Descriptor)
-	if session == nil {
-		log.Println("trying to delete descriptor from null session!")
-		return
-	}
+func (fsm *fsmImpl) CloseNode(id RequestID, nd NodeDescriptor) error {
+	fsm.applyRequest(nd.Session, id, func() requestResult {
+		session := fsm.sessions.GetSession(nd.Session.Descriptor)
+		if session == nil {
+			log.Println("trying to delete descriptor from null session!")
+			return requestResult{}
+		}
 
-	session.CloseDescriptor(nd.Descriptor)
+		// nobody could ever release a lock held through the descriptor once it is closed
+		if nid := session.GetDescriptor(nd.Descriptor); nid != nil {
+			nid.ni.Release(nid)
+		}
+		session.CloseDescriptor(nd.Descriptor)
+		return requestResult{OK: true}
+	})
+	return nil
+}
+
+func (fsm *fsmImpl) DeleteNode(id RequestID, nd NodeDescriptor) (bool, error) {
+	result := fsm.applyRequest(nd.Session, id, func() requestResult {
+		nid := fsm.sessions.GetDescriptor(nd)
+		if nid == nil {
+			log.Println("fsm.DeleteNode got invalid node descriptor:", nd)
+			return requestResult{}
+		}
+
+		fsm.deleteNode(nid.ni.path)
+		return requestResult{OK: true}
+	})
+	return result.OK, nil
+}
+
+func (fsm *fsmImpl) deleteNode(path string) {
+	fsm.sessions.CloseDescriptors(path)
+	fsm.nodes.DeleteNode(path)
 }
 
 func (fsm *fsmImpl) GetNodeDescriptor(nd NodeDescriptor) *nodeDescriptor {
@@ -92,24 +193,104 @@ func (fsm *fsmImpl) GetUnfinalizedNodes() []*nodeInfo {
 	return fsm.nodes.GetUnfinalizedNodes()
 }
 
-func (fsm *fsmImpl) SetLocked(nd NodeDescriptor) {
+func (fsm *fsmImpl) GetLockedNodes() []*nodeInfo {
+	return fsm.nodes.GetLockedNodes()
+}
+
+func (fsm *fsmImpl) GetLockDelayedNodes() []*nodeInfo {
+	return fsm.nodes.GetLockDelayedNodes(time.Now())
+}
+
+func (fsm *fsmImpl) GetNode(path string) *nodeInfo {
+	return fsm.nodes.GetNode(path)
+}
+
+func (fsm *fsmImpl) GetEphemeralNodes(sd SessionDescriptor) []string {
+	return fsm.nodes.GetEphemeralNodes(sd.Descriptor)
+}
+
+func (fsm *fsmImpl) ListChildren(dir string) []DirEntry {
+	return fsm.nodes.ListChildren(dir)
+}
+
+func (fsm *fsmImpl) SetLocked(id RequestID, nd NodeDescriptor) error {
+	fsm.applyRequest(nd.Session, id, func() requestResult {
+		nid := fsm.sessions.GetDescriptor(nd)
+		if nid == nil {
+			log.Println("fsm.TryAcquire got invalid node descriptor:", nd)
+			return requestResult{}
+		}
+
+		nid.ni.SetLocked(nid)
+		return requestResult{OK: true}
+	})
+	return nil
+}
+
+func (fsm *fsmImpl) SetSharedLocked(id RequestID, nd NodeDescriptor) error {
+	fsm.applyRequest(nd.Session, id, func() requestResult {
+		nid := fsm.sessions.GetDescriptor(nd)
+		if nid == nil {
+			log.Println("fsm.SetSharedLocked got invalid node descriptor:", nd)
+			return requestResult{}
+		}
+
+		nid.ni.SetSharedLocked(nid)
+		return requestResult{OK: true}
+	})
+	return nil
+}
+
+func (fsm *fsmImpl) ReleaseLock(id RequestID, nd NodeDescriptor, lost time.Time) (bool, error) {
+	result := fsm.applyRequest(nd.Session, id, func() requestResult {
+		nid := fsm.sessions.GetDescriptor(nd)
+		if nid == nil {
+			log.Println("fsm.Release got invalid node descriptor:", nd)
+			return requestResult{}
+		}
+
+		if err := nid.ni.Release(nid); err != nil {
+			return requestResult{}
+		}
+		if !lost.IsZero() {
+			nid.ni.StartLockDelay(lost)
+		}
+		return requestResult{OK: true}
+	})
+	return result.OK, nil
+}
+
+func (fsm *fsmImpl) SetLockDelay(id RequestID, nd NodeDescriptor, delay time.Duration) (bool, error) {
+	result := fsm.applyRequest(nd.Session, id, func() requestResult {
+		nid := fsm.sessions.GetDescriptor(nd)
+		if nid == nil {
+			log.Println("fsm.SetLockDelay got invalid node descriptor:", nd)
+			return requestResult{}
+		}
+
+		nid.ni.SetLockDelay(delay)
+		return requestResult{OK: true}
+	})
+	return result.OK, nil
+}
+
+func (fsm *fsmImpl) GetSequencer(nd NodeDescriptor) (Sequencer, bool) {
 	nid := fsm.sessions.GetDescriptor(nd)
 	if nid == nil {
-		log.Println("fsm.TryAcquire got invalid node descriptor:", nd)
-		return
+		log.Println("fsm.GetSequencer got invalid node descriptor:", nd)
+		return Sequencer{}, false
 	}
 
-	nid.ni.SetLocked(nid)
+	return nid.ni.GetSequencer(nid)
 }
 
-func (fsm *fsmImpl) ReleaseLock(nd NodeDescriptor) bool {
-	nid := fsm.sessions.GetDescriptor(nd)
-	if nid == nil {
-		log.Println("fsm.Release got invalid node descriptor:", nd)
+func (fsm *fsmImpl) CheckSequencer(seq Sequencer) bool {
+	ni := fsm.nodes.GetNode(seq.Path)
+	if ni == nil {
 		return false
 	}
 
-	return nid.ni.Release(nid) == nil
+	return ni.CheckSequencer(seq)
 }
 
 func (fsm *fsmImpl) GetContentAndStat(nd NodeDescriptor) NodeContentAndStat {
@@ -122,26 +303,83 @@ func (fsm *fsmImpl) GetContentAndStat(nd NodeDescriptor) NodeContentAndStat {
 	return nid.ni.GetContentAndStat()
 }
 
-func (fsm *fsmImpl) PrepareSetContent(nd NodeDescriptor, cas NodeContentAndStat) bool {
-	nid := fsm.sessions.GetDescriptor(nd)
-	if nid == nil {
-		log.Println("fsm.GetContentAndStat got invalid node descriptor:", nd)
-		return false
-	}
+func (fsm *fsmImpl) PrepareSetContent(id RequestID, nd NodeDescriptor, cas NodeContentAndStat) (bool, error) {
+	result := fsm.applyRequest(nd.Session, id, func() requestResult {
+		nid := fsm.sessions.GetDescriptor(nd)
+		if nid == nil {
+			log.Println("fsm.GetContentAndStat got invalid node descriptor:", nd)
+			return requestResult{}
+		}
 
-	// TODO: fix this to use cas.Stat.LastModified?
-	return nid.ni.SetContent(cas.Content, cas.Stat.Generation)
+		// TODO: fix this to use cas.Stat.LastModified?
+		return requestResult{OK: nid.ni.SetContent(cas.Content, cas.Stat.Generation)}
+	})
+	return result.OK, nil
 }
 
-func (fsm *fsmImpl) FinalizeSetContent(path string) {
+func (fsm *fsmImpl) FinalizeSetContent(path string) error {
 	ni := fsm.nodes.GetNode(path)
 	if ni == nil {
-		log.Println("fsm.GetContentAndStat got invalid node info:", path)
+		// the entry is already committed, so a node deleted in the meantime has to be skipped on every replica
+		log.Println("fsm.FinalizeSetContent got invalid node info:", path)
+		return nil
 	}
 
 	// TODO: include generation somehow?
 	ni.FinalizeSetContent()
+	return nil
+}
+
+func (fsm *fsmImpl) Nop(garbage int) error {
+	return nil
+}
+
+func (fsm *fsmImpl) GetStats() FSMStats {
+	var stats FSMStats
+	stats.Sessions, stats.Descriptors = fsm.sessions.stats()
+	stats.Nodes, stats.ExclusiveLocks, stats.SharedLocks = fsm.nodes.stats()
+	return stats
+}
+
+// requestsFor returns where the results of sd's requests are remembered, which is nil if sd is closed
+func (fsm *fsmImpl) requestsFor(sd SessionDescriptor) *requestHistory {
+	if sd == (SessionDescriptor{}) {
+		return fsm.sessions.requests
+	}
+
+	session := fsm.sessions.GetSession(sd.Descriptor)
+	if session == nil {
+		return nil
+	}
+	return session.requests
+}
+
+func (fsm *fsmImpl) GetRequestResult(sd SessionDescriptor, id RequestID) (requestResult, bool) {
+	if id == NoRequestID {
+		return requestResult{}, false
+	}
+	return fsm.requestsFor(sd).Get(id)
+}
+
+// applyRequest calls apply unless request id from sd was applied before, in which case it returns the result
+// from then instead
+func (fsm *fsmImpl) applyRequest(sd SessionDescriptor, id RequestID, apply func() requestResult) requestResult {
+	if result, ok := fsm.GetRequestResult(sd, id); ok {
+		return result
+	}
+
+	result := apply()
+	if id != NoRequestID {
+		fsm.requestsFor(sd).Put(id, result)
+	}
+	return result
+}
+
+// ReadBarrier returns immediately because the changes to a local fsm are applied before they return
+func (fsm *fsmImpl) ReadBarrier() error {
+	return nil
 }
 
-func (fsm *fsmImpl) Nop(garbage int) {
+// AbortProposals does nothing because the changes to a local fsm are applied immediately
+func (fsm *fsmImpl) AbortProposals() {
 }
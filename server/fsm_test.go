@@ -1,8 +1,12 @@
 package server
 
 import (
+	"fmt"
 	"math"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 func BenchmarkFsmImpl_SetContent(b *testing.B) {
@@ -11,8 +15,8 @@ func BenchmarkFsmImpl_SetContent(b *testing.B) {
 		b.Fatal("unable to create fsm")
 	}
 
-	sd := fsm.OpenSession()
-	nd := fsm.OpenNode(sd, "/foo/bar", false, EventsConfig{})
+	sd, _ := fsm.OpenSession(NoRequestID)
+	nd, _ := fsm.OpenNode(NoRequestID, sd, "/foo/bar", false, false, EventsConfig{})
 
 	cas := NodeContentAndStat{
 		Content: "some content",
@@ -22,7 +26,7 @@ func BenchmarkFsmImpl_SetContent(b *testing.B) {
 	}
 
 	// initial set content to check correctness
-	fsm.PrepareSetContent(nd, cas)
+	fsm.PrepareSetContent(NoRequestID, nd, cas)
 	getCas := fsm.GetContentAndStat(nd)
 	if cas.Content != getCas.Content {
 		b.Error("set content failed")
@@ -31,7 +35,7 @@ func BenchmarkFsmImpl_SetContent(b *testing.B) {
 	cas.Content = "some other content"
 
 	for n := 0; n < b.N; n++ {
-		fsm.PrepareSetContent(nd, cas)
+		fsm.PrepareSetContent(NoRequestID, nd, cas)
 	}
 
 	getCas2 := fsm.GetContentAndStat(nd)
@@ -46,8 +50,8 @@ func BenchmarkFsmImpl_SetContentNoOp(b *testing.B) {
 		b.Fatal("unable to create fsm")
 	}
 
-	sd := fsm.OpenSession()
-	nd := fsm.OpenNode(sd, "/foo/bar", false, EventsConfig{})
+	sd, _ := fsm.OpenSession(NoRequestID)
+	nd, _ := fsm.OpenNode(NoRequestID, sd, "/foo/bar", false, false, EventsConfig{})
 
 	cas := NodeContentAndStat{
 		Content: "some content",
@@ -57,7 +61,7 @@ func BenchmarkFsmImpl_SetContentNoOp(b *testing.B) {
 	}
 
 	// initial set content to check correctness
-	fsm.PrepareSetContent(nd, cas)
+	fsm.PrepareSetContent(NoRequestID, nd, cas)
 	getCas := fsm.GetContentAndStat(nd)
 	if cas.Content != getCas.Content {
 		b.Error("set content failed")
@@ -66,7 +70,7 @@ func BenchmarkFsmImpl_SetContentNoOp(b *testing.B) {
 	cas.Content = "some other content"
 
 	for n := 0; n < b.N; n++ {
-		fsm.PrepareSetContent(nd, cas)
+		fsm.PrepareSetContent(NoRequestID, nd, cas)
 	}
 
 	getCas2 := fsm.GetContentAndStat(nd)
@@ -74,3 +78,553 @@ func BenchmarkFsmImpl_SetContentNoOp(b *testing.B) {
 		b.Error("looped set content failed")
 	}
 }
+
+func TestFsmImpl_SnapshotRoundTrip(t *testing.T) {
+	fsm, err := NewFSM()
+	if err != nil {
+		t.Fatal("unable to create fsm:", err)
+	}
+
+	sd, _ := fsm.OpenSession(NoRequestID)
+	nd1, _ := fsm.OpenNode(NoRequestID, sd, "/foo/bar", false, false, EventsConfig{ContentModified: true})
+	nd2, _ := fsm.OpenNode(NoRequestID, sd, "/foo/baz", true, false, EventsConfig{})
+	fsm.SetLocked(NoRequestID, nd1)
+	fsm.SetSharedLocked(NoRequestID, nd2)
+	fsm.PrepareSetContent(NoRequestID, nd1, NodeContentAndStat{Content: "some content"})
+	delayed, _ := fsm.OpenNode(NoRequestID, sd, "/foo/delayed", false, false, EventsConfig{})
+	fsm.SetLockDelay(NoRequestID, delayed, time.Minute)
+	fsm.SetLocked(NoRequestID, delayed)
+	fsm.ReleaseLock(NoRequestID, delayed, time.Now())
+	closedSD, _ := fsm.OpenSession(NoRequestID)
+	fsm.CloseSession(NoRequestID, closedSD)
+
+	data, err := fsm.GetSnapshot()
+	if err != nil {
+		t.Fatal("unable to get snapshot:", err)
+	}
+
+	restored, err := NewFSM()
+	if err != nil {
+		t.Fatal("unable to create fsm:", err)
+	}
+	if err := restored.RecoverFromSnapshot(data); err != nil {
+		t.Fatal("unable to recover from snapshot:", err)
+	}
+
+	if sds := restored.GetSessionDescriptors(); len(sds) != 1 || sds[0] != sd {
+		t.Error("wrong sessions after restore:", sds)
+	}
+
+	nid1 := restored.GetNodeDescriptor(nd1)
+	if nid1 == nil {
+		t.Fatal("descriptor not restored:", nd1)
+	}
+	if !nid1.config.ContentModified || nid1.readOnly {
+		t.Error("descriptor settings not restored:", nid1.config, nid1.readOnly)
+	}
+	if nid1.ni.locker != nid1 {
+		t.Error("locker not restored")
+	}
+	if nid1.ni.finalized {
+		t.Error("finalized flag not restored")
+	}
+	if end := restored.GetNode("/foo/delayed").GetLockDelayEnd(); !end.Equal(fsm.GetNode("/foo/delayed").GetLockDelayEnd()) {
+		t.Error("lock delay not restored:", end)
+	}
+	if cas := restored.GetContentAndStat(nd1); cas.Content != "some content" || cas.Stat.Generation != 1 {
+		t.Error("content not restored:", cas)
+	}
+
+	if nid2 := restored.GetNodeDescriptor(nd2); nid2 == nil || !nid2.readOnly {
+		t.Error("read only descriptor not restored:", nid2)
+	} else if held, shared := nid2.ni.GetLockMode(nid2); !held || !shared {
+		t.Error("shared locker not restored")
+	}
+	if seq, ok := fsm.GetSequencer(nd2); !ok || !seq.Shared {
+		t.Error("no shared sequencer before snapshot:", seq)
+	} else if restoredSeq, ok := restored.GetSequencer(nd2); !ok || restoredSeq != seq {
+		t.Error("shared sequencer not restored:", restoredSeq, seq)
+	}
+
+	// new sessions and descriptors must not reuse keys from before the snapshot
+	if newSD, _ := restored.OpenSession(NoRequestID); newSD.Descriptor <= closedSD.Descriptor {
+		t.Error("session key reused after restore:", newSD)
+	}
+	if newND, _ := restored.OpenNode(NoRequestID, sd, "/foo/bar", false, false, EventsConfig{}); newND.Descriptor <= nd2.Descriptor {
+		t.Error("descriptor key reused after restore:", newND)
+	}
+}
+
+func TestFsmImpl_SnapshotAfterCloseNode(t *testing.T) {
+	// the replica that applies the log and the one restored from its snapshot must agree on who holds the locks
+	replayed, err := NewFSM()
+	if err != nil {
+		t.Fatal("unable to create fsm:", err)
+	}
+
+	sd, _ := replayed.OpenSession(NoRequestID)
+	exclusive, _ := replayed.OpenNode(NoRequestID, sd, "/foo/exclusive", false, false, EventsConfig{})
+	shared, _ := replayed.OpenNode(NoRequestID, sd, "/foo/shared", true, false, EventsConfig{})
+	other, _ := replayed.OpenNode(NoRequestID, sd, "/foo/shared", true, false, EventsConfig{})
+	replayed.SetLocked(NoRequestID, exclusive)
+	replayed.SetSharedLocked(NoRequestID, shared)
+	replayed.SetSharedLocked(NoRequestID, other)
+	replayed.CloseNode(NoRequestID, exclusive)
+	replayed.CloseNode(NoRequestID, shared)
+
+	data, err := replayed.GetSnapshot()
+	if err != nil {
+		t.Fatal("unable to get snapshot:", err)
+	}
+	restored, err := NewFSM()
+	if err != nil {
+		t.Fatal("unable to create fsm:", err)
+	}
+	if err := restored.RecoverFromSnapshot(data); err != nil {
+		t.Fatal("unable to recover from snapshot:", err)
+	}
+
+	for name, fsm := range map[string]FSM{"replayed": replayed, "restored": restored} {
+		if ni := fsm.GetNode("/foo/exclusive"); ni == nil {
+			t.Errorf("%s: node missing", name)
+		} else if locker, sharedLockers := ni.GetLockers(); locker != nil || len(sharedLockers) != 0 {
+			t.Errorf("%s: lock still held through a closed descriptor: %v %v", name, locker, sharedLockers)
+		}
+
+		if ni := fsm.GetNode("/foo/shared"); ni == nil {
+			t.Errorf("%s: node missing", name)
+		} else if locker, sharedLockers := ni.GetLockers(); locker != nil || len(sharedLockers) != 1 || sharedLockers[0].GetND() != other {
+			t.Errorf("%s: wrong shared holders: %v %v", name, locker, sharedLockers)
+		}
+
+		if stats := fsm.GetStats(); stats.ExclusiveLocks != 0 || stats.SharedLocks != 1 {
+			t.Errorf("%s: wrong lock stats: %+v", name, stats)
+		}
+	}
+}
+
+func TestFsmImpl_ListChildren(t *testing.T) {
+	fsm, err := NewFSM()
+	if err != nil {
+		t.Fatal("unable to create fsm:", err)
+	}
+
+	sd, _ := fsm.OpenSession(NoRequestID)
+	fsm.OpenNode(NoRequestID, sd, "/foo", false, false, EventsConfig{})
+	nd, _ := fsm.OpenNode(NoRequestID, sd, "/foo/bar/baz", false, false, EventsConfig{})
+	fsm.PrepareSetContent(NoRequestID, nd, NodeContentAndStat{Content: "some content"})
+
+	if entries := fsm.ListChildren("/"); len(entries) != 1 || entries[0].Name != "foo" {
+		t.Error("wrong entries for /:", entries)
+	}
+	if entries := fsm.ListChildren("/foo/bar"); len(entries) != 1 || entries[0].Stat.Generation != 1 {
+		t.Error("wrong entries for /foo/bar:", entries)
+	}
+
+	// deleting the only node under /foo/bar should remove the implicit directory, but not /foo itself
+	fsm.DeleteNode(NoRequestID, nd)
+	if entries := fsm.ListChildren("/foo"); len(entries) != 0 {
+		t.Error("implicit directory not removed:", entries)
+	}
+	if entries := fsm.ListChildren("/"); len(entries) != 1 || entries[0].Name != "foo" {
+		t.Error("explicit node removed with its children:", entries)
+	}
+}
+
+func TestFsmImpl_CloseUnknownSession(t *testing.T) {
+	proposeC := make(chan string)
+	committedC := make(chan *string)
+	go func() {
+		for s := range proposeC {
+			s := s
+			committedC <- &s
+		}
+	}()
+	local, err := NewFSM()
+	if err != nil {
+		t.Fatal("unable to create fsm:", err)
+	}
+
+	for name, fsm := range map[string]FSM{"local": local, "raft": newTestRaftFSM(t, proposeC, committedC)} {
+		sd, _ := fsm.OpenSession(NoRequestID)
+		fsm.OpenNode(NoRequestID, sd, "/foo/permanent", false, false, EventsConfig{})
+
+		// permanent nodes have the zero owner, which must not make them the ephemeral nodes of an unknown session
+		for _, bogus := range []SessionDescriptor{{}, {Descriptor: 1 << 40}} {
+			if err := fsm.CloseSession(NewRequestID(), bogus); err != ErrInvalidSessionDescriptor {
+				t.Error(name, "expected invalid session closing", bogus, "got:", err)
+			}
+		}
+		if fsm.GetNode("/foo/permanent") == nil {
+			t.Error(name, "permanent node deleted by closing an unknown session")
+		}
+	}
+}
+
+func TestFsmImpl_GetStats(t *testing.T) {
+	fsm, err := NewFSM()
+	if err != nil {
+		t.Fatal("unable to create fsm:", err)
+	}
+
+	sd1, _ := fsm.OpenSession(NoRequestID)
+	sd2, _ := fsm.OpenSession(NoRequestID)
+	nd1, _ := fsm.OpenNode(NoRequestID, sd1, "/foo", false, false, EventsConfig{})
+	fsm.OpenNode(NoRequestID, sd1, "/bar", false, false, EventsConfig{})
+	nd2, _ := fsm.OpenNode(NoRequestID, sd2, "/bar", true, false, EventsConfig{})
+	fsm.SetLocked(NoRequestID, nd1)
+	fsm.SetSharedLocked(NoRequestID, nd2)
+
+	expected := FSMStats{Sessions: 2, Descriptors: 3, Nodes: 2, ExclusiveLocks: 1, SharedLocks: 1}
+	if stats := fsm.GetStats(); stats != expected {
+		t.Errorf("wrong stats: %+v != %+v", stats, expected)
+	}
+
+	// closing a session releases its locks along with its descriptors
+	fsm.CloseSession(NoRequestID, sd1)
+	expected = FSMStats{Sessions: 1, Descriptors: 1, Nodes: 2, ExclusiveLocks: 0, SharedLocks: 1}
+	if stats := fsm.GetStats(); stats != expected {
+		t.Errorf("wrong stats after closing session: %+v != %+v", stats, expected)
+	}
+}
+
+func TestFsmImpl_RequestHistory(t *testing.T) {
+	fsm, err := NewFSM()
+	if err != nil {
+		t.Fatal("unable to create fsm:", err)
+	}
+
+	openID := NewRequestID()
+	sd, _ := fsm.OpenSession(openID)
+	if retried, _ := fsm.OpenSession(openID); retried != sd {
+		t.Error("retried open session not deduplicated:", retried, sd)
+	}
+
+	nd, _ := fsm.OpenNode(NoRequestID, sd, "/foo/bar", false, false, EventsConfig{})
+	setID := NewRequestID()
+	for i := 0; i < 2; i++ {
+		if ok, _ := fsm.PrepareSetContent(setID, nd, NodeContentAndStat{Content: "some content"}); !ok {
+			t.Error("retried set content failed on attempt", i)
+		}
+	}
+	if cas := fsm.GetContentAndStat(nd); cas.Stat.Generation != 1 {
+		t.Error("retried set content applied twice:", cas)
+	}
+
+	// requests without an id are never deduplicated
+	if other, _ := fsm.OpenSession(NoRequestID); other == sd {
+		t.Error("open session without a request id was deduplicated")
+	}
+
+	// the history survives snapshots, since a retry can reach a replica that was restored from one
+	data, err := fsm.GetSnapshot()
+	if err != nil {
+		t.Fatal("unable to get snapshot:", err)
+	}
+	restored, _ := NewFSM()
+	if err := restored.RecoverFromSnapshot(data); err != nil {
+		t.Fatal("unable to recover from snapshot:", err)
+	}
+	if result, ok := restored.GetRequestResult(SessionDescriptor{}, openID); !ok || result.SD != sd {
+		t.Error("open session request not restored:", result, ok)
+	}
+	if result, ok := restored.GetRequestResult(sd, setID); !ok || !result.OK {
+		t.Error("set content request not restored:", result, ok)
+	}
+
+	// only the most recent requests are remembered
+	for i := 0; i < requestHistorySize; i++ {
+		fsm.SetLockDelay(NewRequestID(), nd, time.Second)
+	}
+	if _, ok := fsm.GetRequestResult(sd, setID); ok {
+		t.Error("oldest request not forgotten")
+	}
+}
+
+func newTestRaftFSM(t *testing.T, proposeC chan string, committedC chan *string) *raftFSMImpl {
+	delegate, err := NewFSM()
+	if err != nil {
+		t.Fatal("unable to create fsm:", err)
+	}
+
+	return NewRaftFSM(proposeC, committedC, nil, delegate).(*raftFSMImpl)
+}
+
+func TestRaftFSM_AcksDeleted(t *testing.T) {
+	proposeC := make(chan string)
+	committedC := make(chan *string)
+	go func() {
+		for s := range proposeC {
+			s := s
+			committedC <- &s
+		}
+	}()
+	fsm := newTestRaftFSM(t, proposeC, committedC)
+
+	if _, err := fsm.OpenSession(NoRequestID); err != nil {
+		t.Fatal("unable to open session:", err)
+	}
+	if keys := fsm.acks.Keys(); len(keys) != 0 {
+		t.Error("ack not deleted after delivery:", keys)
+	}
+}
+
+func TestRaftFSM_ProposalIDsUnique(t *testing.T) {
+	// members of a cluster each ack the entries they apply by id, so their ids mustn't overlap
+	ids := make(map[uint64]bool)
+	for i := 0; i < 3; i++ {
+		fsm := newTestRaftFSM(t, make(chan string), make(chan *string))
+		for j := 0; j < 3; j++ {
+			id := fsm.nextId()
+			if ids[id] {
+				t.Fatal("proposal id used by two fsms:", id)
+			}
+			ids[id] = true
+		}
+	}
+}
+
+func TestRaftFSM_ProposalTimeout(t *testing.T) {
+	// nothing ever commits the proposals, as if raft had dropped them
+	proposeC := make(chan string, 10)
+	fsm := newTestRaftFSM(t, proposeC, make(chan *string))
+	fsm.proposalTimeout = 50 * time.Millisecond
+
+	if _, err := fsm.OpenSession(NoRequestID); err != ErrProposalTimeout {
+		t.Error("expected proposal timeout, got:", err)
+	}
+	if keys := fsm.acks.Keys(); len(keys) != 0 {
+		t.Error("ack not deleted after timeout:", keys)
+	}
+}
+
+func TestRaftFSM_AbortProposals(t *testing.T) {
+	proposeC := make(chan string)
+	committedC := make(chan *string)
+	fsm := newTestRaftFSM(t, proposeC, committedC)
+
+	errC := make(chan error)
+	go func() {
+		errC <- fsm.Nop(0)
+	}()
+
+	// leadership is lost after the proposal has been made but before it commits
+	proposal := <-proposeC
+	fsm.AbortProposals()
+
+	select {
+	case err := <-errC:
+		if err != ErrLeadershipLost {
+			t.Error("expected leadership lost, got:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("proposal not aborted")
+	}
+	if keys := fsm.acks.Keys(); len(keys) != 0 {
+		t.Error("ack not deleted after abort:", keys)
+	}
+
+	// the proposal may still commit later, which mustn't block the log
+	committedC <- &proposal
+	if _, err := fsm.GetSnapshot(); err != nil {
+		t.Error("unable to snapshot after late commit:", err)
+	}
+}
+
+func TestRaftFSM_Stop(t *testing.T) {
+	// nothing takes the proposal off proposeC, so it's stuck in proposeBatches
+	committedC := make(chan *string)
+	fsm := newTestRaftFSM(t, make(chan string), committedC)
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- fsm.Nop(0)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// raft closes the commit channel when it stops
+	close(committedC)
+	select {
+	case err := <-errC:
+		if err != ErrFSMStopped {
+			t.Error("expected fsm stopped, got:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending proposal not failed when the fsm stopped")
+	}
+
+	// collectBatches has exited, so nothing takes new proposals either
+	select {
+	case fsm.batchC <- (&OpenSessionProposal{}).Wrap():
+		t.Error("proposal batched after the fsm stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := fsm.Nop(0); err != ErrFSMStopped {
+		t.Error("expected fsm stopped for a new proposal, got:", err)
+	}
+}
+
+func TestRaftFSM_ReadBarrier(t *testing.T) {
+	committedC := make(chan *string)
+	fsm := newTestRaftFSM(t, make(chan string), committedC)
+
+	// an entry that another node proposed is committed by the time the read index is confirmed
+	proposal := OpenSessionProposal{ID: 1000}
+	fsm.readIndex = func(ctx context.Context) error {
+		s := Encode(proposal.Wrap())
+		committedC <- &s
+		return nil
+	}
+
+	if err := fsm.ReadBarrier(); err != nil {
+		t.Fatal("unable to read:", err)
+	}
+	if sds := fsm.GetSessionDescriptors(); len(sds) != 1 {
+		t.Error("entry before the read index not applied:", sds)
+	}
+}
+
+func TestRaftFSM_ReadTimeout(t *testing.T) {
+	fsm := newTestRaftFSM(t, make(chan string), make(chan *string))
+	fsm.proposalTimeout = 50 * time.Millisecond
+
+	// raft never confirms the read index, as if there were no leader
+	fsm.readIndex = func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	if err := fsm.ReadBarrier(); err != ErrReadTimeout {
+		t.Error("expected read timeout, got:", err)
+	}
+}
+
+func TestRaftFSM_Batching(t *testing.T) {
+	proposeC := make(chan string)
+	committedC := make(chan *string)
+	fsm := newTestRaftFSM(t, proposeC, committedC)
+
+	const numProposals = 10
+	errC := make(chan error)
+	for i := 0; i < numProposals; i++ {
+		go func() {
+			errC <- fsm.Nop(0)
+		}()
+	}
+
+	// hold up the first entry so that the other proposals pile up behind it
+	count := func(entry string) int {
+		op, err := Decode(entry)
+		if err != nil {
+			t.Fatal("unable to decode entry:", err)
+		}
+		if batch, ok := op.(BatchProposal); ok {
+			return len(batch.Proposals)
+		}
+		return 1
+	}
+	time.Sleep(50 * time.Millisecond)
+	entries := []string{<-proposeC}
+	proposed := count(entries[0])
+	for proposed < numProposals {
+		entry := <-proposeC
+		entries = append(entries, entry)
+		proposed += count(entry)
+	}
+
+	if len(entries) > 2 {
+		t.Error("proposals not batched, got entries:", len(entries))
+	}
+
+	for _, entry := range entries {
+		entry := entry
+		committedC <- &entry
+	}
+	for i := 0; i < numProposals; i++ {
+		if err := <-errC; err != nil {
+			t.Error("batched proposal failed:", err)
+		}
+	}
+}
+
+func TestRaftFSM_BatchOrder(t *testing.T) {
+	fsm := newTestRaftFSM(t, make(chan string), make(chan *string))
+
+	ac1 := make(chan proposalResult, 1)
+	ac2 := make(chan proposalResult, 1)
+	fsm.acks.Put(1, ac1)
+	fsm.acks.Put(2, ac2)
+
+	first := OpenSessionProposal{ID: 1}
+	second := OpenSessionProposal{ID: 2}
+	batch := BatchProposal{Proposals: []Proposal{first.Wrap(), second.Wrap()}}
+	op, err := Decode(Encode(batch.Wrap()))
+	if err != nil {
+		t.Fatal("unable to decode batch:", err)
+	}
+	fsm.apply(op)
+
+	sd1 := (<-ac1).value.(SessionDescriptor)
+	sd2 := (<-ac2).value.(SessionDescriptor)
+	if sd1.Descriptor >= sd2.Descriptor {
+		t.Error("batch not applied in order:", sd1, sd2)
+	}
+}
+
+func TestRaftFSM_DuplicateProposal(t *testing.T) {
+	fsm := newTestRaftFSM(t, make(chan string), make(chan *string))
+
+	ac1 := make(chan proposalResult, 1)
+	ac2 := make(chan proposalResult, 1)
+	fsm.acks.Put(1, ac1)
+	fsm.acks.Put(2, ac2)
+
+	// a retry at a new leader can be committed after the original that the old leader got into the log
+	request := NewRequestID()
+	fsm.apply(OpenSessionProposal{ID: 1, Request: request})
+	fsm.apply(OpenSessionProposal{ID: 2, Request: request})
+
+	sd1 := (<-ac1).value.(SessionDescriptor)
+	sd2 := (<-ac2).value.(SessionDescriptor)
+	if sd1 != sd2 {
+		t.Error("duplicate proposal applied twice:", sd1, sd2)
+	}
+	if sds := fsm.GetSessionDescriptors(); len(sds) != 1 {
+		t.Error("wrong sessions after duplicate proposal:", sds)
+	}
+}
+
+// BenchmarkRaftFSM_Nop compares concurrent proposals with and without batching. every log entry takes
+// 100µs to commit, roughly a disk sync, regardless of how many proposals it holds.
+func BenchmarkRaftFSM_Nop(b *testing.B) {
+	for _, batchSize := range []int{1, DefaultMaxBatchSize} {
+		b.Run(fmt.Sprintf("batch%d", batchSize), func(b *testing.B) {
+			delegate, err := NewFSM()
+			if err != nil {
+				b.Fatal("unable to create fsm:", err)
+			}
+
+			proposeC := make(chan string)
+			committedC := make(chan *string)
+			go func() {
+				for s := range proposeC {
+					s := s
+					time.Sleep(100 * time.Microsecond)
+					committedC <- &s
+				}
+			}()
+			defer close(proposeC)
+
+			fsm := NewRaftFSMWithBatchSize(proposeC, committedC, nil, delegate, batchSize)
+
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := fsm.Nop(0); err != nil {
+						b.Error("nop failed:", err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -1,21 +1,45 @@
 package server
 
-import "time"
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
 
 type Server interface {
+	// KeepAlive renews the session's lease and waits up to keepAliveDelay for events. the events it returns are
+	// acked by the next call. eis are the nodes the client has cached, which a new leader checks for missed events.
 	KeepAlive(li LeaseInfo, eis []EventInfo, keepAliveDelay time.Duration) ([]Event, error)
+	// OpenEventStream is the alternative to KeepAlive that has events pushed to the client as they happen
+	OpenEventStream(sd SessionDescriptor) (EventStream, error)
 
-	OpenSession() (SessionDescriptor, error)
-	CloseSession(sd SessionDescriptor) error
-	Open(sd SessionDescriptor, path string, readOnly bool, config EventsConfig) (NodeDescriptor, error)
-	CloseNode(nd NodeDescriptor) error
+	// The calls that change the state take a RequestID so that they can be retried safely: a request that was
+	// already applied returns what it returned the first time instead of being applied again. Acquire and
+	// AcquireShared don't need one because acquiring a lock again in the mode it is held in just succeeds.
+	OpenSession(id RequestID) (SessionDescriptor, error)
+	CloseSession(id RequestID, sd SessionDescriptor) error
+	Open(id RequestID, sd SessionDescriptor, path string, readOnly bool, ephemeral bool, config EventsConfig) (NodeDescriptor, error)
+	CloseNode(id RequestID, nd NodeDescriptor) error
+	Delete(id RequestID, node NodeDescriptor) error
+	List(sd SessionDescriptor, dir string) ([]DirEntry, error)
 
 	Acquire(node NodeDescriptor) error
-	TryAcquire(node NodeDescriptor) (bool, error)
-	Release(node NodeDescriptor) error
+	AcquireContext(ctx context.Context, node NodeDescriptor) error
+	CancelAcquire(node NodeDescriptor) error
+	TryAcquire(id RequestID, node NodeDescriptor) (bool, error)
+	AcquireShared(node NodeDescriptor) error
+	TryAcquireShared(id RequestID, node NodeDescriptor) (bool, error)
+	Release(id RequestID, node NodeDescriptor) error
+	GetSequencer(node NodeDescriptor) (Sequencer, error)
+	// SetLockDelay sets how long the lock stays unavailable after a holder is lost without releasing it. the time
+	// the holder was lost is replicated, so a running delay carries over to a new leader as measured by its clock.
+	SetLockDelay(id RequestID, node NodeDescriptor, delay time.Duration) error
+	CheckSequencer(seq Sequencer) (bool, error)
 
 	GetContentAndStat(node NodeDescriptor) (NodeContentAndStat, error)
-	SetContent(node NodeDescriptor, content string, generation uint64) (bool, error)
+	// GetContentAndStatFollower may be served by any member of the cluster, which spreads reads off the leader
+	GetContentAndStatFollower(node NodeDescriptor) (NodeContentAndStat, error)
+	SetContent(id RequestID, node NodeDescriptor, content string, generation uint64) (bool, error)
 	Nop(numOps uint64) error
 }
 
@@ -34,6 +58,9 @@ type LeaseInfo struct {
 	Session SessionDescriptor
 	// list of locks
 	LockedNodes []NodeDescriptor
+	// LastSeq is the sequence number of the last event the client received, or zero if it hasn't received any.
+	// the events after it are sent again, and a new leader numbers the session's events after it.
+	LastSeq uint64
 }
 
 type EventInfo struct {
@@ -47,7 +74,27 @@ type NodeContentAndStat struct {
 	Stat    NodeStat
 }
 
+// DirEntry describes a single node or directory inside of a directory
+type DirEntry struct {
+	Name string
+	Stat NodeStat
+}
+
 type NodeStat struct {
 	Generation   uint64
 	LastModified time.Time
+	// LockGeneration is incremented every time the node's lock is granted, in either mode
+	LockGeneration uint64
+	// LockDelay is how long the lock stays unavailable after its holder is lost without releasing it
+	LockDelay time.Duration
+}
+
+// Sequencer identifies a particular holding of a lock. A lock holder can pass it along to other
+// services, which can call CheckSequencer to reject requests from a holder that has since lost the lock.
+type Sequencer struct {
+	Path           string
+	LockGeneration uint64
+	Holder         NodeDescriptor
+	// Shared is whether the lock is held in shared mode, alongside any number of other shared holders
+	Shared bool
 }
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Introspector shows what a server holds, for the admin api. the node and session state is replicated and can be
+// read from any member, but keepalive times and lock waiters are only tracked by the leader.
+type Introspector interface {
+	GetClusterState() ClusterState
+	GetSessions() []SessionInfo
+	// GetSession looks up a single session by the number in its descriptor
+	GetSession(sd uint64) (SessionInfo, bool)
+	GetLocks() []LockInfo
+	GetNode(path string) (NodeContentAndStat, bool)
+}
+
+type SessionInfo struct {
+	SD SessionDescriptor
+	// when the session's last KeepAlive returned, zero if this server isn't the leader
+	LastKeepAlive time.Time
+	// whether a KeepAlive is waiting for events right now, which counts as the session being alive
+	InKeepAlive bool
+	Descriptors []DescriptorInfo
+}
+
+type DescriptorInfo struct {
+	ND       NodeDescriptor
+	ReadOnly bool
+	Config   EventsConfig
+}
+
+type LockInfo struct {
+	Path           string
+	LockGeneration uint64
+	// the exclusive holder, or nil if the lock is free or held in shared mode
+	Holder        *NodeDescriptor
+	SharedHolders []NodeDescriptor
+	// the Acquire calls queued for the lock, in the order they will get it
+	Waiters []LockWaiterInfo
+	// the lock stays unavailable until then because its last holder was lost without releasing it
+	DelayedUntil time.Time
+}
+
+type LockWaiterInfo struct {
+	ND     NodeDescriptor
+	Shared bool
+}
+
+// KeepAliveState returns when the session's last KeepAlive returned and whether one is in progress
+func (sc *sessionConn) KeepAliveState() (time.Time, bool) {
+	sc.aliveLock.Lock()
+	defer sc.aliveLock.Unlock()
+
+	return sc.lastKeepAlive, sc.inKeepAlive
+}
+
+func (fe *frontendImpl) GetClusterState() ClusterState {
+	return fe.getClusterState()
+}
+
+func (fe *frontendImpl) GetSessions() []SessionInfo {
+	var sis []SessionInfo
+	for _, sd := range fe.fsm.GetSessionDescriptors() {
+		// the session may have closed since the descriptors were listed
+		if si, ok := fe.getSessionInfo(sd); ok {
+			sis = append(sis, si)
+		}
+	}
+
+	sort.Slice(sis, func(i, j int) bool { return sis[i].SD.Descriptor < sis[j].SD.Descriptor })
+	return sis
+}
+
+func (fe *frontendImpl) GetSession(sd uint64) (SessionInfo, bool) {
+	return fe.getSessionInfo(SessionDescriptor{descriptorKey(sd)})
+}
+
+func (fe *frontendImpl) getSessionInfo(sd SessionDescriptor) (SessionInfo, bool) {
+	session := fe.fsm.GetSession(sd)
+	if session == nil {
+		return SessionInfo{}, false
+	}
+
+	si := SessionInfo{SD: sd}
+	if sc, ok := fe.sessions.Get(uint64(sd.Descriptor)).(*sessionConn); ok {
+		si.LastKeepAlive, si.InKeepAlive = sc.KeepAliveState()
+	}
+
+	for _, nid := range session.GetDescriptors() {
+		si.Descriptors = append(si.Descriptors, DescriptorInfo{nid.GetND(), nid.readOnly, nid.config})
+	}
+	sort.Slice(si.Descriptors, func(i, j int) bool {
+		return si.Descriptors[i].ND.Descriptor < si.Descriptors[j].ND.Descriptor
+	})
+	return si, true
+}
+
+func (fe *frontendImpl) GetLocks() []LockInfo {
+	// a lock can have waiters without a holder while it is in its lock delay
+	paths := make(map[string]struct{})
+	for _, ni := range fe.fsm.GetLockedNodes() {
+		paths[ni.path] = struct{}{}
+	}
+	for _, path := range fe.lockQueues.Keys() {
+		paths[path] = struct{}{}
+	}
+
+	var lis []LockInfo
+	for path := range paths {
+		ni := fe.fsm.GetNode(path)
+		if ni == nil {
+			continue
+		}
+
+		li := LockInfo{Path: path, LockGeneration: ni.GetContentAndStat().Stat.LockGeneration}
+		locker, shared := ni.GetLockers()
+		if locker != nil {
+			nd := locker.GetND()
+			li.Holder = &nd
+		}
+		for _, nid := range shared {
+			li.SharedHolders = append(li.SharedHolders, nid.GetND())
+		}
+		sort.Slice(li.SharedHolders, func(i, j int) bool {
+			a, b := li.SharedHolders[i], li.SharedHolders[j]
+			return a.Session.Descriptor < b.Session.Descriptor || (a.Session.Descriptor == b.Session.Descriptor && a.Descriptor < b.Descriptor)
+		})
+
+		// looking at a lock mustn't leave behind entries for it, since nothing else would clean them up.
+		// a queue is only ever made under its lock lock, so a path without a lock lock has no waiters.
+		if lock, ok := fe.lockLocks.Lookup(path); ok {
+			lock.(*sync.Mutex).Lock()
+			if queue, ok := fe.lockQueues.Lookup(path); ok {
+				for _, waiter := range queue.(*lockQueue).waiters {
+					li.Waiters = append(li.Waiters, LockWaiterInfo{waiter.nd, waiter.shared})
+				}
+			}
+			lock.(*sync.Mutex).Unlock()
+		}
+
+		if until := ni.GetLockDelayEnd(); time.Now().Before(until) {
+			li.DelayedUntil = until
+		}
+
+		if li.Holder != nil || len(li.SharedHolders) > 0 || len(li.Waiters) > 0 || !li.DelayedUntil.IsZero() {
+			lis = append(lis, li)
+		}
+	}
+
+	sort.Slice(lis, func(i, j int) bool { return lis[i].Path < lis[j].Path })
+	return lis
+}
+
+func (fe *frontendImpl) GetNode(path string) (NodeContentAndStat, bool) {
+	ni := fe.fsm.GetNode(path)
+	if ni == nil {
+		return NodeContentAndStat{}, false
+	}
+	return ni.GetContentAndStat(), true
+}
@@ -0,0 +1,74 @@
+package server
+
+// lockWaiter is an Acquire call that is parked until the lock is handed to it
+type lockWaiter struct {
+	nd       NodeDescriptor
+	shared   bool
+	err      error
+	grantedC chan struct{}
+}
+
+func newLockWaiter(nd NodeDescriptor, shared bool) *lockWaiter {
+	return &lockWaiter{nd: nd, shared: shared, grantedC: make(chan struct{})}
+}
+
+// grant wakes the waiter up, either with the lock or with an error
+func (lw *lockWaiter) grant(err error) {
+	lw.err = err
+	close(lw.grantedC)
+}
+
+// lockQueue is the FIFO queue of waiters for a single path.
+// it isn't safe for concurrent access, callers must hold the path's lock lock.
+type lockQueue struct {
+	waiters []*lockWaiter
+}
+
+func (lq *lockQueue) Len() int {
+	return len(lq.waiters)
+}
+
+func (lq *lockQueue) Push(lw *lockWaiter) {
+	lq.waiters = append(lq.waiters, lw)
+}
+
+func (lq *lockQueue) Peek() *lockWaiter {
+	if len(lq.waiters) == 0 {
+		return nil
+	}
+	return lq.waiters[0]
+}
+
+// Remove takes lw out of the queue and returns whether it was still waiting
+func (lq *lockQueue) Remove(lw *lockWaiter) bool {
+	for i, waiter := range lq.waiters {
+		if waiter == lw {
+			lq.waiters = append(lq.waiters[:i:i], lq.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveDescriptor takes every waiter for nd out of the queue and returns them
+func (lq *lockQueue) RemoveDescriptor(nd NodeDescriptor) []*lockWaiter {
+	var removed []*lockWaiter
+	var remaining []*lockWaiter
+	for _, waiter := range lq.waiters {
+		if waiter.nd == nd {
+			removed = append(removed, waiter)
+		} else {
+			remaining = append(remaining, waiter)
+		}
+	}
+	lq.waiters = remaining
+	return removed
+}
+
+func (lq *lockQueue) Pop() *lockWaiter {
+	lw := lq.Peek()
+	if lw != nil {
+		lq.waiters = lq.waiters[1:]
+	}
+	return lw
+}
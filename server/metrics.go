@@ -0,0 +1,114 @@
+package server
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	lockWaitSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cupid",
+		Name:      "lock_wait_seconds",
+		Help:      "How long acquires that found the lock taken waited for it, by lock mode and whether they got it.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"mode", "result"})
+
+	eventsPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cupid",
+		Name:      "events_pending",
+		Help:      "Events sent to sessions that are still waiting to be acked.",
+	})
+
+	eventAckTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cupid",
+		Name:      "event_ack_timeouts_total",
+		Help:      "Events that were not acked in time, including those sent to sessions that already looked dead.",
+	})
+
+	proposalSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cupid",
+		Name:      "raft_proposal_duration_seconds",
+		Help:      "How long raft proposals took to be applied or to fail, by result.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"result"})
+
+	leaderChanges = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cupid",
+		Name:      "leader_changes_total",
+		Help:      "Leader changes seen by this server, including losing the leader.",
+	})
+
+	isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cupid",
+		Name:      "is_leader",
+		Help:      "Whether this server is currently the leader.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(lockWaitSeconds, eventsPending, eventAckTimeouts, proposalSeconds, leaderChanges, isLeader)
+}
+
+func lockMode(shared bool) string {
+	if shared {
+		return "shared"
+	}
+	return "exclusive"
+}
+
+func observeLockWait(shared bool, start time.Time, err error) {
+	result := "acquired"
+	if err != nil {
+		result = "failed"
+	}
+	lockWaitSeconds.WithLabelValues(lockMode(shared), result).Observe(time.Since(start).Seconds())
+}
+
+func observeProposal(start time.Time, err error) {
+	result := "applied"
+	switch err {
+	case nil:
+	case ErrProposalTimeout:
+		result = "timeout"
+	case ErrLeadershipLost:
+		result = "leadership_lost"
+	default:
+		result = "error"
+	}
+	proposalSeconds.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+var (
+	sessionsDesc    = prometheus.NewDesc("cupid_sessions", "Open sessions.", nil, nil)
+	descriptorsDesc = prometheus.NewDesc("cupid_descriptors", "Open node descriptors across all sessions.", nil, nil)
+	nodesDesc       = prometheus.NewDesc("cupid_nodes", "Nodes in the tree.", nil, nil)
+	locksHeldDesc   = prometheus.NewDesc("cupid_locks_held", "Locks that are held, by lock mode.", []string{"mode"}, nil)
+)
+
+// fsmCollector reports an fsm's stats whenever it is scraped, so the counts are right even after a snapshot
+// replaces the whole state
+type fsmCollector struct {
+	fsm FSM
+}
+
+// NewFSMCollector makes a collector for the session, descriptor, node and lock counts of fsm
+func NewFSMCollector(fsm FSM) prometheus.Collector {
+	return &fsmCollector{fsm}
+}
+
+func (fc *fsmCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionsDesc
+	ch <- descriptorsDesc
+	ch <- nodesDesc
+	ch <- locksHeldDesc
+}
+
+func (fc *fsmCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := fc.fsm.GetStats()
+	ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.GaugeValue, float64(stats.Sessions))
+	ch <- prometheus.MustNewConstMetric(descriptorsDesc, prometheus.GaugeValue, float64(stats.Descriptors))
+	ch <- prometheus.MustNewConstMetric(nodesDesc, prometheus.GaugeValue, float64(stats.Nodes))
+	ch <- prometheus.MustNewConstMetric(locksHeldDesc, prometheus.GaugeValue, float64(stats.ExclusiveLocks), lockMode(false))
+	ch <- prometheus.MustNewConstMetric(locksHeldDesc, prometheus.GaugeValue, float64(stats.SharedLocks), lockMode(true))
+}
@@ -11,6 +11,8 @@ type clientSession struct {
 	data      map[descriptorKey]*nodeDescriptor
 	ndsByPath map[string][]descriptorKey
 	nextKey   descriptorKey
+
+	requests *requestHistory
 }
 
 func newClientSession(key descriptorKey) *clientSession {
@@ -18,6 +20,7 @@ func newClientSession(key descriptorKey) *clientSession {
 		key:       key,
 		data:      make(map[descriptorKey]*nodeDescriptor),
 		ndsByPath: make(map[string][]descriptorKey),
+		requests:  newRequestHistory(),
 	}
 }
 
@@ -36,6 +39,21 @@ func (cs *clientSession) GetDescriptor(key descriptorKey) *nodeDescriptor {
 	return cs.data[key]
 }
 
+func (cs *clientSession) GetDescriptors() []*nodeDescriptor {
+	if cs == nil {
+		return nil
+	}
+
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+
+	var nds []*nodeDescriptor
+	for _, nd := range cs.data {
+		nds = append(nds, nd)
+	}
+	return nds
+}
+
 func (cs *clientSession) GetDescriptorKeys(path string) []descriptorKey {
 	if cs == nil {
 		return nil
@@ -79,14 +97,32 @@ func (cs *clientSession) CloseDescriptor(key descriptorKey) {
 	delete(cs.data, key)
 }
 
+// CloseDescriptors closes every descriptor in this session that refers to path
+func (cs *clientSession) CloseDescriptors(path string) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	for _, key := range cs.ndsByPath[path] {
+		delete(cs.data, key)
+	}
+	delete(cs.ndsByPath, path)
+}
+
 type sessionDescriptorMap struct {
 	lock    sync.RWMutex
 	data    map[descriptorKey]*clientSession
 	nextKey descriptorKey
+
+	// the requests that open and close sessions, which can't be kept with a session that doesn't exist yet or
+	// doesn't exist anymore
+	requests *requestHistory
 }
 
 func makeSessionDescriptorMap() *sessionDescriptorMap {
-	return &sessionDescriptorMap{data: make(map[descriptorKey]*clientSession)}
+	return &sessionDescriptorMap{
+		data:     make(map[descriptorKey]*clientSession),
+		requests: newRequestHistory(),
+	}
 }
 
 func (sdm *sessionDescriptorMap) GetDescriptor(nd NodeDescriptor) *nodeDescriptor {
@@ -124,6 +160,29 @@ func (sdm *sessionDescriptorMap) CloseSession(sd SessionDescriptor) {
 	delete(sdm.data, sd.Descriptor)
 }
 
+// stats counts the open sessions and the descriptors open in them
+func (sdm *sessionDescriptorMap) stats() (sessions int, descriptors int) {
+	sdm.lock.RLock()
+	defer sdm.lock.RUnlock()
+
+	for _, cs := range sdm.data {
+		cs.lock.RLock()
+		descriptors += len(cs.data)
+		cs.lock.RUnlock()
+	}
+	return len(sdm.data), descriptors
+}
+
+// CloseDescriptors closes every descriptor in every session that refers to path
+func (sdm *sessionDescriptorMap) CloseDescriptors(path string) {
+	sdm.lock.RLock()
+	defer sdm.lock.RUnlock()
+
+	for _, cs := range sdm.data {
+		cs.CloseDescriptors(path)
+	}
+}
+
 type nodeDescriptor struct {
 	cs       *clientSession
 	key      descriptorKey
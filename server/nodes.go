@@ -8,10 +8,19 @@ import (
 
 const (
 	timeoutThreshold = 3 * maxKeepAliveDelay
+	// sessionLeaseTimeout is how long a session can go without a KeepAlive before the leader closes it.
+	// it is longer than timeoutThreshold so that a session that merely looks dead to a contending
+	// locker gets a chance to come back before it loses all of its state.
+	sessionLeaseTimeout = 4 * maxKeepAliveDelay
+	// maxLockDelay is the longest that a lock can be kept unavailable after its holder is lost
+	maxLockDelay = time.Minute
 )
 
 var (
-	ErrLockNotHeld = errors.New("Attempting to release a lock that is not held")
+	ErrLockNotHeld      = errors.New("Attempting to release a lock that is not held")
+	ErrNoSequencerHeld  = errors.New("Sequencer requested for a lock that is not held")
+	ErrLockModeHeld     = errors.New("Lock is already held through this descriptor in the other mode")
+	ErrInvalidLockDelay = errors.New("Lock delay must be between zero and one minute")
 )
 
 type nodeInfo struct {
@@ -22,6 +31,19 @@ type nodeInfo struct {
 	finalized    bool
 	lock         sync.RWMutex
 	locker       *nodeDescriptor
+	// the holders of the lock in shared mode and the lock generation each was granted at, only non-empty while
+	// locker is nil
+	sharedLockers map[*nodeDescriptor]uint64
+	// incremented every time the lock is granted in either mode, used to build sequencers
+	lockGeneration uint64
+	// how long the lock stays unavailable after its holder is lost without releasing it
+	lockDelay time.Duration
+	// when the lock-delay of the last lost holder runs out. it is worked out from the replicated time that the
+	// holder was lost so that a new leader keeps the lock unavailable just as the old one would have.
+	lockDelayEnd time.Time
+
+	// the session that created this node if it is ephemeral, or 0 if it is permanent
+	ephemeralOwner descriptorKey
 }
 
 func (ni *nodeInfo) GetContentAndStat() NodeContentAndStat {
@@ -33,6 +55,8 @@ func (ni *nodeInfo) GetContentAndStat() NodeContentAndStat {
 		NodeStat{
 			ni.generation,
 			ni.lastModified,
+			ni.lockGeneration,
+			ni.lockDelay,
 		},
 	}
 }
@@ -58,11 +82,119 @@ func (ni *nodeInfo) FinalizeSetContent() {
 	ni.finalized = true
 }
 
+// IsFinalized returns whether every session has been told about the node's last SetContent
+func (ni *nodeInfo) IsFinalized() bool {
+	ni.lock.RLock()
+	defer ni.lock.RUnlock()
+	return ni.finalized
+}
+
+func (ni *nodeInfo) SetLockDelay(delay time.Duration) {
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+
+	ni.lockDelay = delay
+}
+
+func (ni *nodeInfo) GetLockDelay() time.Duration {
+	ni.lock.RLock()
+	defer ni.lock.RUnlock()
+
+	return ni.lockDelay
+}
+
+// StartLockDelay keeps the lock unavailable for its lock-delay from when its holder was lost
+func (ni *nodeInfo) StartLockDelay(lost time.Time) {
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+
+	if end := lost.Add(ni.lockDelay); end.After(ni.lockDelayEnd) {
+		ni.lockDelayEnd = end
+	}
+}
+
+// GetLockDelayEnd returns when the lock-delay of the last lost holder runs out, which may be in the past
+func (ni *nodeInfo) GetLockDelayEnd() time.Time {
+	ni.lock.RLock()
+	defer ni.lock.RUnlock()
+
+	return ni.lockDelayEnd
+}
+
 func (ni *nodeInfo) SetLocked(locker *nodeDescriptor) {
 	ni.lock.Lock()
 	defer ni.lock.Unlock()
 
 	ni.locker = locker
+	ni.lockGeneration += 1
+}
+
+func (ni *nodeInfo) SetSharedLocked(locker *nodeDescriptor) {
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+
+	if ni.sharedLockers == nil {
+		ni.sharedLockers = make(map[*nodeDescriptor]uint64)
+	}
+	ni.lockGeneration += 1
+	ni.sharedLockers[locker] = ni.lockGeneration
+}
+
+// GetLockMode returns whether holder holds the lock and if so whether it is in shared mode
+func (ni *nodeInfo) GetLockMode(holder *nodeDescriptor) (held bool, shared bool) {
+	ni.lock.RLock()
+	defer ni.lock.RUnlock()
+
+	if ni.locker == holder {
+		return true, false
+	}
+	_, ok := ni.sharedLockers[holder]
+	return ok, ok
+}
+
+// GetLockers returns the exclusive holder of the lock, if any, and its shared holders
+func (ni *nodeInfo) GetLockers() (*nodeDescriptor, []*nodeDescriptor) {
+	ni.lock.RLock()
+	defer ni.lock.RUnlock()
+
+	var shared []*nodeDescriptor
+	for locker := range ni.sharedLockers {
+		shared = append(shared, locker)
+	}
+	return ni.locker, shared
+}
+
+// GetSequencer returns a sequencer for the lock if it is currently held by holder, in either mode
+func (ni *nodeInfo) GetSequencer(holder *nodeDescriptor) (Sequencer, bool) {
+	ni.lock.RLock()
+	defer ni.lock.RUnlock()
+
+	if holder == nil {
+		return Sequencer{}, false
+	} else if ni.locker == holder {
+		return Sequencer{Path: ni.path, LockGeneration: ni.lockGeneration, Holder: holder.GetND()}, true
+	} else if generation, ok := ni.sharedLockers[holder]; ok {
+		return Sequencer{Path: ni.path, LockGeneration: generation, Holder: holder.GetND(), Shared: true}, true
+	}
+	return Sequencer{}, false
+}
+
+// CheckSequencer reports whether seq still describes a current holding of the lock
+func (ni *nodeInfo) CheckSequencer(seq Sequencer) bool {
+	ni.lock.RLock()
+	defer ni.lock.RUnlock()
+
+	if !seq.Shared {
+		return ni.locker != nil && ni.lockGeneration == seq.LockGeneration && ni.locker.GetND() == seq.Holder
+	}
+
+	// the holder must not have released the lock and acquired it again since, which gives it a new generation
+	for locker, generation := range ni.sharedLockers {
+		if locker.GetND() == seq.Holder {
+			return generation == seq.LockGeneration
+		}
+	}
+	return false
 }
 
 // TODO: add error checking for whether the caller has the lock
@@ -74,11 +206,15 @@ func (ni *nodeInfo) Release(unlocker *nodeDescriptor) error {
 		return ErrInvalidNodeDescriptor
 	}
 
-	if ni.locker != unlocker {
-		return ErrLockNotHeld
+	if ni.locker == unlocker {
+		ni.locker = nil
+		return nil
 	}
 
-	ni.locker = nil
+	if _, ok := ni.sharedLockers[unlocker]; ok {
+		delete(ni.sharedLockers, unlocker)
+		return nil
+	}
 
-	return nil
+	return ErrLockNotHeld
 }
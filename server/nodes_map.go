@@ -1,15 +1,91 @@
 package server
 
-import "sync"
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
 
 // maps aren't safe for concurrent access, so guard mutations with a RWMutex
 type nodeInfoMap struct {
 	data map[string]*nodeInfo
 	lock sync.RWMutex
+
+	// children maps a directory to the names of the nodes and directories directly inside of it.
+	// directories exist implicitly for as long as some node beneath them exists.
+	children map[string]map[string]struct{}
 }
 
 func makeNodeInfoMap() *nodeInfoMap {
-	return &nodeInfoMap{data: make(map[string]*nodeInfo)}
+	return &nodeInfoMap{
+		data:     make(map[string]*nodeInfo),
+		children: make(map[string]map[string]struct{}),
+	}
+}
+
+// splitPath splits a path into its parent directory and its name within that directory
+func splitPath(path string) (string, string) {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", path
+	} else if i == 0 {
+		return "/", path[1:]
+	}
+	return path[:i], path[i+1:]
+}
+
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	} else if dir == "/" {
+		return "/" + name
+	}
+	return dir + "/" + name
+}
+
+// addToParents registers path with its parent directory and every directory above that.
+// callers must hold the write lock.
+func (nim *nodeInfoMap) addToParents(path string) {
+	for {
+		dir, name := splitPath(path)
+		if name == "" {
+			return
+		}
+
+		names, ok := nim.children[dir]
+		if !ok {
+			names = make(map[string]struct{})
+			nim.children[dir] = names
+		}
+		if _, ok := names[name]; ok {
+			// the ancestors were registered along with this entry
+			return
+		}
+		names[name] = struct{}{}
+		path = dir
+	}
+}
+
+// removeFromParents unregisters path and any directories that it leaves empty.
+// callers must hold the write lock.
+func (nim *nodeInfoMap) removeFromParents(path string) {
+	for {
+		if _, ok := nim.data[path]; ok || len(nim.children[path]) > 0 {
+			return
+		}
+
+		dir, name := splitPath(path)
+		if name == "" {
+			return
+		}
+
+		delete(nim.children[dir], name)
+		if len(nim.children[dir]) == 0 {
+			delete(nim.children, dir)
+		}
+		path = dir
+	}
 }
 
 func (nim *nodeInfoMap) GetNode(path string) *nodeInfo {
@@ -19,16 +95,52 @@ func (nim *nodeInfoMap) GetNode(path string) *nodeInfo {
 }
 
 func (nim *nodeInfoMap) CreateNode(path string) *nodeInfo {
+	return nim.createNode(path, 0)
+}
+
+func (nim *nodeInfoMap) createNode(path string, ephemeralOwner descriptorKey) *nodeInfo {
 	nim.lock.Lock()
 	defer nim.lock.Unlock()
 
 	if _, ok := nim.data[path]; !ok {
-		nim.data[path] = &nodeInfo{path: path, finalized: true}
+		nim.data[path] = &nodeInfo{path: path, finalized: true, ephemeralOwner: ephemeralOwner}
+		nim.addToParents(path)
 	}
 
 	return nim.data[path]
 }
 
+func (nim *nodeInfoMap) DeleteNode(path string) {
+	nim.lock.Lock()
+	defer nim.lock.Unlock()
+
+	delete(nim.data, path)
+	nim.removeFromParents(path)
+}
+
+// ListChildren returns the entries directly inside of dir sorted by name.
+// entries for implicit directories that are not nodes themselves have an empty stat.
+func (nim *nodeInfoMap) ListChildren(dir string) []DirEntry {
+	if len(dir) > 1 {
+		dir = strings.TrimSuffix(dir, "/")
+	}
+
+	nim.lock.RLock()
+	defer nim.lock.RUnlock()
+
+	var entries []DirEntry
+	for name := range nim.children[dir] {
+		entry := DirEntry{Name: name}
+		if ni, ok := nim.data[joinPath(dir, name)]; ok {
+			entry.Stat = ni.GetContentAndStat().Stat
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
 func (nim *nodeInfoMap) GetOrCreateNode(path string) *nodeInfo {
 	if node := nim.GetNode(path); node != nil {
 		return node
@@ -37,6 +149,80 @@ func (nim *nodeInfoMap) GetOrCreateNode(path string) *nodeInfo {
 	return nim.CreateNode(path)
 }
 
+// GetOrCreateEphemeralNode creates path as an ephemeral node owned by session if it doesn't exist yet.
+// an existing node is returned as is, whether or not it is ephemeral.
+func (nim *nodeInfoMap) GetOrCreateEphemeralNode(path string, session descriptorKey) *nodeInfo {
+	if node := nim.GetNode(path); node != nil {
+		return node
+	}
+
+	return nim.createNode(path, session)
+}
+
+// GetEphemeralNodes returns the paths of the ephemeral nodes owned by session
+func (nim *nodeInfoMap) GetEphemeralNodes(session descriptorKey) []string {
+	// permanent nodes have the zero owner, which is never given to a session
+	if session == 0 {
+		return nil
+	}
+
+	nim.lock.RLock()
+	defer nim.lock.RUnlock()
+
+	var paths []string
+	for path, ni := range nim.data {
+		if ni.ephemeralOwner == session {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// stats counts the nodes and the locks that are held on them
+func (nim *nodeInfoMap) stats() (nodes int, exclusive int, shared int) {
+	nim.lock.RLock()
+	defer nim.lock.RUnlock()
+
+	for _, ni := range nim.data {
+		ni.lock.RLock()
+		if ni.locker != nil {
+			exclusive++
+		} else if len(ni.sharedLockers) > 0 {
+			shared++
+		}
+		ni.lock.RUnlock()
+	}
+	return len(nim.data), exclusive, shared
+}
+
+// GetLockedNodes returns the nodes whose locks are held in either mode
+func (nim *nodeInfoMap) GetLockedNodes() []*nodeInfo {
+	nim.lock.RLock()
+	defer nim.lock.RUnlock()
+
+	var locked []*nodeInfo
+	for _, ni := range nim.data {
+		if locker, shared := ni.GetLockers(); locker != nil || len(shared) > 0 {
+			locked = append(locked, ni)
+		}
+	}
+	return locked
+}
+
+// GetLockDelayedNodes returns the nodes whose locks are still in the lock-delay of a lost holder at now
+func (nim *nodeInfoMap) GetLockDelayedNodes(now time.Time) []*nodeInfo {
+	nim.lock.RLock()
+	defer nim.lock.RUnlock()
+
+	var delayed []*nodeInfo
+	for _, ni := range nim.data {
+		if now.Before(ni.GetLockDelayEnd()) {
+			delayed = append(delayed, ni)
+		}
+	}
+	return delayed
+}
+
 func (nim *nodeInfoMap) GetUnfinalizedNodes() []*nodeInfo {
 	nim.lock.RLock()
 	defer nim.lock.RUnlock()
@@ -44,7 +230,7 @@ func (nim *nodeInfoMap) GetUnfinalizedNodes() []*nodeInfo {
 	var unfinalized []*nodeInfo
 	for key := range nim.data {
 		ni := nim.data[key]
-		if !ni.finalized {
+		if !ni.IsFinalized() {
 			unfinalized = append(unfinalized, ni)
 		}
 	}
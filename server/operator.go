@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+var (
+	ErrNodeNotFound = errors.New("Node does not exist")
+)
+
+// Operator takes locks and sessions away from clients that are stuck holding them, for the admin api. a session
+// that still sends keepalives is never reaped and its locks are never reclaimed, so these are the only way to get
+// them back from a wedged client. both go through the fsm like any other write and only work on the leader.
+type Operator interface {
+	// ExpireSession closes sd as if its lease ran out, after invalidating the locks it holds
+	ExpireSession(sd SessionDescriptor) error
+	// ForceReleaseLock takes the lock on path from all of its holders and returns the descriptors it was taken from
+	ForceReleaseLock(path string) ([]NodeDescriptor, error)
+}
+
+func (fe *frontendImpl) ExpireSession(sd SessionDescriptor) error {
+	if cs := fe.getClusterState(); !cs.IsLeader {
+		return cs.MakeRedirectError()
+	}
+
+	session := fe.fsm.GetSession(sd)
+	if session == nil {
+		return ErrInvalidSessionDescriptor
+	}
+
+	// the locks are revoked before the session goes away so that the invalidation events still have a session
+	// to be delivered to, which a wedged client that is still sending keepalives will pick up
+	for _, nid := range session.GetDescriptors() {
+		lock := fe.lockLocks.Get(nid.ni.path).(*sync.Mutex)
+		lock.Lock()
+		var err error
+		if held, _ := nid.ni.GetLockMode(nid); held {
+			err = fe.revokeLock(nid.ni, []*nodeDescriptor{nid})
+		}
+		lock.Unlock()
+		if err != nil {
+			return fe.proposalError(err)
+		}
+	}
+
+	log.Println("expiring session:", sd)
+	return fe.closeSession(NoRequestID, sd, true)
+}
+
+func (fe *frontendImpl) ForceReleaseLock(path string) ([]NodeDescriptor, error) {
+	if cs := fe.getClusterState(); !cs.IsLeader {
+		return nil, cs.MakeRedirectError()
+	}
+
+	ni := fe.fsm.GetNode(path)
+	if ni == nil {
+		return nil, ErrNodeNotFound
+	}
+
+	lock := fe.lockLocks.Get(path).(*sync.Mutex)
+	lock.Lock()
+	currentLocker, lockers := ni.GetLockers()
+	if currentLocker != nil {
+		lockers = append(lockers, currentLocker)
+	}
+	if len(lockers) == 0 {
+		lock.Unlock()
+		return nil, ErrLockNotHeld
+	}
+
+	log.Println("force releasing lock:", path)
+	err := fe.revokeLock(ni, lockers)
+	lock.Unlock()
+	if err != nil {
+		return nil, fe.proposalError(err)
+	}
+
+	// the waiters only get the lock once its lock-delay runs out, in case a holder is still acting on it
+	fe.grantNextWaiter(path)
+
+	var nds []NodeDescriptor
+	for _, locker := range lockers {
+		nds = append(nds, locker.GetND())
+	}
+	return nds, nil
+}
@@ -1,22 +1,48 @@
 package server
 
 import (
-	"bytes"
-	"encoding/gob"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"log"
 	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
+const (
+	// how long a proposal may take to be applied before it is given up on
+	defaultProposalTimeout = 5 * time.Second
+	// how many concurrent proposals may be coalesced into a single log entry
+	DefaultMaxBatchSize = 64
+)
+
+var (
+	ErrProposalTimeout = errors.New("Proposal was not applied before its deadline")
+	ErrLeadershipLost  = errors.New("Leadership was lost before the proposal was applied")
+	ErrReadTimeout     = errors.New("Read index was not confirmed before its deadline")
+	ErrFSMStopped      = errors.New("Raft stopped before the proposal was applied")
+)
+
+// ReadIndexFunc asks raft for the current commit index, confirming with a quorum that no newer leader has
+// committed past it, and returns once every entry up to that index has been sent on the commit channel.
+type ReadIndexFunc func(ctx context.Context) error
+
 const (
 	openSessionProposalType = iota
 	closeSessionProposalType
 	openNodeProposalType
 	closeNodeProposalType
+	deleteNodeProposalType
 	tryAcquireProposalType
 	releaseProposalType
 	prepareSetContentProposalType
 	finalizeSetContentProposalType
 	nopProposalType
+	restoreSnapshotProposalType
+	setLockDelayProposalType
+	batchProposalType
 )
 
 type Proposal struct {
@@ -25,11 +51,15 @@ type Proposal struct {
 	*CloseSessionProposal
 	*OpenNodeProposal
 	*CloseNodeProposal
+	*DeleteNodeProposal
 	*TryAcquireProposal
 	*ReleaseProposal
 	*PrepareSetContentProposal
 	*FinalizeSetContentProposal
 	*NopProposal
+	*RestoreSnapshotProposal
+	*SetLockDelayProposal
+	*BatchProposal
 }
 
 func (p *Proposal) Get() interface{} {
@@ -42,6 +72,8 @@ func (p *Proposal) Get() interface{} {
 		return *p.OpenNodeProposal
 	case closeNodeProposalType:
 		return *p.CloseNodeProposal
+	case deleteNodeProposalType:
+		return *p.DeleteNodeProposal
 	case tryAcquireProposalType:
 		return *p.TryAcquireProposal
 	case releaseProposalType:
@@ -52,13 +84,20 @@ func (p *Proposal) Get() interface{} {
 		return *p.FinalizeSetContentProposal
 	case nopProposalType:
 		return *p.NopProposal
+	case restoreSnapshotProposalType:
+		return *p.RestoreSnapshotProposal
+	case setLockDelayProposalType:
+		return *p.SetLockDelayProposal
+	case batchProposalType:
+		return *p.BatchProposal
 	default:
 		return nil
 	}
 }
 
 type OpenSessionProposal struct {
-	ID uint64
+	ID      uint64
+	Request RequestID
 }
 
 func (osp *OpenSessionProposal) Wrap() Proposal {
@@ -66,7 +105,8 @@ func (osp *OpenSessionProposal) Wrap() Proposal {
 }
 
 type CloseSessionProposal struct {
-	ID uint64
+	ID      uint64
+	Request RequestID
 
 	SD SessionDescriptor
 }
@@ -76,12 +116,14 @@ func (csp *CloseSessionProposal) Wrap() Proposal {
 }
 
 type OpenNodeProposal struct {
-	ID uint64
+	ID      uint64
+	Request RequestID
 
-	SD       SessionDescriptor
-	Path     string
-	ReadOnly bool
-	Config   EventsConfig
+	SD        SessionDescriptor
+	Path      string
+	ReadOnly  bool
+	Ephemeral bool
+	Config    EventsConfig
 }
 
 func (onp *OpenNodeProposal) Wrap() Proposal {
@@ -89,7 +131,8 @@ func (onp *OpenNodeProposal) Wrap() Proposal {
 }
 
 type CloseNodeProposal struct {
-	ID uint64
+	ID      uint64
+	Request RequestID
 
 	ND NodeDescriptor
 }
@@ -98,28 +141,56 @@ func (cnp *CloseNodeProposal) Wrap() Proposal {
 	return Proposal{Type: closeNodeProposalType, CloseNodeProposal: cnp}
 }
 
-type TryAcquireProposal struct {
-	ID uint64
+type DeleteNodeProposal struct {
+	ID      uint64
+	Request RequestID
+
 	ND NodeDescriptor
 }
 
+func (dnp *DeleteNodeProposal) Wrap() Proposal {
+	return Proposal{Type: deleteNodeProposalType, DeleteNodeProposal: dnp}
+}
+
+type TryAcquireProposal struct {
+	ID      uint64
+	Request RequestID
+	ND      NodeDescriptor
+	Shared  bool
+}
+
 func (tap *TryAcquireProposal) Wrap() Proposal {
 	return Proposal{Type: tryAcquireProposalType, TryAcquireProposal: tap}
 }
 
 type ReleaseProposal struct {
-	ID uint64
-	ND NodeDescriptor
+	ID      uint64
+	Request RequestID
+	ND      NodeDescriptor
+	// when the holder was lost, which is zero if it released the lock itself
+	Lost time.Time
 }
 
 func (rp *ReleaseProposal) Wrap() Proposal {
 	return Proposal{Type: releaseProposalType, ReleaseProposal: rp}
 }
 
+type SetLockDelayProposal struct {
+	ID      uint64
+	Request RequestID
+	ND      NodeDescriptor
+	Delay   time.Duration
+}
+
+func (sldp *SetLockDelayProposal) Wrap() Proposal {
+	return Proposal{Type: setLockDelayProposalType, SetLockDelayProposal: sldp}
+}
+
 type PrepareSetContentProposal struct {
-	ID  uint64
-	ND  NodeDescriptor
-	CAS NodeContentAndStat
+	ID      uint64
+	Request RequestID
+	ND      NodeDescriptor
+	CAS     NodeContentAndStat
 }
 
 func (scp *PrepareSetContentProposal) Wrap() Proposal {
@@ -144,39 +215,56 @@ func (np *NopProposal) Wrap() Proposal {
 	return Proposal{Type: nopProposalType, NopProposal: np}
 }
 
-func Encode(proposal Proposal) string {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(&proposal); err != nil {
-		log.Fatal(err)
-	}
-	return buf.String()
+// RestoreSnapshotProposal is never proposed. It is placed on the commit stream by the raft node when a
+// snapshot is received from the leader so that the snapshot is applied in order with the other entries.
+type RestoreSnapshotProposal struct {
+	Data []byte
 }
 
-func Decode(s string) interface{} {
-	var p Proposal
-	if err := gob.NewDecoder(bytes.NewBufferString(s)).Decode(&p); err != nil {
-		return nil
-	}
-	return p.Get()
+func (rsp *RestoreSnapshotProposal) Wrap() Proposal {
+	return Proposal{Type: restoreSnapshotProposalType, RestoreSnapshotProposal: rsp}
 }
 
-func NewRaftFSM(proposeC chan<- string, committedC <-chan *string, delegate FSM) FSM {
+// BatchProposal is several proposals that share a single log entry. They are applied in order.
+type BatchProposal struct {
+	Proposals []Proposal
+}
+
+func (bp *BatchProposal) Wrap() Proposal {
+	return Proposal{Type: batchProposalType, BatchProposal: bp}
+}
+
+// NewRaftFSM replicates the changes to delegate through raft. readIndex may be nil if every committed entry is
+// already on committedC by the time its proposal returns, like when there is no actual raft cluster.
+func NewRaftFSM(proposeC chan<- string, committedC <-chan *string, readIndex ReadIndexFunc, delegate FSM) FSM {
+	return NewRaftFSMWithBatchSize(proposeC, committedC, readIndex, delegate, DefaultMaxBatchSize)
+}
+
+// NewRaftFSMWithBatchSize is NewRaftFSM with up to maxBatchSize proposals per log entry. a maxBatchSize of 1
+// proposes every change in its own entry.
+func NewRaftFSMWithBatchSize(proposeC chan<- string, committedC <-chan *string, readIndex ReadIndexFunc, delegate FSM, maxBatchSize int) FSM {
+	if maxBatchSize < 1 {
+		maxBatchSize = 1
+	}
+
 	fsm := &raftFSMImpl{
-		proposeC:               proposeC,
-		committedC:             committedC,
-		delegate:               delegate,
-		id:                     0,
-		openSessionAcks:        NewAtomicMap(),
-		closeSessionAcks:       NewAtomicMap(),
-		openNodeAcks:           NewAtomicMap(),
-		closeNodeAcks:          NewAtomicMap(),
-		tryAcquireAcks:         NewAtomicMap(),
-		releaseAcks:            NewAtomicMap(),
-		setContentAcks:         NewAtomicMap(),
-		finalizeSetContentAcks: NewAtomicMap(),
-		nopProposalAcks:        NewAtomicMap(),
+		proposeC:         proposeC,
+		committedC:       committedC,
+		readIndex:        readIndex,
+		delegate:         delegate,
+		id:               newProposalIDBase(),
+		proposalTimeout:  defaultProposalTimeout,
+		maxBatchSize:     maxBatchSize,
+		batchC:           make(chan Proposal),
+		readyC:           make(chan []Proposal),
+		acks:             NewAtomicMap(),
+		snapshotRequests: make(chan chan snapshotResult),
+		barriers:         make(chan chan struct{}),
+		stopped:          make(chan struct{}),
 	}
 
+	go fsm.collectBatches()
+	go fsm.proposeBatches()
 	go fsm.readFromLog()
 
 	return fsm
@@ -185,47 +273,186 @@ func NewRaftFSM(proposeC chan<- string, committedC <-chan *string, delegate FSM)
 type raftFSMImpl struct {
 	proposeC   chan<- string
 	committedC <-chan *string
+	readIndex  ReadIndexFunc
 	delegate   FSM
 
-	id uint64
+	id              uint64
+	proposalTimeout time.Duration
+
+	// proposals are handed to collectBatches on batchC, which passes them on to proposeBatches in batches
+	maxBatchSize int
+	batchC       chan Proposal
+	readyC       chan []Proposal
+
+	// the proposals that are waiting to be applied, by id. each is removed as soon as it is acked.
+	acks AtomicMap
+
+	snapshotRequests chan chan snapshotResult
+	barriers         chan chan struct{}
+
+	// closed once raft closes the commit channel, which stops the goroutines that batch and propose
+	stopped chan struct{}
+}
+
+// proposalResult is what a pending proposal is acked with once it is applied, or once it has failed
+type proposalResult struct {
+	value interface{}
+	err   error
+}
 
-	openSessionAcks        AtomicMap
-	closeSessionAcks       AtomicMap
-	openNodeAcks           AtomicMap
-	closeNodeAcks          AtomicMap
-	tryAcquireAcks         AtomicMap
-	releaseAcks            AtomicMap
-	setContentAcks         AtomicMap
-	finalizeSetContentAcks AtomicMap
-	nopProposalAcks        AtomicMap
+type snapshotResult struct {
+	data []byte
+	err  error
+}
+
+// newProposalIDBase picks a random prefix for the ids of this fsm's proposals. every member applies every entry
+// and acks the waiter with the entry's id, so the ids have to be unique across the cluster and across restarts,
+// or an entry proposed elsewhere would wake up one of our waiters with a result of the wrong type.
+func newProposalIDBase() uint64 {
+	var prefix [4]byte
+	if _, err := rand.Read(prefix[:]); err != nil {
+		panic(err)
+	}
+	return uint64(binary.BigEndian.Uint32(prefix[:])) << 32
 }
 
 func (fsm *raftFSMImpl) nextId() uint64 {
 	return atomic.AddUint64(&fsm.id, 1)
 }
 
-func (fsm *raftFSMImpl) OpenSession() SessionDescriptor {
-	id := fsm.nextId()
+// propose submits proposal to raft and waits for it to be applied, returning the value that apply acks it with.
+// it fails if the proposal isn't applied by its deadline or if this node stops being the leader first, in which
+// case the proposal may still be applied later on.
+func (fsm *raftFSMImpl) propose(id uint64, proposal Proposal) (value interface{}, err error) {
+	defer func(start time.Time) { observeProposal(start, err) }(time.Now())
+
+	ac := make(chan proposalResult, 1)
+	fsm.acks.Put(id, ac)
+
+	deadline := time.NewTimer(fsm.proposalTimeout)
+	defer deadline.Stop()
+
+	select {
+	case fsm.batchC <- proposal:
+	case result := <-ac:
+		return result.value, result.err
+	case <-deadline.C:
+		fsm.acks.Delete(id)
+		return nil, ErrProposalTimeout
+	case <-fsm.stopped:
+		fsm.acks.Delete(id)
+		return nil, ErrFSMStopped
+	}
 
-	ac := make(chan SessionDescriptor)
-	fsm.openSessionAcks.Put(id, ac)
+	select {
+	case result := <-ac:
+		return result.value, result.err
+	case <-deadline.C:
+		fsm.acks.Delete(id)
+		return nil, ErrProposalTimeout
+	case <-fsm.stopped:
+		fsm.acks.Delete(id)
+	}
 
-	proposal := OpenSessionProposal{ID: id}
-	fsm.proposeC <- Encode(proposal.Wrap())
+	// the last entries are applied before the fsm stops, so the proposal may have committed after all
+	select {
+	case result := <-ac:
+		return result.value, result.err
+	default:
+		return nil, ErrFSMStopped
+	}
+}
 
-	return <-ac
+// collectBatches gathers the proposals from batchC into batches for proposeBatches. while an entry is being
+// proposed the proposals made in the meantime pile up into the next batch, so concurrent callers share a log
+// entry rather than each waiting their turn.
+func (fsm *raftFSMImpl) collectBatches() {
+	var pending []Proposal
+	for {
+		// only hand over a batch once proposeBatches is ready for it, and stop taking proposals once it's full
+		batchC, readyC := fsm.batchC, fsm.readyC
+		if len(pending) == 0 {
+			readyC = nil
+		}
+		if len(pending) >= fsm.maxBatchSize {
+			batchC = nil
+		}
+
+		select {
+		case proposal := <-batchC:
+			pending = append(pending, proposal)
+		case readyC <- pending:
+			pending = nil
+		case <-fsm.stopped:
+			return
+		}
+	}
+}
+
+// proposeBatches proposes each batch from collectBatches as a single log entry, until raft stops
+func (fsm *raftFSMImpl) proposeBatches() {
+	for {
+		var batch []Proposal
+		select {
+		case batch = <-fsm.readyC:
+		case <-fsm.stopped:
+			return
+		}
+
+		entry := Encode(batch[0])
+		if len(batch) > 1 {
+			bp := BatchProposal{Proposals: batch}
+			entry = Encode(bp.Wrap())
+		}
+
+		select {
+		case fsm.proposeC <- entry:
+		case <-fsm.stopped:
+			return
+		}
+	}
+}
+
+// ack hands value to the caller waiting on proposal id, if it is still waiting
+func (fsm *raftFSMImpl) ack(id uint64, value interface{}) {
+	if ac := fsm.acks.Take(id); ac != nil {
+		ac.(chan proposalResult) <- proposalResult{value: value}
+	}
 }
 
-func (fsm *raftFSMImpl) CloseSession(sd SessionDescriptor) {
+// fail wakes up the proposer of id with the error that applying its proposal returned
+func (fsm *raftFSMImpl) fail(id uint64, err error) {
+	if ac := fsm.acks.Take(id); ac != nil {
+		ac.(chan proposalResult) <- proposalResult{err: err}
+	}
+}
+
+func (fsm *raftFSMImpl) AbortProposals() {
+	for _, id := range fsm.acks.Keys() {
+		if ac := fsm.acks.Take(id); ac != nil {
+			ac.(chan proposalResult) <- proposalResult{err: ErrLeadershipLost}
+		}
+	}
+}
+
+func (fsm *raftFSMImpl) OpenSession(request RequestID) (SessionDescriptor, error) {
 	id := fsm.nextId()
 
-	ac := make(chan bool)
-	fsm.closeSessionAcks.Put(id, ac)
+	proposal := OpenSessionProposal{ID: id, Request: request}
+	sd, err := fsm.propose(id, proposal.Wrap())
+	if err != nil {
+		return SessionDescriptor{}, err
+	}
+
+	return sd.(SessionDescriptor), nil
+}
 
-	proposal := CloseSessionProposal{ID: id, SD: sd}
-	fsm.proposeC <- Encode(proposal.Wrap())
+func (fsm *raftFSMImpl) CloseSession(request RequestID, sd SessionDescriptor) error {
+	id := fsm.nextId()
 
-	<-ac
+	proposal := CloseSessionProposal{ID: id, Request: request, SD: sd}
+	_, err := fsm.propose(id, proposal.Wrap())
+	return err
 }
 
 func (fsm *raftFSMImpl) GetSession(sd SessionDescriptor) *clientSession {
@@ -236,28 +463,36 @@ func (fsm *raftFSMImpl) GetSessionDescriptors() []SessionDescriptor {
 	return fsm.delegate.GetSessionDescriptors()
 }
 
-func (fsm *raftFSMImpl) OpenNode(sd SessionDescriptor, path string, readOnly bool, config EventsConfig) NodeDescriptor {
+func (fsm *raftFSMImpl) OpenNode(request RequestID, sd SessionDescriptor, path string, readOnly bool, ephemeral bool, config EventsConfig) (NodeDescriptor, error) {
 	id := fsm.nextId()
 
-	ac := make(chan NodeDescriptor)
-	fsm.openNodeAcks.Put(id, ac)
-
-	proposal := OpenNodeProposal{ID: id, SD: sd, Path: path, ReadOnly: readOnly, Config: config}
-	fsm.proposeC <- Encode(proposal.Wrap())
+	proposal := OpenNodeProposal{ID: id, Request: request, SD: sd, Path: path, ReadOnly: readOnly, Ephemeral: ephemeral, Config: config}
+	nd, err := fsm.propose(id, proposal.Wrap())
+	if err != nil {
+		return NodeDescriptor{}, err
+	}
 
-	return <-ac
+	return nd.(NodeDescriptor), nil
 }
 
-func (fsm *raftFSMImpl) CloseNode(nd NodeDescriptor) {
+func (fsm *raftFSMImpl) CloseNode(request RequestID, nd NodeDescriptor) error {
 	id := fsm.nextId()
 
-	ac := make(chan bool)
-	fsm.closeNodeAcks.Put(id, ac)
+	proposal := CloseNodeProposal{ID: id, Request: request, ND: nd}
+	_, err := fsm.propose(id, proposal.Wrap())
+	return err
+}
 
-	proposal := CloseNodeProposal{ID: id, ND: nd}
-	fsm.proposeC <- Encode(proposal.Wrap())
+func (fsm *raftFSMImpl) DeleteNode(request RequestID, nd NodeDescriptor) (bool, error) {
+	id := fsm.nextId()
+
+	proposal := DeleteNodeProposal{ID: id, Request: request, ND: nd}
+	succ, err := fsm.propose(id, proposal.Wrap())
+	if err != nil {
+		return false, err
+	}
 
-	<-ac
+	return succ.(bool), nil
 }
 
 func (fsm *raftFSMImpl) GetNodeDescriptor(nd NodeDescriptor) *nodeDescriptor {
@@ -268,127 +503,228 @@ func (fsm *raftFSMImpl) GetUnfinalizedNodes() []*nodeInfo {
 	return fsm.delegate.GetUnfinalizedNodes()
 }
 
-func (fsm *raftFSMImpl) SetLocked(nd NodeDescriptor) {
+func (fsm *raftFSMImpl) GetLockedNodes() []*nodeInfo {
+	return fsm.delegate.GetLockedNodes()
+}
+
+func (fsm *raftFSMImpl) GetLockDelayedNodes() []*nodeInfo {
+	return fsm.delegate.GetLockDelayedNodes()
+}
+
+func (fsm *raftFSMImpl) GetNode(path string) *nodeInfo {
+	return fsm.delegate.GetNode(path)
+}
+
+func (fsm *raftFSMImpl) GetEphemeralNodes(sd SessionDescriptor) []string {
+	return fsm.delegate.GetEphemeralNodes(sd)
+}
+
+func (fsm *raftFSMImpl) ListChildren(dir string) []DirEntry {
+	return fsm.delegate.ListChildren(dir)
+}
+
+func (fsm *raftFSMImpl) SetLocked(request RequestID, nd NodeDescriptor) error {
 	id := fsm.nextId()
 
-	ac := make(chan bool)
-	fsm.tryAcquireAcks.Put(id, ac)
+	proposal := TryAcquireProposal{ID: id, Request: request, ND: nd}
+	_, err := fsm.propose(id, proposal.Wrap())
+	return err
+}
+
+func (fsm *raftFSMImpl) SetSharedLocked(request RequestID, nd NodeDescriptor) error {
+	id := fsm.nextId()
+
+	proposal := TryAcquireProposal{ID: id, Request: request, ND: nd, Shared: true}
+	_, err := fsm.propose(id, proposal.Wrap())
+	return err
+}
+
+func (fsm *raftFSMImpl) ReleaseLock(request RequestID, nd NodeDescriptor, lost time.Time) (bool, error) {
+	id := fsm.nextId()
 
-	proposal := TryAcquireProposal{ID: id, ND: nd}
-	fsm.proposeC <- Encode(proposal.Wrap())
+	proposal := ReleaseProposal{ID: id, Request: request, ND: nd, Lost: lost}
+	succ, err := fsm.propose(id, proposal.Wrap())
+	if err != nil {
+		return false, err
+	}
 
-	<-ac
+	return succ.(bool), nil
 }
 
-func (fsm *raftFSMImpl) ReleaseLock(nd NodeDescriptor) bool {
+func (fsm *raftFSMImpl) SetLockDelay(request RequestID, nd NodeDescriptor, delay time.Duration) (bool, error) {
 	id := fsm.nextId()
 
-	ac := make(chan bool)
-	fsm.releaseAcks.Put(id, ac)
+	proposal := SetLockDelayProposal{ID: id, Request: request, ND: nd, Delay: delay}
+	succ, err := fsm.propose(id, proposal.Wrap())
+	if err != nil {
+		return false, err
+	}
 
-	proposal := ReleaseProposal{ID: id, ND: nd}
-	fsm.proposeC <- Encode(proposal.Wrap())
+	return succ.(bool), nil
+}
 
-	return <-ac
+func (fsm *raftFSMImpl) GetSequencer(nd NodeDescriptor) (Sequencer, bool) {
+	return fsm.delegate.GetSequencer(nd)
+}
+
+func (fsm *raftFSMImpl) CheckSequencer(seq Sequencer) bool {
+	return fsm.delegate.CheckSequencer(seq)
 }
 
 func (fsm *raftFSMImpl) GetContentAndStat(nd NodeDescriptor) NodeContentAndStat {
 	return fsm.delegate.GetContentAndStat(nd)
 }
 
-func (fsm *raftFSMImpl) PrepareSetContent(nd NodeDescriptor, cas NodeContentAndStat) bool {
+func (fsm *raftFSMImpl) PrepareSetContent(request RequestID, nd NodeDescriptor, cas NodeContentAndStat) (bool, error) {
 	id := fsm.nextId()
 
-	ac := make(chan bool)
-	fsm.setContentAcks.Put(id, ac)
-
-	proposal := PrepareSetContentProposal{ID: id, ND: nd, CAS: cas}
-	fsm.proposeC <- Encode(proposal.Wrap())
+	proposal := PrepareSetContentProposal{ID: id, Request: request, ND: nd, CAS: cas}
+	succ, err := fsm.propose(id, proposal.Wrap())
+	if err != nil {
+		return false, err
+	}
 
-	return <-ac
+	return succ.(bool), nil
 }
 
-func (fsm *raftFSMImpl) FinalizeSetContent(path string) {
+func (fsm *raftFSMImpl) FinalizeSetContent(path string) error {
 	id := fsm.nextId()
 
-	ac := make(chan bool)
-	fsm.finalizeSetContentAcks.Put(id, ac)
-
 	proposal := FinalizeSetContentProposal{ID: id, Path: path}
-	fsm.proposeC <- Encode(proposal.Wrap())
-
-	<-ac
+	_, err := fsm.propose(id, proposal.Wrap())
+	return err
 }
 
-func (fsm *raftFSMImpl) Nop(garbage int) {
+func (fsm *raftFSMImpl) Nop(garbage int) error {
 	id := fsm.nextId()
 
-	ac := make(chan bool)
-	fsm.nopProposalAcks.Put(id, ac)
-
 	proposal := NopProposal{ID: id, Garbage: garbage}
+	_, err := fsm.propose(id, proposal.Wrap())
+	return err
+}
 
-	fsm.proposeC <- Encode(proposal.Wrap())
+func (fsm *raftFSMImpl) GetStats() FSMStats {
+	return fsm.delegate.GetStats()
+}
 
-	<-ac
+func (fsm *raftFSMImpl) GetRequestResult(sd SessionDescriptor, id RequestID) (requestResult, bool) {
+	return fsm.delegate.GetRequestResult(sd, id)
 }
 
-func (fsm *raftFSMImpl) readFromLog() {
-	for operation := range fsm.committedC {
-		if operation == nil {
-			log.Println("nil operation")
-			continue
+func (fsm *raftFSMImpl) ReadBarrier() error {
+	if fsm.readIndex != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), fsm.proposalTimeout)
+		defer cancel()
+
+		if err := fsm.readIndex(ctx); err == context.DeadlineExceeded {
+			return ErrReadTimeout
+		} else if err != nil {
+			return err
 		}
+	}
 
-		proposal := Decode(*operation)
-		switch p := proposal.(type) {
-		case OpenSessionProposal:
-			sd := fsm.delegate.OpenSession()
-			if ch := fsm.openSessionAcks.Get(p.ID); ch != nil {
-				ch.(chan SessionDescriptor) <- sd
-			}
-		case CloseSessionProposal:
-			fsm.delegate.CloseSession(p.SD)
-			if ch := fsm.closeSessionAcks.Get(p.ID); ch != nil {
-				ch.(chan bool) <- true
-			}
-		case OpenNodeProposal:
-			nd := fsm.delegate.OpenNode(p.SD, p.Path, p.ReadOnly, p.Config)
-			if ch := fsm.openNodeAcks.Get(p.ID); ch != nil {
-				ch.(chan NodeDescriptor) <- nd
-			}
-		case CloseNodeProposal:
-			fsm.delegate.CloseNode(p.ND)
-			if ch := fsm.closeNodeAcks.Get(p.ID); ch != nil {
-				ch.(chan bool) <- true
-			}
-		case TryAcquireProposal:
-			fsm.delegate.SetLocked(p.ND)
-			if ch := fsm.tryAcquireAcks.Get(p.ID); ch != nil {
-				ch.(chan bool) <- true
-			}
-		case ReleaseProposal:
-			succ := fsm.delegate.ReleaseLock(p.ND)
-			if ch := fsm.releaseAcks.Get(p.ID); ch != nil {
-				ch.(chan bool) <- succ
-			}
-		case PrepareSetContentProposal:
-			succ := fsm.delegate.PrepareSetContent(p.ND, p.CAS)
-			if ch := fsm.setContentAcks.Get(p.ID); ch != nil {
-				ch.(chan bool) <- succ
+	// the entries up to the read index have been handed to the log reading goroutine, so once it gets to the
+	// barrier they have all been applied
+	done := make(chan struct{})
+	fsm.barriers <- done
+	<-done
+	return nil
+}
+
+// GetSnapshot is served by the log reading goroutine so that the snapshot reflects exactly the entries that have
+// been committed so far, even if one of them is still being applied when the snapshot is requested.
+func (fsm *raftFSMImpl) GetSnapshot() ([]byte, error) {
+	rc := make(chan snapshotResult)
+	fsm.snapshotRequests <- rc
+	result := <-rc
+	return result.data, result.err
+}
+
+// RecoverFromSnapshot must only be called before any entries are committed, snapshots received later on
+// arrive through the log as a RestoreSnapshotProposal.
+func (fsm *raftFSMImpl) RecoverFromSnapshot(data []byte) error {
+	return fsm.delegate.RecoverFromSnapshot(data)
+}
+
+func (fsm *raftFSMImpl) readFromLog() {
+	for {
+		select {
+		case operation, ok := <-fsm.committedC:
+			if !ok {
+				close(fsm.stopped)
+				return
 			}
-		case FinalizeSetContentProposal:
-			fsm.delegate.FinalizeSetContent(p.Path)
-			if ch := fsm.finalizeSetContentAcks.Get(p.ID); ch != nil {
-				ch.(chan bool) <- true
+			if operation == nil {
+				log.Println("nil operation")
+				continue
 			}
-		case NopProposal:
-			fsm.delegate.Nop(p.Garbage)
-			if ch := fsm.nopProposalAcks.Get(p.ID); ch != nil {
-				ch.(chan bool) <- true
+			op, err := Decode(*operation)
+			if err != nil {
+				log.Fatal("unable to decode log entry: ", err)
 			}
-		default:
-			log.Println("unrecognized operation:", proposal)
+			fsm.apply(op)
+		case rc := <-fsm.snapshotRequests:
+			data, err := fsm.delegate.GetSnapshot()
+			rc <- snapshotResult{data, err}
+		case done := <-fsm.barriers:
+			close(done)
 		}
 	}
 }
+
+// apply applies a committed proposal to the delegate. the local fsm only fails on requests that are invalid on
+// every replica, like closing a session that doesn't exist, and otherwise its errors are ignored.
+func (fsm *raftFSMImpl) apply(proposal interface{}) {
+	switch p := proposal.(type) {
+	case OpenSessionProposal:
+		sd, _ := fsm.delegate.OpenSession(p.Request)
+		fsm.ack(p.ID, sd)
+	case CloseSessionProposal:
+		if err := fsm.delegate.CloseSession(p.Request, p.SD); err != nil {
+			fsm.fail(p.ID, err)
+		} else {
+			fsm.ack(p.ID, true)
+		}
+	case OpenNodeProposal:
+		nd, _ := fsm.delegate.OpenNode(p.Request, p.SD, p.Path, p.ReadOnly, p.Ephemeral, p.Config)
+		fsm.ack(p.ID, nd)
+	case CloseNodeProposal:
+		fsm.delegate.CloseNode(p.Request, p.ND)
+		fsm.ack(p.ID, true)
+	case DeleteNodeProposal:
+		succ, _ := fsm.delegate.DeleteNode(p.Request, p.ND)
+		fsm.ack(p.ID, succ)
+	case TryAcquireProposal:
+		if p.Shared {
+			fsm.delegate.SetSharedLocked(p.Request, p.ND)
+		} else {
+			fsm.delegate.SetLocked(p.Request, p.ND)
+		}
+		fsm.ack(p.ID, true)
+	case ReleaseProposal:
+		succ, _ := fsm.delegate.ReleaseLock(p.Request, p.ND, p.Lost)
+		fsm.ack(p.ID, succ)
+	case SetLockDelayProposal:
+		succ, _ := fsm.delegate.SetLockDelay(p.Request, p.ND, p.Delay)
+		fsm.ack(p.ID, succ)
+	case PrepareSetContentProposal:
+		succ, _ := fsm.delegate.PrepareSetContent(p.Request, p.ND, p.CAS)
+		fsm.ack(p.ID, succ)
+	case FinalizeSetContentProposal:
+		fsm.delegate.FinalizeSetContent(p.Path)
+		fsm.ack(p.ID, true)
+	case NopProposal:
+		fsm.delegate.Nop(p.Garbage)
+		fsm.ack(p.ID, true)
+	case BatchProposal:
+		for _, proposal := range p.Proposals {
+			fsm.apply(proposal.Get())
+		}
+	case RestoreSnapshotProposal:
+		if err := fsm.delegate.RecoverFromSnapshot(p.Data); err != nil {
+			log.Fatal("unable to restore snapshot:", err)
+		}
+	default:
+		log.Println("unrecognized operation:", proposal)
+	}
+}
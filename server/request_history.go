@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+)
+
+const (
+	// how many of its most recent requests a session remembers the results of
+	requestHistorySize = 1024
+)
+
+// RequestID identifies a single call that changes the state, so that a client can retry the call after a
+// failover without it being applied twice. Clients pick a new one with NewRequestID for every call and reuse
+// it for that call's retries. Calls made with NoRequestID are never deduplicated.
+type RequestID uint64
+
+const NoRequestID RequestID = 0
+
+func NewRequestID() RequestID {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		if id := RequestID(binary.LittleEndian.Uint64(b[:])); id != NoRequestID {
+			return id
+		}
+	}
+}
+
+// requestResult is what a request returned the first time it was applied.
+// only the fields that the request's fsm method returns are set.
+type requestResult struct {
+	SD SessionDescriptor
+	ND NodeDescriptor
+	OK bool
+}
+
+type recordedRequest struct {
+	ID     RequestID
+	Result requestResult
+}
+
+// requestHistory remembers the results of the last requestHistorySize requests. it is part of the replicated
+// state, so it is only written while applying and every replica forgets the same requests.
+type requestHistory struct {
+	lock    sync.Mutex
+	results map[RequestID]requestResult
+	order   []RequestID
+}
+
+func newRequestHistory() *requestHistory {
+	return &requestHistory{results: make(map[RequestID]requestResult)}
+}
+
+func (rh *requestHistory) Get(id RequestID) (requestResult, bool) {
+	if rh == nil {
+		return requestResult{}, false
+	}
+
+	rh.lock.Lock()
+	defer rh.lock.Unlock()
+
+	result, ok := rh.results[id]
+	return result, ok
+}
+
+func (rh *requestHistory) Put(id RequestID, result requestResult) {
+	if rh == nil {
+		return
+	}
+
+	rh.lock.Lock()
+	defer rh.lock.Unlock()
+
+	if _, ok := rh.results[id]; !ok {
+		rh.order = append(rh.order, id)
+	}
+	rh.results[id] = result
+
+	for len(rh.order) > requestHistorySize {
+		delete(rh.results, rh.order[0])
+		rh.order = rh.order[1:]
+	}
+}
+
+// snapshot returns the remembered requests from oldest to newest
+func (rh *requestHistory) snapshot() []recordedRequest {
+	rh.lock.Lock()
+	defer rh.lock.Unlock()
+
+	var rrs []recordedRequest
+	for _, id := range rh.order {
+		rrs = append(rrs, recordedRequest{id, rh.results[id]})
+	}
+	return rrs
+}
+
+// restore replaces the remembered requests with rrs, which are ordered from oldest to newest
+func (rh *requestHistory) restore(rrs []recordedRequest) {
+	rh.lock.Lock()
+	rh.results = make(map[RequestID]requestResult)
+	rh.order = nil
+	rh.lock.Unlock()
+
+	for _, rr := range rrs {
+		rh.Put(rr.ID, rr.Result)
+	}
+}
@@ -3,6 +3,9 @@ package server
 import (
 	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 func DoServerTest_KeepAlive(t *testing.T, s Server) {
@@ -14,7 +17,7 @@ func DoServerTest_KeepAlive(t *testing.T, s Server) {
 		}
 	}
 
-	sd, err := s.OpenSession()
+	sd, err := s.OpenSession(NewRequestID())
 	ne("Error opening session:", err)
 
 	events, err := s.KeepAlive(LeaseInfo{Session: sd}, nil, 1)
@@ -24,11 +27,11 @@ func DoServerTest_KeepAlive(t *testing.T, s Server) {
 	}
 
 	// test with LeaseInfo that claims to have a lock we don't have
-	nd, err := s.Open(sd, "/foo/bar", false, EventsConfig{})
+	nd, err := s.Open(NewRequestID(), sd, "/foo/bar", false, false, EventsConfig{})
 	ne("Error opening /foo/bar:", err)
 
 	// expect to get lock invalidation event
-	bogusLeaseInfo := LeaseInfo{sd, []NodeDescriptor{nd}}
+	bogusLeaseInfo := LeaseInfo{Session: sd, LockedNodes: []NodeDescriptor{nd}}
 	events, err = s.KeepAlive(bogusLeaseInfo, nil, 1)
 	ne("KeepAlive with bogus LeaseInfo", err)
 	if len(events) != 1 {
@@ -44,13 +47,13 @@ func DoServerTest_KeepAlive(t *testing.T, s Server) {
 	}
 
 	// test case where we do have a lock
-	ok, err := s.TryAcquire(nd)
+	ok, err := s.TryAcquire(NewRequestID(), nd)
 	ne("TryAcquire", err)
 	if !ok {
 		t.Error("Failed to acquire lock")
 	}
 
-	goodLeaseInfo := LeaseInfo{sd, []NodeDescriptor{nd}}
+	goodLeaseInfo := LeaseInfo{Session: sd, LockedNodes: []NodeDescriptor{nd}}
 	events, err = s.KeepAlive(goodLeaseInfo, nil, 1)
 	ne("KeepAlive with good LeaseInfo", err)
 	if len(events) != 0 {
@@ -67,10 +70,10 @@ func DoServerTest_OpenGetSet(t *testing.T, s Server) {
 
 	contents := []string{"some content", "dog", "foo bar", "foo bar"}
 
-	sd, err := s.OpenSession()
+	sd, err := s.OpenSession(NewRequestID())
 	ne("Error opening session:", err)
 
-	nd, err := s.Open(sd, "/foo/bar", false, EventsConfig{})
+	nd, err := s.Open(NewRequestID(), sd, "/foo/bar", false, false, EventsConfig{})
 	ne("Error opening /foo/bar:", err)
 
 	cas, err := s.GetContentAndStat(nd)
@@ -84,7 +87,7 @@ func DoServerTest_OpenGetSet(t *testing.T, s Server) {
 
 	oldCas := cas
 	for _, content := range contents {
-		ok, err := s.SetContent(nd, content, 16)
+		ok, err := s.SetContent(NewRequestID(), nd, content, 16)
 		ne("Error SetContent /foo/bar:", err)
 		if !ok {
 			t.Error("Failed write for SetContent")
@@ -118,10 +121,10 @@ func DoServerTest_OpenReadOnly(t *testing.T, s Server) {
 		}
 	}
 
-	sd, err := s.OpenSession()
+	sd, err := s.OpenSession(NewRequestID())
 	ne("Error opening session:", err)
 
-	nd, err := s.Open(sd, "/foo/bar", true, EventsConfig{})
+	nd, err := s.Open(NewRequestID(), sd, "/foo/bar", true, false, EventsConfig{})
 	ne("Error opening /foo/bar:", err)
 
 	cas, err := s.GetContentAndStat(nd)
@@ -133,7 +136,7 @@ func DoServerTest_OpenReadOnly(t *testing.T, s Server) {
 		t.Error("Generation not initialized to 0")
 	}
 
-	_, err = s.SetContent(nd, "foo", 16)
+	_, err = s.SetContent(NewRequestID(), nd, "foo", 16)
 	ae("Expected error from SetContent with read only Descriptor", err)
 
 	oldCas := cas
@@ -147,10 +150,10 @@ func DoServerTest_OpenReadOnly(t *testing.T, s Server) {
 	err = s.Acquire(nd)
 	ae("Expected error from Acquire with read only Descriptor", err)
 
-	_, err = s.TryAcquire(nd)
+	_, err = s.TryAcquire(NewRequestID(), nd)
 	ae("Expected error from TryAcquire with read only Descriptor", err)
 
-	err = s.Release(nd)
+	err = s.Release(NewRequestID(), nd)
 	ae("Expected error from Release with read only Descriptor", err)
 }
 
@@ -161,10 +164,10 @@ func DoServerTest_SetContentGeneration(t *testing.T, s Server) {
 		}
 	}
 
-	sd, err := s.OpenSession()
+	sd, err := s.OpenSession(NewRequestID())
 	ne("Error opening session:", err)
 
-	nd, err := s.Open(sd, "/foo/bar", false, EventsConfig{})
+	nd, err := s.Open(NewRequestID(), sd, "/foo/bar", false, false, EventsConfig{})
 	ne("Error opening /foo/bar:", err)
 
 	cas, err := s.GetContentAndStat(nd)
@@ -177,7 +180,7 @@ func DoServerTest_SetContentGeneration(t *testing.T, s Server) {
 	}
 
 	// when a node is first created, any generation value should succeed:
-	ok, err := s.SetContent(nd, "foo", 0)
+	ok, err := s.SetContent(NewRequestID(), nd, "foo", 0)
 	ne("Error SetContent generation 0", err)
 	if !ok {
 		t.Error("Failed initial SetContent with generation 0")
@@ -194,7 +197,7 @@ func DoServerTest_SetContentGeneration(t *testing.T, s Server) {
 	}
 
 	// generation is now 1, so a generation value of 0 should nop
-	ok, err = s.SetContent(nd, "bar", 0)
+	ok, err = s.SetContent(NewRequestID(), nd, "bar", 0)
 	ne("Error SetContent generation 0 second round", err)
 	if ok {
 		t.Error("Erroneously succeeded in setting content when generation was too low")
@@ -208,7 +211,7 @@ func DoServerTest_SetContentGeneration(t *testing.T, s Server) {
 	}
 
 	// now do a set with the correct minimum generation value, 1
-	ok, err = s.SetContent(nd, "bar", 1)
+	ok, err = s.SetContent(NewRequestID(), nd, "bar", 1)
 	ne("Error SetContent generation 1", err)
 	if !ok {
 		t.Error("Failed SetContent with generation 1 (high enough that should not nop)")
@@ -244,10 +247,10 @@ func DoServerTest_ConcurrentOpen(t *testing.T, s Server) {
 			// wait until all children are created to do concurrent open
 			mainDone1.Wait()
 
-			sd, err := s.OpenSession()
+			sd, err := s.OpenSession(NewRequestID())
 			ne("Error opening session:", err)
 
-			nd, err := s.Open(sd, "/foo/baz", false, EventsConfig{})
+			nd, err := s.Open(NewRequestID(), sd, "/foo/baz", false, false, EventsConfig{})
 			ne("Error opening file in child:", err)
 
 			// signal that this child is done and wait until main is done
@@ -273,14 +276,14 @@ func DoServerTest_ConcurrentOpen(t *testing.T, s Server) {
 	mainDone1.Done()
 	childrenDone.Wait()
 
-	sd, err := s.OpenSession()
+	sd, err := s.OpenSession(NewRequestID())
 	ne("Error opening session:", err)
 
 	// set the content so that all of the children can read it
-	nd, err := s.Open(sd, "/foo/baz", false, EventsConfig{})
+	nd, err := s.Open(NewRequestID(), sd, "/foo/baz", false, false, EventsConfig{})
 	ne("Error opening file in main:", err)
 
-	ok, err := s.SetContent(nd, content, 10)
+	ok, err := s.SetContent(NewRequestID(), nd, content, 10)
 	ne("Error setting content from main:", err)
 	if !ok {
 		t.Error("Failed to set content from main")
@@ -299,39 +302,39 @@ func DoServerTest_TryAcquire(t *testing.T, s Server) {
 		}
 	}
 
-	sd, err := s.OpenSession()
+	sd, err := s.OpenSession(NewRequestID())
 	ne("Error opening session:", err)
 
-	nd, err := s.Open(sd, "/foo/bar", false, EventsConfig{})
+	nd, err := s.Open(NewRequestID(), sd, "/foo/bar", false, false, EventsConfig{})
 	ne("Error opening /foo/bar:", err)
 
-	err = s.Release(nd)
+	err = s.Release(NewRequestID(), nd)
 	if err == nil {
 		t.Error("Failed to error when releasing a lock not held")
 	}
 
-	ok, err := s.TryAcquire(nd)
+	ok, err := s.TryAcquire(NewRequestID(), nd)
 	ne("Error TryAcquire:", err)
 	if !ok {
 		t.Error("Failed to acquire lock with TryAcquire starting from default state")
 	}
 
-	ok, err = s.TryAcquire(nd)
+	ok, err = s.TryAcquire(NewRequestID(), nd)
 	ne("Error TryAcquire after TryAcquire:", err)
 	if ok {
 		t.Error("Acquired lock for a second time")
 	}
 
-	err = s.Release(nd)
+	err = s.Release(NewRequestID(), nd)
 	ne("Error Release:", err)
 
-	ok, err = s.TryAcquire(nd)
+	ok, err = s.TryAcquire(NewRequestID(), nd)
 	ne("Error TryAcquire after Release:", err)
 	if !ok {
 		t.Error("Failed to acquire lock after Release")
 	}
 
-	ok, err = s.TryAcquire(nd)
+	ok, err = s.TryAcquire(NewRequestID(), nd)
 	ne("Error TryAcquire after TryAcquire:", err)
 	if ok {
 		t.Error("Acquired lock for a second time")
@@ -345,23 +348,745 @@ func DoServerTest_BadRelease(t *testing.T, s Server) {
 		}
 	}
 
-	sd, err := s.OpenSession()
+	sd, err := s.OpenSession(NewRequestID())
 	ne("Error opening session:", err)
 
-	nd1, err := s.Open(sd, "/foo/bar", false, EventsConfig{})
+	nd1, err := s.Open(NewRequestID(), sd, "/foo/bar", false, false, EventsConfig{})
 	ne("Error opening /foo/bar nd1:", err)
 
-	nd2, err := s.Open(sd, "/foo/bar", false, EventsConfig{})
+	nd2, err := s.Open(NewRequestID(), sd, "/foo/bar", false, false, EventsConfig{})
 	ne("Error opening /foo/bar nd2:", err)
 
-	ok, err := s.TryAcquire(nd1)
+	ok, err := s.TryAcquire(NewRequestID(), nd1)
 	ne("Acquiring nd1", err)
 	if !ok {
 		t.Error("Unable to acquire lock")
 	}
 
-	err = s.Release(nd2)
+	err = s.Release(NewRequestID(), nd2)
 	if err == nil {
 		t.Error("Erroneously released lock that we do not own")
 	}
 }
+
+func DoServerTest_Delete(t *testing.T, s Server) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	sd, err := s.OpenSession(NewRequestID())
+	ne("Error opening session:", err)
+
+	nd, err := s.Open(NewRequestID(), sd, "/foo/deleted", false, false, EventsConfig{})
+	ne("Error opening /foo/deleted:", err)
+
+	readOnlyNd, err := s.Open(NewRequestID(), sd, "/foo/deleted", true, false, EventsConfig{})
+	ne("Error opening /foo/deleted read only:", err)
+
+	err = s.Delete(NewRequestID(), readOnlyNd)
+	if err == nil {
+		t.Error("Deleted node from read only Descriptor")
+	}
+
+	ok, err := s.TryAcquire(NewRequestID(), nd)
+	ne("Error TryAcquire:", err)
+	if !ok {
+		t.Error("Failed to acquire lock before Delete")
+	}
+
+	err = s.Delete(NewRequestID(), nd)
+	ne("Error Delete:", err)
+
+	// every descriptor on the deleted node should now be invalid
+	_, err = s.GetContentAndStat(nd)
+	if err == nil {
+		t.Error("GetContentAndStat succeeded on deleted node")
+	}
+	_, err = s.GetContentAndStat(readOnlyNd)
+	if err == nil {
+		t.Error("GetContentAndStat succeeded from read only Descriptor on deleted node")
+	}
+	err = s.Delete(NewRequestID(), nd)
+	if err == nil {
+		t.Error("Deleted the same node twice")
+	}
+
+	// opening the path again should create a fresh, unlocked node
+	nd, err = s.Open(NewRequestID(), sd, "/foo/deleted", false, false, EventsConfig{})
+	ne("Error reopening /foo/deleted:", err)
+
+	cas, err := s.GetContentAndStat(nd)
+	ne("Error GetContentAndStat after reopen:", err)
+	if cas.Content != "" || cas.Stat.Generation != 0 {
+		t.Error("Recreated node was not empty:", cas)
+	}
+
+	ok, err = s.TryAcquire(NewRequestID(), nd)
+	ne("Error TryAcquire after reopen:", err)
+	if !ok {
+		t.Error("Lock survived Delete")
+	}
+}
+
+func DoServerTest_List(t *testing.T, s Server) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	sd, err := s.OpenSession(NewRequestID())
+	ne("Error opening session:", err)
+
+	for _, path := range []string{"/list/b", "/list/a", "/list/dir/c"} {
+		_, err := s.Open(NewRequestID(), sd, path, false, false, EventsConfig{})
+		ne("Error opening "+path+":", err)
+	}
+
+	entries, err := s.List(sd, "/list")
+	ne("Error List /list:", err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if len(names) != 3 || names[0] != "a" || names[1] != "b" || names[2] != "dir" {
+		t.Error("Wrong entries for /list, expected [a b dir], got:", names)
+	}
+
+	entries, err = s.List(sd, "/list/dir/")
+	ne("Error List /list/dir/:", err)
+	if len(entries) != 1 || entries[0].Name != "c" {
+		t.Error("Wrong entries for /list/dir/, expected [c], got:", entries)
+	}
+
+	entries, err = s.List(sd, "/list/missing")
+	ne("Error List /list/missing:", err)
+	if len(entries) != 0 {
+		t.Error("Got entries for a directory that does not exist:", entries)
+	}
+
+	_, err = s.List(SessionDescriptor{Descriptor: 1 << 32}, "/list")
+	if err == nil {
+		t.Error("List succeeded with an invalid session")
+	}
+}
+
+func DoServerTest_Ephemeral(t *testing.T, s Server) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	owner, err := s.OpenSession(NewRequestID())
+	ne("Error opening owner session:", err)
+
+	other, err := s.OpenSession(NewRequestID())
+	ne("Error opening other session:", err)
+
+	_, err = s.Open(NewRequestID(), owner, "/ephemeral/node", false, true, EventsConfig{})
+	ne("Error opening ephemeral node:", err)
+	permanentNd, err := s.Open(NewRequestID(), other, "/ephemeral/permanent", false, false, EventsConfig{})
+	ne("Error opening permanent node:", err)
+
+	// permanent nodes have no owner, so closing a session that doesn't exist must not delete them
+	for _, bogus := range []SessionDescriptor{{}, {Descriptor: 1 << 40}} {
+		if err := s.CloseSession(NewRequestID(), bogus); err == nil || err.Error() != ErrInvalidSessionDescriptor.Error() {
+			t.Error("Expected invalid session closing unknown session", bogus, "got:", err)
+		}
+	}
+	_, err = s.GetContentAndStat(permanentNd)
+	ne("Permanent node gone after closing unknown sessions:", err)
+
+	// opening an existing ephemeral node from another session should not take ownership of it
+	otherNd, err := s.Open(NewRequestID(), other, "/ephemeral/node", true, true, EventsConfig{})
+	ne("Error opening ephemeral node from other session:", err)
+
+	entries, err := s.List(other, "/ephemeral")
+	ne("Error List /ephemeral:", err)
+	if len(entries) != 2 || entries[0].Name != "node" {
+		t.Error("Ephemeral node not listed:", entries)
+	}
+
+	err = s.CloseSession(NewRequestID(), owner)
+	ne("Error closing owner session:", err)
+
+	_, err = s.GetContentAndStat(otherNd)
+	if err == nil {
+		t.Error("Ephemeral node still readable after owner session closed")
+	}
+
+	entries, err = s.List(other, "/ephemeral")
+	ne("Error List /ephemeral after close:", err)
+	if len(entries) != 1 || entries[0].Name != "permanent" {
+		t.Error("Ephemeral node still listed after owner session closed:", entries)
+	}
+}
+
+func DoServerTest_AcquireFIFO(t *testing.T, s Server) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	open := func() NodeDescriptor {
+		sd, err := s.OpenSession(NewRequestID())
+		ne("Error opening session:", err)
+
+		nd, err := s.Open(NewRequestID(), sd, "/foo/fifo", false, false, EventsConfig{})
+		ne("Error opening /foo/fifo:", err)
+		return nd
+	}
+
+	holder := open()
+	ne("Error Acquire with no contention:", s.Acquire(holder))
+
+	// queue up the waiters one at a time so that their order is known
+	acquired := make(chan NodeDescriptor)
+	var waiters []NodeDescriptor
+	for i := 0; i < 3; i++ {
+		nd := open()
+		waiters = append(waiters, nd)
+		go func() {
+			ne("Error Acquire while waiting:", s.Acquire(nd))
+			acquired <- nd
+		}()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ok, err := s.TryAcquire(NewRequestID(), open())
+	ne("Error TryAcquire with waiters:", err)
+	if ok {
+		t.Error("TryAcquire cut in front of waiting Acquire calls")
+	}
+
+	ne("Error Release by holder:", s.Release(NewRequestID(), holder))
+	for _, expected := range waiters {
+		select {
+		case nd := <-acquired:
+			if nd != expected {
+				t.Error("Lock granted out of order, expected:", expected, "got:", nd)
+			}
+			ne("Error Release by waiter:", s.Release(NewRequestID(), nd))
+		case <-time.After(5 * time.Second):
+			t.Fatal("Waiter was never granted the lock:", expected)
+		}
+	}
+}
+
+func DoServerTest_AcquireContext(t *testing.T, s Server) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	open := func() NodeDescriptor {
+		sd, err := s.OpenSession(NewRequestID())
+		ne("Error opening session:", err)
+
+		nd, err := s.Open(NewRequestID(), sd, "/foo/ctx", false, false, EventsConfig{})
+		ne("Error opening /foo/ctx:", err)
+		return nd
+	}
+
+	holder := open()
+	ne("Error Acquire with no contention:", s.Acquire(holder))
+
+	// a waiter whose deadline passes should give up
+	timedOut := open()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := s.AcquireContext(ctx, timedOut); err == nil {
+		t.Error("AcquireContext succeeded while lock was held")
+	}
+
+	// and so should one that is cancelled
+	cancelled := open()
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+	if err := s.AcquireContext(ctx, cancelled); err == nil {
+		t.Error("AcquireContext succeeded after being cancelled")
+	}
+
+	// a cancel that gets to the server before the wait does still has to end the wait
+	acquireCancelled := func(ctx context.Context, nd NodeDescriptor) {
+		errC := make(chan error, 1)
+		go func() {
+			errC <- s.AcquireContext(ctx, nd)
+		}()
+		select {
+		case err := <-errC:
+			if err == nil {
+				t.Error("AcquireContext succeeded after being cancelled")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("AcquireContext still waiting after being cancelled")
+		}
+	}
+	for i := 0; i < 20; i++ {
+		ctx, cancel = context.WithCancel(context.Background())
+		cancel()
+		acquireCancelled(ctx, cancelled)
+
+		ctx, cancel = context.WithCancel(context.Background())
+		go cancel()
+		acquireCancelled(ctx, cancelled)
+	}
+
+	bogus := cancelled
+	bogus.Descriptor += 1000
+	if err := s.CancelAcquire(bogus); err == nil || err.Error() != ErrInvalidNodeDescriptor.Error() {
+		t.Error("Expected invalid node descriptor from CancelAcquire, got:", err)
+	}
+
+	// neither of them should still be queued for the lock
+	ne("Error Release by holder:", s.Release(NewRequestID(), holder))
+	ok, err := s.TryAcquire(NewRequestID(), open())
+	ne("Error TryAcquire after waiters gave up:", err)
+	if !ok {
+		t.Error("Abandoned AcquireContext calls are still waiting for the lock")
+	}
+}
+
+func DoServerTest_Sequencer(t *testing.T, s Server) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	open := func() NodeDescriptor {
+		sd, err := s.OpenSession(NewRequestID())
+		ne("Error opening session:", err)
+
+		nd, err := s.Open(NewRequestID(), sd, "/foo/seq", false, false, EventsConfig{})
+		ne("Error opening /foo/seq:", err)
+		return nd
+	}
+
+	first := open()
+	if _, err := s.GetSequencer(first); err == nil {
+		t.Error("GetSequencer succeeded without holding the lock")
+	}
+
+	ne("Error Acquire by first:", s.Acquire(first))
+	seq1, err := s.GetSequencer(first)
+	ne("Error GetSequencer by first:", err)
+
+	valid, err := s.CheckSequencer(seq1)
+	ne("Error CheckSequencer while held:", err)
+	if !valid {
+		t.Error("Sequencer of current holder was rejected:", seq1)
+	}
+
+	cas, err := s.GetContentAndStat(first)
+	ne("Error GetContentAndStat:", err)
+	if cas.Stat.LockGeneration != seq1.LockGeneration {
+		t.Error("NodeStat lock generation", cas.Stat.LockGeneration, "does not match sequencer", seq1.LockGeneration)
+	}
+
+	ne("Error Release by first:", s.Release(NewRequestID(), first))
+	valid, err = s.CheckSequencer(seq1)
+	ne("Error CheckSequencer after release:", err)
+	if valid {
+		t.Error("Sequencer was accepted after its lock was released:", seq1)
+	}
+
+	second := open()
+	ne("Error Acquire by second:", s.Acquire(second))
+	seq2, err := s.GetSequencer(second)
+	ne("Error GetSequencer by second:", err)
+	if seq2.LockGeneration <= seq1.LockGeneration {
+		t.Error("Lock generation did not increase:", seq1.LockGeneration, seq2.LockGeneration)
+	}
+
+	valid, err = s.CheckSequencer(seq1)
+	ne("Error CheckSequencer of stale holder:", err)
+	if valid {
+		t.Error("Stale sequencer was accepted:", seq1)
+	}
+
+	// shared holders each get a sequencer, which stays valid while other readers come and go
+	check := func(m string, seq Sequencer, expected bool) {
+		valid, err := s.CheckSequencer(seq)
+		ne("Error CheckSequencer "+m+":", err)
+		if valid != expected {
+			t.Error("CheckSequencer", m, "expected:", expected, "got:", valid, seq)
+		}
+	}
+
+	ne("Error Release by second:", s.Release(NewRequestID(), second))
+	reader1, reader2 := open(), open()
+	ne("Error AcquireShared by first reader:", s.AcquireShared(reader1))
+	rseq1, err := s.GetSequencer(reader1)
+	ne("Error GetSequencer by first reader:", err)
+	if !rseq1.Shared || rseq1.LockGeneration <= seq2.LockGeneration {
+		t.Error("Wrong shared sequencer:", rseq1, "after", seq2)
+	}
+
+	ne("Error AcquireShared by second reader:", s.AcquireShared(reader2))
+	rseq2, err := s.GetSequencer(reader2)
+	ne("Error GetSequencer by second reader:", err)
+	check("of first reader", rseq1, true)
+	check("of second reader", rseq2, true)
+
+	exclusive := rseq1
+	exclusive.Shared = false
+	check("of reader passed off as exclusive", exclusive, false)
+
+	// a reader that releases and acquires again has a new holding of the lock
+	ne("Error Release by second reader:", s.Release(NewRequestID(), reader2))
+	check("of released reader", rseq2, false)
+	check("of remaining reader", rseq1, true)
+	ne("Error AcquireShared again by second reader:", s.AcquireShared(reader2))
+	check("of reader from before it released", rseq2, false)
+}
+
+func DoServerTest_SharedLocks(t *testing.T, s Server) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	open := func(readOnly bool) NodeDescriptor {
+		sd, err := s.OpenSession(NewRequestID())
+		ne("Error opening session:", err)
+
+		nd, err := s.Open(NewRequestID(), sd, "/foo/shared", readOnly, false, EventsConfig{})
+		ne("Error opening /foo/shared:", err)
+		return nd
+	}
+
+	tryAcquire := func(nd NodeDescriptor, shared bool, expected bool) {
+		var ok bool
+		var err error
+		if shared {
+			ok, err = s.TryAcquireShared(NewRequestID(), nd)
+		} else {
+			ok, err = s.TryAcquire(NewRequestID(), nd)
+		}
+		ne("Error TryAcquire:", err)
+		if ok != expected {
+			t.Error("TryAcquire shared:", shared, "expected:", expected, "got:", ok)
+		}
+	}
+
+	// readers share the lock, including through read only descriptors
+	reader1 := open(false)
+	reader2 := open(true)
+	tryAcquire(reader1, true, true)
+	ne("Error AcquireShared by second reader:", s.AcquireShared(reader2))
+
+	writer := open(false)
+	tryAcquire(writer, false, false)
+	if err := s.Acquire(reader1); err == nil {
+		t.Error("Expected error acquiring exclusively while holding the lock shared")
+	}
+
+	// a waiting writer keeps new readers from starving it
+	writerAcquired := make(chan struct{})
+	go func() {
+		ne("Error Acquire by writer:", s.Acquire(writer))
+		close(writerAcquired)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	tryAcquire(open(false), true, false)
+
+	ne("Error Release by first reader:", s.Release(NewRequestID(), reader1))
+	select {
+	case <-writerAcquired:
+		t.Error("Writer acquired the lock while a reader still held it")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ne("Error Release by read only reader:", s.Release(NewRequestID(), reader2))
+	select {
+	case <-writerAcquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Writer was never granted the lock")
+	}
+
+	// every reader waiting on the writer gets the lock when it releases
+	readersAcquired := make(chan struct{}, 2)
+	for _, nd := range []NodeDescriptor{reader1, reader2} {
+		go func(nd NodeDescriptor) {
+			ne("Error AcquireShared while waiting:", s.AcquireShared(nd))
+			readersAcquired <- struct{}{}
+		}(nd)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ne("Error Release by writer:", s.Release(NewRequestID(), writer))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-readersAcquired:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Waiting reader was never granted the lock")
+		}
+	}
+}
+
+func DoServerTest_SetLockDelay(t *testing.T, s Server) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	sd, err := s.OpenSession(NewRequestID())
+	ne("Error opening session:", err)
+
+	nd, err := s.Open(NewRequestID(), sd, "/foo/delay", false, false, EventsConfig{})
+	ne("Error opening /foo/delay:", err)
+
+	ne("Error SetLockDelay:", s.SetLockDelay(NewRequestID(), nd, 5*time.Second))
+	cas, err := s.GetContentAndStat(nd)
+	ne("Error GetContentAndStat:", err)
+	if cas.Stat.LockDelay != 5*time.Second {
+		t.Error("Wrong lock delay in stat:", cas.Stat.LockDelay)
+	}
+
+	if err := s.SetLockDelay(NewRequestID(), nd, -time.Second); err == nil {
+		t.Error("Expected error from negative lock delay")
+	}
+	if err := s.SetLockDelay(NewRequestID(), nd, time.Hour); err == nil {
+		t.Error("Expected error from lock delay over the maximum")
+	}
+
+	rnd, err := s.Open(NewRequestID(), sd, "/foo/delay", true, false, EventsConfig{})
+	ne("Error opening /foo/delay read only:", err)
+	if err := s.SetLockDelay(NewRequestID(), rnd, time.Second); err == nil {
+		t.Error("Expected error from SetLockDelay with read only descriptor")
+	}
+}
+
+func DoServerTest_GetContentAndStatFollower(t *testing.T, s Server) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	sd, err := s.OpenSession(NewRequestID())
+	ne("Error opening session:", err)
+
+	nd, err := s.Open(NewRequestID(), sd, "/foo/follower", false, false, EventsConfig{})
+	ne("Error opening /foo/follower:", err)
+
+	ok, err := s.SetContent(NewRequestID(), nd, "followed", 1)
+	ne("Error SetContent:", err)
+	if !ok {
+		t.Error("SetContent failed")
+	}
+
+	cas, err := s.GetContentAndStatFollower(nd)
+	ne("Error GetContentAndStatFollower:", err)
+	if cas.Content != "followed" || cas.Stat.Generation != 1 {
+		t.Error("Wrong content from follower read:", cas)
+	}
+
+	ne("Error closing node:", s.CloseNode(NewRequestID(), nd))
+	if _, err := s.GetContentAndStatFollower(nd); err == nil {
+		t.Error("Expected error from follower read with closed descriptor")
+	}
+}
+
+func DoServerTest_RetriedRequests(t *testing.T, s Server) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	// each request is made twice with the same id, like a client retrying after the reply was lost
+	openID := NewRequestID()
+	sd, err := s.OpenSession(openID)
+	ne("Error opening session:", err)
+	retriedSD, err := s.OpenSession(openID)
+	ne("Error retrying open session:", err)
+	if retriedSD != sd {
+		t.Error("Retried OpenSession opened another session:", retriedSD, "expected:", sd)
+	}
+
+	openNodeID := NewRequestID()
+	nd, err := s.Open(openNodeID, sd, "/foo/retried", false, false, EventsConfig{})
+	ne("Error opening /foo/retried:", err)
+	retriedND, err := s.Open(openNodeID, sd, "/foo/retried", false, false, EventsConfig{})
+	ne("Error retrying open /foo/retried:", err)
+	if retriedND != nd {
+		t.Error("Retried Open opened another descriptor:", retriedND, "expected:", nd)
+	}
+
+	setID := NewRequestID()
+	for i := 0; i < 2; i++ {
+		ok, err := s.SetContent(setID, nd, "retried", 0)
+		ne("Error SetContent:", err)
+		if !ok {
+			t.Error("Retried SetContent failed on attempt", i)
+		}
+	}
+	cas, err := s.GetContentAndStat(nd)
+	ne("Error GetContentAndStat:", err)
+	if cas.Stat.Generation != 1 {
+		t.Error("Retried SetContent applied more than once, generation:", cas.Stat.Generation)
+	}
+
+	acquireID := NewRequestID()
+	for i := 0; i < 2; i++ {
+		ok, err := s.TryAcquire(acquireID, nd)
+		ne("Error TryAcquire:", err)
+		if !ok {
+			t.Error("Retried TryAcquire failed on attempt", i)
+		}
+	}
+	// a new request is applied again, and the lock is already held
+	if ok, _ := s.TryAcquire(NewRequestID(), nd); ok {
+		t.Error("TryAcquire with a new request id acquired a held lock")
+	}
+
+	releaseID := NewRequestID()
+	ne("Error Release:", s.Release(releaseID, nd))
+	ne("Error retrying Release:", s.Release(releaseID, nd))
+	if err := s.Release(NewRequestID(), nd); err == nil {
+		t.Error("Release with a new request id released an unheld lock")
+	}
+
+	deleteID := NewRequestID()
+	ne("Error Delete:", s.Delete(deleteID, nd))
+	ne("Error retrying Delete:", s.Delete(deleteID, nd))
+
+	closeID := NewRequestID()
+	ne("Error CloseSession:", s.CloseSession(closeID, sd))
+	ne("Error retrying CloseSession:", s.CloseSession(closeID, sd))
+}
+
+func DoServerTest_EventStream(t *testing.T, s Server) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	watcher, err := s.OpenSession(NewRequestID())
+	ne("Error opening session:", err)
+	watcherNd, err := s.Open(NewRequestID(), watcher, "/foo/streamed", false, false, EventsConfig{ContentModified: true})
+	ne("Error opening /foo/streamed:", err)
+
+	stream, err := s.OpenEventStream(watcher)
+	if err != nil {
+		t.Fatal("Error opening event stream:", err)
+	}
+	defer stream.Close()
+	ne("Error sending keepalive:", stream.KeepAlive(LeaseInfo{Session: watcher}, nil))
+
+	// the write waits for every descriptor on the node, including the writer's, to ack its invalidation
+	for i := 1; i <= 2; i++ {
+		set := make(chan error, 1)
+		go func() {
+			_, err := s.SetContent(NewRequestID(), watcherNd, "streamed", uint64(i-1))
+			set <- err
+		}()
+
+		events, err := stream.Recv()
+		ne("Error receiving events:", err)
+		if len(events) != 1 || events[0].Seq != uint64(i) {
+			t.Fatal("Got wrong events:", events)
+		} else if event, ok := events[0].Event.(ContentInvalidationPushEvent); !ok || event.Descriptor != watcherNd {
+			t.Fatal("Expected ContentInvalidationPushEvent, got:", events[0].Event)
+		}
+
+		select {
+		case err := <-set:
+			t.Error("SetContent returned before the event was acked:", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		start := time.Now()
+		ne("Error acking events:", stream.Ack(events[0].Seq))
+		ne("Error SetContent:", <-set)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Error("SetContent took too long to return after the ack:", elapsed)
+		}
+	}
+
+	// the stream fails once its session is closed
+	ne("Error closing session:", s.CloseSession(NewRequestID(), watcher))
+	if _, err := stream.Recv(); err == nil || err.Error() != ErrInvalidSessionDescriptor.Error() {
+		t.Error("Expected invalid session from stream of closed session, got:", err)
+	}
+	if _, err := s.OpenEventStream(watcher); err == nil {
+		t.Error("Opened event stream for closed session")
+	}
+}
+
+func DoServerTest_EventStreamRedelivery(t *testing.T, s Server) {
+	ne := func(m string, e error) {
+		if e != nil {
+			t.Error(m, e)
+		}
+	}
+
+	watcher, err := s.OpenSession(NewRequestID())
+	ne("Error opening session:", err)
+	watcherNd, err := s.Open(NewRequestID(), watcher, "/foo/redelivered", false, false, EventsConfig{ContentModified: true})
+	ne("Error opening /foo/redelivered:", err)
+
+	stream, err := s.OpenEventStream(watcher)
+	if err != nil {
+		t.Fatal("Error opening event stream:", err)
+	}
+	ne("Error sending keepalive:", stream.KeepAlive(LeaseInfo{Session: watcher}, nil))
+
+	set := make(chan error, 1)
+	go func() {
+		_, err := s.SetContent(NewRequestID(), watcherNd, "redelivered", 0)
+		set <- err
+	}()
+
+	events, err := stream.Recv()
+	ne("Error receiving events:", err)
+	if len(events) != 1 || events[0].Seq != 1 {
+		t.Fatal("Got wrong events:", events)
+	}
+
+	// the event is lost along with the stream before it is acked, so the next stream gets it again
+	stream.Close()
+	stream, err = s.OpenEventStream(watcher)
+	if err != nil {
+		t.Fatal("Error reopening event stream:", err)
+	}
+	defer stream.Close()
+	ne("Error sending keepalive:", stream.KeepAlive(LeaseInfo{Session: watcher}, nil))
+
+	redelivered, err := stream.Recv()
+	ne("Error receiving redelivered events:", err)
+	if len(redelivered) != 1 || redelivered[0].Seq != 1 {
+		t.Fatal("Got wrong redelivered events:", redelivered)
+	} else if event, ok := redelivered[0].Event.(ContentInvalidationPushEvent); !ok || event.Descriptor != watcherNd {
+		t.Fatal("Expected ContentInvalidationPushEvent, got:", redelivered[0].Event)
+	}
+
+	ne("Error acking events:", stream.Ack(redelivered[0].Seq))
+	ne("Error SetContent:", <-set)
+
+	// the keepalives report the last event received, which acks it for good
+	go func() {
+		_, err := s.SetContent(NewRequestID(), watcherNd, "redelivered again", 1)
+		set <- err
+	}()
+	events, err = stream.Recv()
+	ne("Error receiving events:", err)
+	if len(events) != 1 || events[0].Seq != 2 {
+		t.Fatal("Got wrong events:", events)
+	}
+	ne("Error sending keepalive:", stream.KeepAlive(LeaseInfo{Session: watcher, LastSeq: events[0].Seq}, nil))
+	ne("Error SetContent:", <-set)
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// fsmSnapshot is the serialized form of an fsmImpl. Pointers between sessions, descriptors and nodes are
+// flattened into descriptor keys and paths so that the whole thing can be gob encoded.
+type fsmSnapshot struct {
+	NextSessionKey descriptorKey
+	Sessions       []sessionSnapshot
+	Nodes          []nodeSnapshot
+	// the requests that opened or closed sessions
+	Requests []recordedRequest
+}
+
+type sessionSnapshot struct {
+	Key         descriptorKey
+	NextKey     descriptorKey
+	Descriptors []descriptorSnapshot
+	Requests    []recordedRequest
+}
+
+type descriptorSnapshot struct {
+	Key      descriptorKey
+	Path     string
+	ReadOnly bool
+	Config   EventsConfig
+}
+
+type nodeSnapshot struct {
+	Path           string
+	Content        string
+	LastModified   time.Time
+	Generation     uint64
+	Finalized      bool
+	Locker         *NodeDescriptor
+	SharedLockers  []NodeDescriptor
+	LockGeneration uint64
+	LockDelay      time.Duration
+	// the generation each of SharedLockers was granted the lock at, in the same order. snapshots from before
+	// shared holders had sequencers don't have it.
+	SharedLockGenerations []uint64
+	LockDelayEnd          time.Time
+
+	EphemeralOwner descriptorKey
+}
+
+func (fsm *fsmImpl) GetSnapshot() ([]byte, error) {
+	var snapshot fsmSnapshot
+	snapshot.Sessions, snapshot.NextSessionKey = fsm.sessions.snapshot()
+	snapshot.Nodes = fsm.nodes.snapshot()
+	snapshot.Requests = fsm.sessions.requests.snapshot()
+
+	return encodeVersioned(&snapshot)
+}
+
+func (fsm *fsmImpl) RecoverFromSnapshot(data []byte) error {
+	var snapshot fsmSnapshot
+	if err := decodeVersioned(data, &snapshot); err != nil {
+		return err
+	}
+
+	nodes := make(map[string]*nodeInfo)
+	for _, ns := range snapshot.Nodes {
+		nodes[ns.Path] = &nodeInfo{
+			path:         ns.Path,
+			content:      ns.Content,
+			lastModified: ns.LastModified,
+			generation:   ns.Generation,
+			finalized:    ns.Finalized,
+
+			lockGeneration: ns.LockGeneration,
+			lockDelay:      ns.LockDelay,
+			lockDelayEnd:   ns.LockDelayEnd,
+			ephemeralOwner: ns.EphemeralOwner,
+		}
+	}
+
+	sessions := make(map[descriptorKey]*clientSession)
+	for _, ss := range snapshot.Sessions {
+		cs := newClientSession(ss.Key)
+		cs.nextKey = ss.NextKey
+		cs.requests.restore(ss.Requests)
+		for _, ds := range ss.Descriptors {
+			ni, ok := nodes[ds.Path]
+			if !ok {
+				ni = &nodeInfo{path: ds.Path, finalized: true}
+				nodes[ds.Path] = ni
+			}
+
+			cs.data[ds.Key] = &nodeDescriptor{cs, ds.Key, ni, ds.ReadOnly, ds.Config}
+			cs.ndsByPath[ds.Path] = append(cs.ndsByPath[ds.Path], ds.Key)
+		}
+		sessions[ss.Key] = cs
+	}
+
+	// CloseNode releases the locks held through the descriptor, but snapshots taken before it did can still have
+	// them. nothing could ever release such a lock, so drop it.
+	getLocker := func(nd NodeDescriptor) *nodeDescriptor {
+		locker := sessions[nd.Session.Descriptor].GetDescriptor(nd.Descriptor)
+		if locker == nil {
+			log.Println("dropping lock held by closed descriptor:", nd)
+		}
+		return locker
+	}
+
+	for _, ns := range snapshot.Nodes {
+		ni := nodes[ns.Path]
+		if ns.Locker != nil {
+			ni.locker = getLocker(*ns.Locker)
+		}
+
+		for i, nd := range ns.SharedLockers {
+			if locker := getLocker(nd); locker != nil {
+				if ni.sharedLockers == nil {
+					ni.sharedLockers = make(map[*nodeDescriptor]uint64)
+				}
+				generation := ns.LockGeneration
+				if i < len(ns.SharedLockGenerations) {
+					generation = ns.SharedLockGenerations[i]
+				}
+				ni.sharedLockers[locker] = generation
+			}
+		}
+	}
+
+	fsm.nodes.restore(nodes)
+	fsm.sessions.restore(sessions, snapshot.NextSessionKey)
+	fsm.sessions.requests.restore(snapshot.Requests)
+	return nil
+}
+
+func (sdm *sessionDescriptorMap) snapshot() ([]sessionSnapshot, descriptorKey) {
+	sdm.lock.RLock()
+	defer sdm.lock.RUnlock()
+
+	var sss []sessionSnapshot
+	for _, cs := range sdm.data {
+		sss = append(sss, cs.snapshot())
+	}
+	return sss, sdm.nextKey
+}
+
+func (sdm *sessionDescriptorMap) restore(data map[descriptorKey]*clientSession, nextKey descriptorKey) {
+	sdm.lock.Lock()
+	defer sdm.lock.Unlock()
+
+	sdm.data = data
+	sdm.nextKey = nextKey
+}
+
+func (cs *clientSession) snapshot() sessionSnapshot {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+
+	ss := sessionSnapshot{Key: cs.key, NextKey: cs.nextKey, Requests: cs.requests.snapshot()}
+	for key, nd := range cs.data {
+		ss.Descriptors = append(ss.Descriptors, descriptorSnapshot{key, nd.ni.path, nd.readOnly, nd.config})
+	}
+	return ss
+}
+
+func (nim *nodeInfoMap) snapshot() []nodeSnapshot {
+	nim.lock.RLock()
+	defer nim.lock.RUnlock()
+
+	var nss []nodeSnapshot
+	for _, ni := range nim.data {
+		nss = append(nss, ni.snapshot())
+	}
+	return nss
+}
+
+func (nim *nodeInfoMap) restore(data map[string]*nodeInfo) {
+	nim.lock.Lock()
+	defer nim.lock.Unlock()
+
+	nim.data = data
+	nim.children = make(map[string]map[string]struct{})
+	for path := range data {
+		nim.addToParents(path)
+	}
+}
+
+func (ni *nodeInfo) snapshot() nodeSnapshot {
+	ni.lock.RLock()
+	defer ni.lock.RUnlock()
+
+	ns := nodeSnapshot{
+		Path:           ni.path,
+		Content:        ni.content,
+		LastModified:   ni.lastModified,
+		Generation:     ni.generation,
+		Finalized:      ni.finalized,
+		LockGeneration: ni.lockGeneration,
+		LockDelay:      ni.lockDelay,
+		LockDelayEnd:   ni.lockDelayEnd,
+
+		EphemeralOwner: ni.ephemeralOwner,
+	}
+	if ni.locker != nil {
+		locker := ni.locker.GetND()
+		ns.Locker = &locker
+	}
+	for locker, generation := range ni.sharedLockers {
+		ns.SharedLockers = append(ns.SharedLockers, locker.GetND())
+		ns.SharedLockGenerations = append(ns.SharedLockGenerations, generation)
+	}
+	return ns
+}